@@ -1,6 +1,7 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -8,7 +9,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -22,7 +25,16 @@ type TestOptions struct {
 	ServerAddr    string
 	TestLogger    io.Writer
 	Bypass        bool
+	DryRun        bool
 	GoTestOptions []string
+	// The selectors composed with `+`, like `influenced+failed`. If empty, the selector in the configuration file is used.
+	Selector string
+	// The max number of times each failed test is retried. If 0, the number in the configuration file is used.
+	Retries int
+	// The contents of the unsaved files, keyed by the path. See `common.TestRequest`.
+	Overlay map[string]string
+	// The environment variables of the go test command. If nil, they are collected by `common.CollectEnv`.
+	Env map[string]string
 }
 
 // TestAction runs the test of the packages related to the specified file.
@@ -35,27 +47,24 @@ func TestAction(ctx context.Context, query string, options TestOptions) error {
 		return errors.New("the range is not supported")
 	}
 
-	if !filepath.IsAbs(path) {
-		curr, err := os.Getwd()
-		if err != nil {
-			return fmt.Errorf("failed to find the abs path: %w", err)
-		}
-		path = filepath.Join(curr, path)
+	path, err = toAbsPath(path)
+	if err != nil {
+		return err
 	}
 
-	reqData := common.TestRequest{Bypass: options.Bypass, Path: path, GoTestOptions: options.GoTestOptions}
-	reqBody, err := json.Marshal(&reqData)
+	overlay, err := toAbsOverlay(options.Overlay)
 	if err != nil {
 		return err
 	}
 
-	url := fmt.Sprintf("http://%s%s", options.ServerAddr, common.TestPath)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, bytes.NewBuffer(reqBody))
+	env, err := requestEnv(path, options.Env)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	reqData := common.TestRequest{Bypass: options.Bypass, DryRun: options.DryRun, Path: path, GoTestOptions: options.GoTestOptions, Overlay: overlay, Env: env,
+		Selector: options.Selector, Retries: options.Retries}
+	resp, err := sendRequest(ctx, options.ServerAddr, common.TestPath, &reqData)
 	if err != nil {
 		return err
 	} else if resp.StatusCode != http.StatusOK {
@@ -71,6 +80,10 @@ func TestAction(ctx context.Context, query string, options TestOptions) error {
 // HintOptions represents the options which the hint action accepts.
 type HintOptions struct {
 	ServerAddr string
+	// The unit of the columns in the line-based ranges. See `common.HintRequest`.
+	ColumnUnit string
+	// The contents of the unsaved files, keyed by the path. See `common.HintRequest`.
+	Overlay map[string]string
 }
 
 // HintAction hints the recent change of the specified file.
@@ -81,55 +94,521 @@ func HintAction(ctx context.Context, query string, options HintOptions) error {
 		return err
 	}
 
-	if !filepath.IsAbs(path) {
-		curr, err := os.Getwd()
-		if err != nil {
-			return fmt.Errorf("failed to find the abs path: %w", err)
+	path, err = toAbsPath(path)
+	if err != nil {
+		return err
+	}
+
+	overlay, err := toAbsOverlay(options.Overlay)
+	if err != nil {
+		return err
+	}
+
+	reqData := common.HintRequest{Path: path, Ranges: ranges, ColumnUnit: options.ColumnUnit, Overlay: overlay}
+	resp, err := sendRequest(ctx, options.ServerAddr, common.HintPath, &reqData)
+	if err != nil {
+		return err
+	} else if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to hint the recent change: %s:\n%s", resp.Status, string(body))
+	}
+
+	return nil
+}
+
+// ExplainOptions represents the options which the explain action accepts.
+type ExplainOptions struct {
+	ServerAddr string
+	Writer     io.Writer
+	// print the raw json response if true.
+	JSON          bool
+	GoTestOptions []string
+	// The selectors composed with `+`. See `TestOptions`.
+	Selector string
+	// The environment variables of the go test command. If nil, they are collected by `common.CollectEnv`.
+	Env map[string]string
+}
+
+// ExplainAction explains why each test function in the package is selected or not.
+// If the path is relative, it assumes it's the relative path from the current working directory.
+func ExplainAction(ctx context.Context, query string, options ExplainOptions) error {
+	path, ranges, err := parseQuery(query)
+	if err != nil {
+		return err
+	} else if len(ranges) > 0 {
+		return errors.New("the range is not supported")
+	}
+
+	path, err = toAbsPath(path)
+	if err != nil {
+		return err
+	}
+
+	env, err := requestEnv(path, options.Env)
+	if err != nil {
+		return err
+	}
+
+	reqData := common.TestRequest{Path: path, GoTestOptions: options.GoTestOptions, Env: env, Selector: options.Selector}
+	resp, err := sendRequest(ctx, options.ServerAddr, common.ExplainPath, &reqData)
+	if err != nil {
+		return err
+	} else if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to explain the test selection: %s:\n%s", resp.Status, string(body))
+	}
+
+	if options.JSON {
+		_, err = io.Copy(options.Writer, resp.Body)
+		return err
+	}
+
+	var explanation common.ExplainResponse
+	if err := json.NewDecoder(resp.Body).Decode(&explanation); err != nil {
+		return fmt.Errorf("failed to decode the response: %w", err)
+	}
+	printExplanation(options.Writer, explanation)
+	return nil
+}
+
+func printExplanation(w io.Writer, explanation common.ExplainResponse) {
+	fmt.Fprintf(w, "Changed: [%s]\n", strings.Join(explanation.Changed, ", "))
+	for _, e := range explanation.Explain {
+		if !e.Selected {
+			fmt.Fprintf(w, "%s: not selected\n", e.TestFunction)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: selected\n", e.TestFunction)
+		for _, c := range e.Chains {
+			var elems []string
+			for _, elem := range c {
+				if elem.Position == "" {
+					elems = append(elems, elem.Name)
+				} else {
+					elems = append(elems, fmt.Sprintf("%s (%s)", elem.Name, elem.Position))
+				}
+			}
+			fmt.Fprintf(w, "    %s\n", strings.Join(elems, " -> "))
 		}
-		path = filepath.Join(curr, path)
 	}
+}
 
-	reqData := common.HintRequest{Path: path, Ranges: ranges}
-	reqBody, err := json.Marshal(&reqData)
+// AffectedOptions represents the options which the affected action accepts.
+type AffectedOptions struct {
+	ServerAddr string
+	Writer     io.Writer
+	// The unit of the columns in the line-based ranges. See `common.AffectedRequest`.
+	ColumnUnit string
+	// print the raw json response if true.
+	JSON          bool
+	GoTestOptions []string
+	// The environment variables of the go test command. If nil, they are collected by `common.CollectEnv`.
+	Env map[string]string
+}
+
+// AffectedAction prints the test functions affected by the hypothetical change of the specified ranges.
+// If the path is relative, it assumes it's the relative path from the current working directory.
+func AffectedAction(ctx context.Context, query string, options AffectedOptions) error {
+	path, ranges, err := parseQuery(query)
 	if err != nil {
 		return err
 	}
 
-	url := fmt.Sprintf("http://%s%s", options.ServerAddr, common.HintPath)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, bytes.NewBuffer(reqBody))
+	path, err = toAbsPath(path)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	env, err := requestEnv(path, options.Env)
+	if err != nil {
+		return err
+	}
+
+	reqData := common.AffectedRequest{Path: path, Ranges: ranges, ColumnUnit: options.ColumnUnit, GoTestOptions: options.GoTestOptions, Env: env}
+	resp, err := sendRequest(ctx, options.ServerAddr, common.AffectedPath, &reqData)
 	if err != nil {
 		return err
 	} else if resp.StatusCode != http.StatusOK {
 		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("failed to hint the recent change: %s:\n%s", resp.Status, string(body))
+		return fmt.Errorf("failed to find the affected tests: %s:\n%s", resp.Status, string(body))
+	}
+
+	if options.JSON {
+		_, err = io.Copy(options.Writer, resp.Body)
+		return err
+	}
+
+	var affected common.AffectedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&affected); err != nil {
+		return fmt.Errorf("failed to decode the response: %w", err)
+	}
+	for _, f := range affected.TestFunctions {
+		fmt.Fprintln(options.Writer, f)
+	}
+	return nil
+}
+
+// FailedOptions represents the options which the failed action accepts.
+type FailedOptions struct {
+	ServerAddr string
+	Writer     io.Writer
+	// print the raw json response if true.
+	JSON bool
+}
+
+// FailedAction prints the tests which failed and haven't passed since, in the packages under the workspace directory.
+// If the path is relative, it assumes it's the relative path from the current working directory.
+func FailedAction(ctx context.Context, workspace string, options FailedOptions) error {
+	workspace, err := toAbsPath(workspace)
+	if err != nil {
+		return err
+	}
+
+	reqData := common.FailedRequest{Path: workspace}
+	resp, err := sendRequest(ctx, options.ServerAddr, common.FailedPath, &reqData)
+	if err != nil {
+		return err
+	} else if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to list the failed tests: %s:\n%s", resp.Status, string(body))
+	}
+
+	if options.JSON {
+		_, err = io.Copy(options.Writer, resp.Body)
+		return err
 	}
 
+	var failed common.FailedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&failed); err != nil {
+		return fmt.Errorf("failed to decode the response: %w", err)
+	}
+	for _, pkg := range failed.Packages {
+		fmt.Fprintf(options.Writer, "%s\n", pkg.PackageDir)
+		for _, f := range pkg.TestFunctions {
+			fmt.Fprintf(options.Writer, "    %s\n", f)
+		}
+	}
 	return nil
 }
 
+// FlakyOptions represents the options which the flaky action accepts.
+type FlakyOptions struct {
+	ServerAddr string
+	Writer     io.Writer
+	// print the raw json response if true.
+	JSON bool
+}
+
+// FlakyAction prints the tests which failed but passed on retry, in the packages under the workspace directory.
+// If the path is relative, it assumes it's the relative path from the current working directory.
+func FlakyAction(ctx context.Context, workspace string, options FlakyOptions) error {
+	workspace, err := toAbsPath(workspace)
+	if err != nil {
+		return err
+	}
+
+	reqData := common.FlakyRequest{Path: workspace}
+	resp, err := sendRequest(ctx, options.ServerAddr, common.FlakyPath, &reqData)
+	if err != nil {
+		return err
+	} else if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to list the flaky tests: %s:\n%s", resp.Status, string(body))
+	}
+
+	if options.JSON {
+		_, err = io.Copy(options.Writer, resp.Body)
+		return err
+	}
+
+	var flaky common.FlakyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&flaky); err != nil {
+		return fmt.Errorf("failed to decode the response: %w", err)
+	}
+	pkgDir := ""
+	for _, test := range flaky.Tests {
+		if test.PackageDir != pkgDir {
+			pkgDir = test.PackageDir
+			fmt.Fprintf(options.Writer, "%s\n", pkgDir)
+		}
+		fmt.Fprintf(options.Writer, "    %s: flaky in %d of %d runs\n", test.TestFunction, test.Flakes, test.Runs)
+	}
+	return nil
+}
+
+// WatchOptions represents the options which the watch action accepts.
+type WatchOptions struct {
+	ServerAddr string
+	Writer     io.Writer
+	// print the raw json events if true.
+	JSON bool
+	// print the test output if true.
+	Verbose bool
+}
+
+// WatchAction prints the events of the jobs which test the packages under the workspace directory,
+// until the context is canceled or the server closes the connection.
+// If the path is relative, it assumes it's the relative path from the current working directory.
+func WatchAction(ctx context.Context, workspace string, options WatchOptions) error {
+	workspace, err := toAbsPath(workspace)
+	if err != nil {
+		return err
+	}
+
+	if _, err := checkServerVersion(ctx, options.ServerAddr); err != nil {
+		return err
+	}
+
+	httpClient, baseURL := newHTTPClient(options.ServerAddr)
+	reqURL := fmt.Sprintf("%s%s?workspace=%s", baseURL, common.EventsPath, url.QueryEscape(workspace))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	setAuthToken(req, options.ServerAddr)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to watch the events: %s:\n%s", resp.Status, string(body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+			continue
+		} else if line != "" || data == "" {
+			// ignore the event name, the comment and so on. The event type is included in the data.
+			continue
+		}
+
+		if options.JSON {
+			fmt.Fprintln(options.Writer, data)
+		} else {
+			var ev common.Event
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				return fmt.Errorf("failed to decode the event: %w", err)
+			}
+			printEvent(options.Writer, ev, options.Verbose)
+		}
+		data = ""
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func printEvent(w io.Writer, ev common.Event, verbose bool) {
+	prefix := fmt.Sprintf("%s [job #%d]", ev.Time.Format("15:04:05"), ev.JobID)
+	switch ev.Type {
+	case common.EventTypeJobStarted:
+		fmt.Fprintf(w, "%s start %s: [%s]\n", prefix, ev.PackageDir, strings.Join(ev.TestFunctions, ", "))
+	case common.EventTypeOutput:
+		if verbose {
+			fmt.Fprintf(w, "%s %s\n", prefix, ev.Output)
+		}
+	case common.EventTypeTestResult:
+		fmt.Fprintf(w, "%s %s: %s (%.2fs)\n", prefix, ev.Result, ev.TestFunction, ev.Elapsed)
+	case common.EventTypeJobFinished:
+		fmt.Fprintf(w, "%s finish %s: %s (%.2fs)\n", prefix, ev.PackageDir, ev.Result, ev.Elapsed)
+		if len(ev.FlakyTestFunctions) > 0 {
+			fmt.Fprintf(w, "%s flaky: [%s]\n", prefix, strings.Join(ev.FlakyTestFunctions, ", "))
+		}
+	}
+}
+
+// sendRequest checks the version of the server and the fields the request sets, and sends the request to the server.
+// The caller must check the status code of the response.
+func sendRequest(ctx context.Context, serverAddr, apiPath string, reqData interface{}) (*http.Response, error) {
+	info, err := checkServerVersion(ctx, serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRequestFields(info, apiPath, reqData); err != nil {
+		return nil, err
+	}
+	return doRequest(ctx, serverAddr, apiPath, reqData)
+}
+
+// doRequest sends the request to the server. The caller must check the status code of the response.
+// If the server is not running and the auto start is enabled, it starts the server and sends the request again.
+func doRequest(ctx context.Context, serverAddr, apiPath string, reqData interface{}) (*http.Response, error) {
+	reqBody, err := json.Marshal(reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, baseURL := newHTTPClient(serverAddr)
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+apiPath, bytes.NewBuffer(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		setAuthToken(req, serverAddr)
+		return httpClient.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil && autoStartEnabled && isConnectionError(err) {
+		fmt.Fprintf(os.Stderr, "starting the server at %s\n", serverAddr)
+		if err := StartServer(ctx, serverAddr); err != nil {
+			return nil, fmt.Errorf("failed to start the server: %w", err)
+		}
+		return send()
+	}
+	return resp, err
+}
+
+// setAuthToken sets the token which the server writes to the token file. No token is set if the file doesn't exist.
+func setAuthToken(req *http.Request, serverAddr string) {
+	token, err := ioutil.ReadFile(common.TokenPath(serverAddr))
+	if err != nil {
+		return
+	}
+	req.Header.Set(common.AuthTokenHeader, strings.TrimSpace(string(token)))
+}
+
+// newHTTPClient returns the http client which connects to the server and the base url of the APIs.
+// The server address is `unix:/path/to/socket` or `host:port`.
+func newHTTPClient(serverAddr string) (*http.Client, string) {
+	network, address := common.ParseServerAddr(serverAddr)
+	if network != "unix" {
+		return http.DefaultClient, "http://" + address
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", address)
+		},
+	}
+	// the host is not used to connect, but required to build the url.
+	return &http.Client{Transport: transport}, "http://unix"
+}
+
+// toAbsPath converts the relative path from the current working directory to the abs path.
+func toAbsPath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+
+	curr, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the abs path: %w", err)
+	}
+	return filepath.Join(curr, path), nil
+}
+
+// toAbsOverlay converts the relative paths in the overlay to the abs paths.
+func toAbsOverlay(overlay map[string]string) (map[string]string, error) {
+	if len(overlay) == 0 {
+		return nil, nil
+	}
+
+	absOverlay := make(map[string]string)
+	for path, content := range overlay {
+		absPath, err := toAbsPath(path)
+		if err != nil {
+			return nil, err
+		}
+		absOverlay[absPath] = content
+	}
+	return absOverlay, nil
+}
+
+// ReadOverlayFile reads the overlay file in the format of the `-overlay` option of the go command:
+// {"Replace": {"path/to/file.go": "path/to/unsaved/content.go"}}.
+// It returns the contents of the unsaved files, keyed by the path.
+func ReadOverlayFile(overlayPath string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(overlayPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the overlay file: %w", err)
+	}
+
+	var overlayJSON struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(data, &overlayJSON); err != nil {
+		return nil, fmt.Errorf("failed to parse the overlay file: %w", err)
+	}
+
+	overlay := make(map[string]string)
+	for path, replacePath := range overlayJSON.Replace {
+		if replacePath == "" {
+			// the deleted file is not supported
+			continue
+		}
+		content, err := ioutil.ReadFile(replacePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the overlay file: %w", err)
+		}
+		overlay[path] = string(content)
+	}
+	return overlay, nil
+}
+
+// parseQuery splits the query into the path and the ranges. The ranges follow the `:` after the last character which
+// can't be in the ranges, so the path may contain `:` (e.g. `C:\path\to\file.go:#1`).
+// If the ranges are invalid but the whole query is the existing file, the query is considered to be the path.
 func parseQuery(pathAndRange string) (string, []common.Range, error) {
-	chunks := strings.Split(pathAndRange, ":")
-	if len(chunks) > 2 {
-		return "", nil, errors.New("too many `:`")
-	} else if len(chunks) == 1 {
+	index := findRangeSeparator(pathAndRange)
+	if index == -1 {
 		return pathAndRange, nil, nil
-	} else if chunks[1] == "" {
-		return "", nil, errors.New("range is not specified")
 	}
 
-	path := chunks[0]
-	ranges, err := parseRanges(chunks[1])
-	return path, ranges, err
+	path, rawRanges := pathAndRange[:index], pathAndRange[index+1:]
+	var ranges []common.Range
+	err := errors.New("range is not specified")
+	if rawRanges != "" {
+		ranges, err = parseRanges(rawRanges)
+	}
+	if err != nil {
+		if _, statErr := os.Stat(pathAndRange); statErr == nil {
+			return pathAndRange, nil, nil
+		}
+		return "", nil, err
+	}
+	return path, ranges, nil
+}
+
+// findRangeSeparator returns the index of the first `:` after which there are only the characters used in the ranges.
+// It returns -1 if there is no such `:`.
+func findRangeSeparator(pathAndRange string) int {
+	i := len(pathAndRange) - 1
+	for ; i >= 0; i-- {
+		if !strings.ContainsRune("0123456789#LC,:-", rune(pathAndRange[i])) {
+			break
+		}
+	}
+	index := strings.IndexByte(pathAndRange[i+1:], ':')
+	if index == -1 {
+		return -1
+	}
+	return i + 1 + index
 }
 
 func parseRanges(rawRanges string) (rs []common.Range, err error) {
 	ranges := strings.Split(rawRanges, ",")
 	for _, r := range ranges {
+		if strings.HasPrefix(r, "L") {
+			lineRange, err := parseLineRange(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the query: %w", err)
+			}
+			rs = append(rs, lineRange)
+			continue
+		}
+
 		r = strings.TrimPrefix(r, "#")
 
 		index := strings.Index(r, "-")
@@ -138,7 +617,7 @@ func parseRanges(rawRanges string) (rs []common.Range, err error) {
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse the query: %w", err)
 			}
-			rs = append(rs, common.Range{offset, offset})
+			rs = append(rs, common.Range{Begin: offset, End: offset})
 			continue
 		}
 
@@ -151,7 +630,56 @@ func parseRanges(rawRanges string) (rs []common.Range, err error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse the query: %w", err)
 		}
-		rs = append(rs, common.Range{begin, end})
+		rs = append(rs, common.Range{Begin: begin, End: end})
 	}
 	return rs, nil
 }
+
+// parseLineRange parses the line-based range like `L10-L20` or `L10:C5-L12:C1`.
+func parseLineRange(rawRange string) (common.Range, error) {
+	var r common.Range
+	var err error
+	chunks := strings.Split(rawRange, "-")
+	switch len(chunks) {
+	case 1:
+		r.BeginLine, r.BeginColumn, err = parseLinePosition(chunks[0])
+		r.EndLine, r.EndColumn = r.BeginLine, r.BeginColumn
+	case 2:
+		r.BeginLine, r.BeginColumn, err = parseLinePosition(chunks[0])
+		if err == nil {
+			r.EndLine, r.EndColumn, err = parseLinePosition(chunks[1])
+		}
+	default:
+		err = errors.New("too many `-`")
+	}
+	return r, err
+}
+
+// parseLinePosition parses the position like `L10` or `L10:C5`.
+func parseLinePosition(rawPosition string) (line, column int, err error) {
+	chunks := strings.Split(rawPosition, ":")
+	if len(chunks) > 2 || !strings.HasPrefix(chunks[0], "L") {
+		return 0, 0, fmt.Errorf("invalid position: %s", rawPosition)
+	}
+
+	line, err = strconv.Atoi(strings.TrimPrefix(chunks[0], "L"))
+	if err != nil {
+		return 0, 0, err
+	} else if line <= 0 {
+		return 0, 0, fmt.Errorf("invalid line: %d", line)
+	}
+	if len(chunks) == 1 {
+		return line, 0, nil
+	}
+
+	if !strings.HasPrefix(chunks[1], "C") {
+		return 0, 0, fmt.Errorf("invalid position: %s", rawPosition)
+	}
+	column, err = strconv.Atoi(strings.TrimPrefix(chunks[1], "C"))
+	if err != nil {
+		return 0, 0, err
+	} else if column <= 0 {
+		return 0, 0, fmt.Errorf("invalid column: %d", column)
+	}
+	return line, column, nil
+}
@@ -3,10 +3,14 @@ package client_test
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -51,6 +55,53 @@ func TestTestAction_BadRequest(t *testing.T) {
 	}
 }
 
+func TestTestAction_Env(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, common.ConfigFileName), []byte("env: [NOISEGATE_TEST_DATABASE_URL]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("NOISEGATE_TEST_DATABASE_URL", "postgres://localhost/test")
+	defer os.Unsetenv("NOISEGATE_TEST_DATABASE_URL")
+	os.Setenv("CGO_ENABLED", "0")
+	defer os.Unsetenv("CGO_ENABLED")
+	os.Setenv("NOISEGATE_TEST_SECRET", "secret")
+	defer os.Unsetenv("NOISEGATE_TEST_SECRET")
+
+	var env map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.TestPath, func(w http.ResponseWriter, r *http.Request) {
+		req := common.TestRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode: %v", err)
+		}
+		env = req.Env
+	})
+	server := httptest.NewServer(mux)
+
+	options := client.TestOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), TestLogger: ioutil.Discard}
+	if err := client.TestAction(context.Background(), dir, options); err != nil {
+		t.Fatal(err)
+	}
+	if env["NOISEGATE_TEST_DATABASE_URL"] != "postgres://localhost/test" || env["CGO_ENABLED"] != "0" {
+		t.Errorf("the variables are not sent: %v", env)
+	}
+	if _, ok := env["NOISEGATE_TEST_SECRET"]; ok {
+		t.Errorf("the unselected variable is sent: %v", env)
+	}
+
+	options.Env = map[string]string{"GOOS": "windows"}
+	if err := client.TestAction(context.Background(), dir, options); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(options.Env, env) {
+		t.Errorf("unexpected env: %v", env)
+	}
+}
+
 func TestTestAction_RelativePath(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc(common.TestPath, func(w http.ResponseWriter, r *http.Request) {
@@ -74,6 +125,25 @@ func TestTestAction_RelativePath(t *testing.T) {
 	}
 }
 
+func TestTestAction_DryRun(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.TestPath, func(w http.ResponseWriter, r *http.Request) {
+		req := common.TestRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode: %v", err)
+		}
+		if !req.DryRun {
+			t.Errorf("dry run is not requested")
+		}
+	})
+	server := httptest.NewServer(mux)
+
+	options := client.TestOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), TestLogger: &strings.Builder{}, DryRun: true}
+	if err := client.TestAction(context.Background(), "/path/to/test/dir", options); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestTestAction_RangeIsSpecified(t *testing.T) {
 	server := httptest.NewServer(http.NewServeMux())
 
@@ -100,11 +170,11 @@ func TestHintAction_Offsets(t *testing.T) {
 		expect []common.Range
 		err    bool
 	}{
-		{"#1", []common.Range{{1, 1}}, false},
-		{"#1-2", []common.Range{{1, 2}}, false},
-		{"#1-2,#3-4", []common.Range{{1, 2}, {3, 4}}, false},
-		{"#1,#2", []common.Range{{1, 1}, {2, 2}}, false},
-		{"#1,2", []common.Range{{1, 1}, {2, 2}}, false},
+		{"#1", []common.Range{{Begin: 1, End: 1}}, false},
+		{"#1-2", []common.Range{{Begin: 1, End: 2}}, false},
+		{"#1-2,#3-4", []common.Range{{Begin: 1, End: 2}, {Begin: 3, End: 4}}, false},
+		{"#1,#2", []common.Range{{Begin: 1, End: 1}, {Begin: 2, End: 2}}, false},
+		{"#1,2", []common.Range{{Begin: 1, End: 1}, {Begin: 2, End: 2}}, false},
 		{"#1:#2", nil, true},
 		{"#1-", nil, true},
 		{"", nil, true},
@@ -125,6 +195,133 @@ func TestHintAction_Offsets(t *testing.T) {
 	}
 }
 
+func TestHintAction_Lines(t *testing.T) {
+	mux := http.NewServeMux()
+	var req common.HintRequest
+	mux.HandleFunc(common.HintPath, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(data, &req)
+	})
+	server := httptest.NewServer(mux)
+
+	for _, testdata := range []struct {
+		lines  string
+		expect []common.Range
+		err    bool
+	}{
+		{"L10", []common.Range{{BeginLine: 10, EndLine: 10}}, false},
+		{"L10-L20", []common.Range{{BeginLine: 10, EndLine: 20}}, false},
+		{"L10:C5-L12:C1", []common.Range{{BeginLine: 10, BeginColumn: 5, EndLine: 12, EndColumn: 1}}, false},
+		{"L1-L2,#3-4", []common.Range{{BeginLine: 1, EndLine: 2}, {Begin: 3, End: 4}}, false},
+		{"L10:5", nil, true},
+		{"L0", nil, true},
+		{"L1:C0", nil, true},
+		{"L1-L2-L3", nil, true},
+		{"L1:C1:C2", nil, true},
+	} {
+		req = common.HintRequest{}
+		query := "/path/to/test/file:" + testdata.lines
+		options := client.HintOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), ColumnUnit: common.ColumnUnitUTF16}
+		err := client.HintAction(context.Background(), query, options)
+		if err != nil {
+			if !testdata.err {
+				t.Fatal(err)
+			}
+			continue
+		} else if testdata.err {
+			t.Fatalf("not error: %s", testdata.lines)
+		}
+
+		if !reflect.DeepEqual(testdata.expect, req.Ranges) {
+			t.Errorf("unexpected ranges: %#v", req.Ranges)
+		}
+		if req.ColumnUnit != common.ColumnUnitUTF16 {
+			t.Errorf("unexpected column unit: %s", req.ColumnUnit)
+		}
+	}
+}
+
+func TestHintAction_PathWithColon(t *testing.T) {
+	mux := http.NewServeMux()
+	var req common.HintRequest
+	mux.HandleFunc(common.HintPath, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(data, &req)
+	})
+	server := httptest.NewServer(mux)
+
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	existingFile := filepath.Join(dir, "file:1-")
+	if err := ioutil.WriteFile(existingFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, testdata := range []struct {
+		query      string
+		expectPath string
+		expect     []common.Range
+	}{
+		{"/path/to/a:b/file:#1", "/path/to/a:b/file", []common.Range{{Begin: 1, End: 1}}},
+		{"/path/to/a:b/file:L1:C2", "/path/to/a:b/file", []common.Range{{BeginLine: 1, BeginColumn: 2, EndLine: 1, EndColumn: 2}}},
+		{"/path/to/a:b/file", "/path/to/a:b/file", nil},
+		{existingFile, existingFile, nil},
+	} {
+		req = common.HintRequest{}
+		options := client.HintOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://")}
+		if err := client.HintAction(context.Background(), testdata.query, options); err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if req.Path != testdata.expectPath || !reflect.DeepEqual(testdata.expect, req.Ranges) {
+			t.Errorf("[%d] unexpected request: %#v", i, req)
+		}
+	}
+}
+
+func TestHintAction_Overlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contentPath := filepath.Join(dir, "sum.go")
+	if err := ioutil.WriteFile(contentPath, []byte("package sum\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	overlayPath := filepath.Join(dir, "overlay.json")
+	overlayJSON := fmt.Sprintf(`{"Replace": {"relative/sum.go": %q}}`, contentPath)
+	if err := ioutil.WriteFile(overlayPath, []byte(overlayJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	overlay, err := client.ReadOverlayFile(overlayPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	var req common.HintRequest
+	mux.HandleFunc(common.HintPath, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(data, &req)
+	})
+	server := httptest.NewServer(mux)
+
+	options := client.HintOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), Overlay: overlay}
+	if err := client.HintAction(context.Background(), "relative/sum.go:#1", options); err != nil {
+		t.Fatal(err)
+	}
+
+	curr, _ := os.Getwd()
+	expect := map[string]string{filepath.Join(curr, "relative", "sum.go"): "package sum\n"}
+	if !reflect.DeepEqual(expect, req.Overlay) {
+		t.Errorf("unexpected overlay: %#v", req.Overlay)
+	}
+}
+
 func TestHintAction_RelativePath(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc(common.HintPath, func(w http.ResponseWriter, r *http.Request) {
@@ -146,3 +343,259 @@ func TestHintAction_RelativePath(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestExplainAction(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.ExplainPath, func(w http.ResponseWriter, r *http.Request) {
+		resp := common.ExplainResponse{
+			Changed: []string{"Sum"},
+			Explain: []common.Explanation{
+				{TestFunction: "TestSum", Selected: true, Chains: [][]common.ChainElement{{{Name: "Sum", Position: "sum.go:3"}, {Name: "TestSum", Position: "sum_test.go:8"}}}},
+				{TestFunction: "TestSub"},
+			},
+		}
+		json.NewEncoder(w).Encode(&resp)
+	})
+	server := httptest.NewServer(mux)
+
+	out := &strings.Builder{}
+	options := client.ExplainOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), Writer: out}
+	if err := client.ExplainAction(context.Background(), "/path/to/test/dir", options); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `Changed: [Sum]
+TestSum: selected
+    Sum (sum.go:3) -> TestSum (sum_test.go:8)
+TestSub: not selected
+`
+	if out.String() != expect {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
+
+func TestAffectedAction(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.AffectedPath, func(w http.ResponseWriter, r *http.Request) {
+		req := common.AffectedRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode: %v", err)
+		}
+		if !reflect.DeepEqual(req.Ranges, []common.Range{{Begin: 100, End: 200}}) {
+			t.Errorf("wrong ranges: %#v", req.Ranges)
+		}
+
+		resp := common.AffectedResponse{Changed: []string{"Sum"}, TestFunctions: []string{"TestSum", "TestSum_Add1"}}
+		json.NewEncoder(w).Encode(&resp)
+	})
+	server := httptest.NewServer(mux)
+
+	out := &strings.Builder{}
+	options := client.AffectedOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), Writer: out}
+	if err := client.AffectedAction(context.Background(), "/path/to/sum.go:#100-200", options); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "TestSum\nTestSum_Add1\n" {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
+
+func TestFailedAction(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.FailedPath, func(w http.ResponseWriter, r *http.Request) {
+		req := common.FailedRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode: %v", err)
+		}
+		if req.Path != "/path/to" {
+			t.Errorf("wrong path: %s", req.Path)
+		}
+
+		resp := common.FailedResponse{Packages: []common.FailedPackage{{PackageDir: "/path/to/pkg", TestFunctions: []string{"TestSum", "TestSum_Add1"}}}}
+		json.NewEncoder(w).Encode(&resp)
+	})
+	server := httptest.NewServer(mux)
+
+	out := &strings.Builder{}
+	options := client.FailedOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), Writer: out}
+	if err := client.FailedAction(context.Background(), "/path/to", options); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "/path/to/pkg\n    TestSum\n    TestSum_Add1\n" {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
+
+func TestFlakyAction(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.FlakyPath, func(w http.ResponseWriter, r *http.Request) {
+		resp := common.FlakyResponse{Tests: []common.FlakyTest{
+			{PackageDir: "/path/to/a", TestFunction: "TestSum", Runs: 10, Flakes: 2},
+			{PackageDir: "/path/to/a", TestFunction: "TestSub", Runs: 3, Flakes: 1},
+			{PackageDir: "/path/to/b", TestFunction: "TestMul", Runs: 1, Flakes: 1},
+		}}
+		json.NewEncoder(w).Encode(&resp)
+	})
+	server := httptest.NewServer(mux)
+
+	out := &strings.Builder{}
+	options := client.FlakyOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), Writer: out}
+	if err := client.FlakyAction(context.Background(), "/path/to", options); err != nil {
+		t.Fatal(err)
+	}
+	expected := "/path/to/a\n    TestSum: flaky in 2 of 10 runs\n    TestSub: flaky in 1 of 3 runs\n/path/to/b\n    TestMul: flaky in 1 of 1 runs\n"
+	if out.String() != expected {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
+
+func TestWatchAction(t *testing.T) {
+	mux := http.NewServeMux()
+	var workspace string
+	mux.HandleFunc(common.EventsPath, func(w http.ResponseWriter, r *http.Request) {
+		workspace = r.URL.Query().Get("workspace")
+		w.Header().Set("Content-Type", "text/event-stream")
+		events := []common.Event{
+			{Type: common.EventTypeJobStarted, JobID: 1, PackageDir: "/path/to/pkg", TestFunctions: []string{"TestSum"}},
+			{Type: common.EventTypeOutput, JobID: 1, PackageDir: "/path/to/pkg", Output: "=== RUN   TestSum"},
+			{Type: common.EventTypeTestResult, JobID: 1, PackageDir: "/path/to/pkg", TestFunction: "TestSum", Result: "PASS", Elapsed: 0.01},
+			{Type: common.EventTypeJobFinished, JobID: 1, PackageDir: "/path/to/pkg", Result: common.JobResultSuccessful, Elapsed: 1},
+		}
+		fmt.Fprint(w, ": keep-alive\n\n")
+		for _, ev := range events {
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+	})
+	server := httptest.NewServer(mux)
+
+	var out strings.Builder
+	options := client.WatchOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), Writer: &out}
+	if err := client.WatchAction(context.Background(), "/path/to", options); err != nil {
+		t.Fatal(err)
+	}
+
+	if workspace != "/path/to" {
+		t.Errorf("wrong workspace: %s", workspace)
+	}
+	expect := `00:00:00 [job #1] start /path/to/pkg: [TestSum]
+00:00:00 [job #1] PASS: TestSum (0.01s)
+00:00:00 [job #1] finish /path/to/pkg: successful (1.00s)
+`
+	if out.String() != expect {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
+
+func TestHintAction_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "gated.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(socketPath+".token", []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	called := false
+	mux.HandleFunc(common.HintPath, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if token := r.Header.Get(common.AuthTokenHeader); token != "secret" {
+			t.Errorf("wrong token: %s", token)
+		}
+	})
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	options := client.HintOptions{ServerAddr: "unix:" + socketPath}
+	if err := client.HintAction(context.Background(), "/path/to/file:#1", options); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Errorf("the server is not called")
+	}
+}
+
+func TestHintAction_IncompatibleServer(t *testing.T) {
+	mux := http.NewServeMux()
+	called := false
+	mux.HandleFunc(common.InfoPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(common.InfoResponse{Version: "99.0.0"})
+	})
+	mux.HandleFunc(common.HintPath, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	options := client.HintOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://")}
+	err := client.HintAction(context.Background(), "/path/to/file:#1", options)
+	if err == nil || !strings.Contains(err.Error(), "not compatible") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if called {
+		t.Errorf("the hint API is called")
+	}
+}
+
+func TestHintAction_UnsupportedField(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.InfoPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(common.InfoResponse{Version: common.Version, RequestFields: map[string][]string{common.HintPath: {"path", "ranges"}}})
+	})
+	called := 0
+	mux.HandleFunc(common.HintPath, func(w http.ResponseWriter, r *http.Request) {
+		called++
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// the field with the zero value is not checked.
+	options := client.HintOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://")}
+	if err := client.HintAction(context.Background(), "/path/to/file:#1", options); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	options.Overlay = map[string]string{"/path/to/file": "package file\n"}
+	err := client.HintAction(context.Background(), "/path/to/file:#1", options)
+	if err == nil || !strings.Contains(err.Error(), "overlay") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if called != 1 {
+		t.Errorf("wrong number of calls: %d", called)
+	}
+}
+
+func TestServerInfoAction(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.InfoPath, func(w http.ResponseWriter, r *http.Request) {
+		info := common.InfoResponse{
+			Version:       common.Version,
+			RequestFields: map[string][]string{common.HintPath: {"path", "ranges"}},
+			GoVersion:     "go1.14",
+			Uptime:        61.5,
+		}
+		json.NewEncoder(w).Encode(info)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	out := &strings.Builder{}
+	options := client.ServerOptions{ServerAddr: strings.TrimPrefix(server.URL, "http://"), Writer: out}
+	if err := client.ServerInfoAction(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+	expect := fmt.Sprintf("version: %s (client: %s)\ngo version: go1.14\nuptime: 1m1s\n/cli/hint: path, ranges\n", common.Version, common.Version)
+	if out.String() != expect {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
@@ -0,0 +1,267 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+var autoStartEnabled bool
+
+// EnableAutoStart can enable or disable starting the server automatically when the client can't connect to it.
+func EnableAutoStart(enable bool) {
+	autoStartEnabled = enable
+}
+
+// the time to wait until the server starts or stops.
+const serverStartStopTimeout = 10 * time.Second
+
+// isServerRunning returns true if the server accepts the connection.
+func isServerRunning(serverAddr string) bool {
+	network, address := common.ParseServerAddr(serverAddr)
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// isConnectionError returns true if the error means the server is not running.
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// StartServer starts the server in the background and waits until it's ready.
+// The lock file prevents the multiple clients from starting the servers at the same time.
+// The log of the server is written to `common.LogPath`. The directory of the files must be owned by the current user
+// (see `common.MakeOwnDir`) and the log file is not opened through the symlink.
+func StartServer(ctx context.Context, serverAddr string) error {
+	lockPath := common.PIDPath(serverAddr) + ".lock"
+	if _, err := common.MakeOwnDir(filepath.Dir(lockPath)); err != nil {
+		return fmt.Errorf("invalid server directory: %w", err)
+	}
+	locked, err := acquireLock(lockPath)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		// another client is starting the server.
+		return waitServerReady(ctx, serverAddr, nil)
+	}
+	defer os.Remove(lockPath)
+
+	if isServerRunning(serverAddr) {
+		return nil
+	}
+
+	gatedPath, err := findGatedPath()
+	if err != nil {
+		return err
+	}
+	logPath := common.LogPath(serverAddr)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND|oNoFollow, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the log file: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(gatedPath, serverAddr)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = daemonSysProcAttr()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start the server: %w", err)
+	}
+	exitCh := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exitCh)
+	}()
+
+	if err := waitServerReady(ctx, serverAddr, exitCh); err != nil {
+		return fmt.Errorf("%w (see %s)", err, logPath)
+	}
+	return nil
+}
+
+// acquireLock creates the lock file. It returns false if the lock is held by another process.
+// The lock older than the timeout is considered stale and removed.
+func acquireLock(lockPath string) (bool, error) {
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprint(f, os.Getpid())
+			f.Close()
+			return true, nil
+		} else if !os.IsExist(err) {
+			return false, fmt.Errorf("failed to create the lock file: %w", err)
+		}
+
+		fi, err := os.Stat(lockPath)
+		if err != nil || time.Since(fi.ModTime()) < serverStartStopTimeout {
+			return false, nil
+		}
+		os.Remove(lockPath)
+	}
+	return false, nil
+}
+
+// waitServerReady waits until the server accepts the connection and writes the token.
+// `exitCh` is closed when the server process exits. It may be nil if the server is started by another process.
+func waitServerReady(ctx context.Context, serverAddr string, exitCh <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(ctx, serverStartStopTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if isServerRunning(serverAddr) {
+			if _, err := os.Stat(common.TokenPath(serverAddr)); err == nil {
+				return nil
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-exitCh:
+			return errors.New("the server exited unexpectedly")
+		case <-ctx.Done():
+			return errors.New("timed out waiting for the server to start")
+		}
+	}
+}
+
+// findGatedPath finds the server binary in the PATH or the directory of the client binary.
+func findGatedPath() (string, error) {
+	if path, err := exec.LookPath("gated"); err == nil {
+		return path, nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(filepath.Dir(exe), "gated"+filepath.Ext(exe))
+	if _, err := os.Stat(path); err != nil {
+		return "", errors.New("gated is not found in the PATH")
+	}
+	return path, nil
+}
+
+// StopServer stops the server and waits until it's stopped.
+// The process in the pid file must be the running gated owned by the current user, because the stale pid file may
+// point to the unrelated process which reused the pid.
+func StopServer(ctx context.Context, serverAddr string) error {
+	pid, err := readServerPID(serverAddr)
+	if err != nil {
+		return err
+	}
+	if err := checkServerProcess(pid); err != nil {
+		return fmt.Errorf("failed to stop the server (pid: %d): %w", pid, err)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := terminateProcess(p); err != nil {
+		return fmt.Errorf("failed to stop the server: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, serverStartStopTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for isServerRunning(serverAddr) {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return errors.New("timed out waiting for the server to stop")
+		}
+	}
+	return nil
+}
+
+func readServerPID(serverAddr string) (int, error) {
+	content, err := ioutil.ReadFile(common.PIDPath(serverAddr))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the pid file: %w", err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+// ServerOptions represents the options which the server actions accept.
+type ServerOptions struct {
+	ServerAddr string
+	Writer     io.Writer
+}
+
+// ServerStatusAction prints whether the server is running.
+func ServerStatusAction(ctx context.Context, options ServerOptions) error {
+	if !isServerRunning(options.ServerAddr) {
+		fmt.Fprintf(options.Writer, "not running at %s\n", options.ServerAddr)
+		return nil
+	}
+
+	if pid, err := readServerPID(options.ServerAddr); err == nil {
+		fmt.Fprintf(options.Writer, "running at %s (pid: %d)\n", options.ServerAddr, pid)
+	} else {
+		fmt.Fprintf(options.Writer, "running at %s\n", options.ServerAddr)
+	}
+	return nil
+}
+
+// ServerStartAction starts the server if it's not running.
+func ServerStartAction(ctx context.Context, options ServerOptions) error {
+	if isServerRunning(options.ServerAddr) {
+		fmt.Fprintf(options.Writer, "already running at %s\n", options.ServerAddr)
+		return nil
+	}
+
+	if err := StartServer(ctx, options.ServerAddr); err != nil {
+		return err
+	}
+	fmt.Fprintf(options.Writer, "started at %s\n", options.ServerAddr)
+	return nil
+}
+
+// ServerStopAction stops the server if it's running.
+func ServerStopAction(ctx context.Context, options ServerOptions) error {
+	if !isServerRunning(options.ServerAddr) {
+		fmt.Fprintf(options.Writer, "not running at %s\n", options.ServerAddr)
+		return nil
+	}
+
+	if err := StopServer(ctx, options.ServerAddr); err != nil {
+		return err
+	}
+	fmt.Fprintln(options.Writer, "stopped")
+	return nil
+}
+
+// ServerRestartAction stops the server if it's running and starts the new server.
+func ServerRestartAction(ctx context.Context, options ServerOptions) error {
+	if isServerRunning(options.ServerAddr) {
+		if err := StopServer(ctx, options.ServerAddr); err != nil {
+			return err
+		}
+	}
+
+	if err := StartServer(ctx, options.ServerAddr); err != nil {
+		return err
+	}
+	fmt.Fprintf(options.Writer, "restarted at %s\n", options.ServerAddr)
+	return nil
+}
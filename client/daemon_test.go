@@ -0,0 +1,148 @@
+package client_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-noisegate/noisegate/client"
+	"github.com/go-noisegate/noisegate/common"
+)
+
+// buildGated builds the server binary and adds its directory to the PATH.
+func buildGated(t *testing.T, dir string) {
+	binDir := filepath.Join(dir, "bin")
+	cmd := exec.Command("go", "build", "-o", filepath.Join(binDir, "gated"), "github.com/go-noisegate/noisegate/cmd/gated")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build gated: %v\n%s", err, out)
+	}
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestServerActions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	buildGated(t, dir)
+
+	addr := "unix:" + filepath.Join(dir, "gated.sock")
+	out := &strings.Builder{}
+	options := client.ServerOptions{ServerAddr: addr, Writer: out}
+	ctx := context.Background()
+
+	if err := client.ServerStatusAction(ctx, options); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ServerStartAction(ctx, options); err != nil {
+		t.Fatal(err)
+	}
+	defer client.StopServer(ctx, addr)
+	if err := client.ServerStatusAction(ctx, options); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ServerStopAction(ctx, options); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("unexpected output: %s", out.String())
+	}
+	if !strings.HasPrefix(lines[0], "not running") {
+		t.Errorf("unexpected status: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "started") {
+		t.Errorf("unexpected start: %s", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "running") || !strings.Contains(lines[2], "pid") {
+		t.Errorf("unexpected status: %s", lines[2])
+	}
+	if lines[3] != "stopped" {
+		t.Errorf("unexpected stop: %s", lines[3])
+	}
+}
+
+func TestHintAction_AutoStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	buildGated(t, dir)
+
+	addr := "unix:" + filepath.Join(dir, "gated.sock")
+	ctx := context.Background()
+	options := client.HintOptions{ServerAddr: addr}
+
+	client.EnableAutoStart(false)
+	if err := client.HintAction(ctx, filepath.Join(dir, "sum.go:#0"), options); err == nil {
+		t.Fatal("nil error")
+	}
+
+	client.EnableAutoStart(true)
+	defer client.EnableAutoStart(false)
+	path := filepath.Join(dir, "sum.go")
+	if err := ioutil.WriteFile(path, []byte("package sum\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.HintAction(ctx, path+":#0", options); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.StopServer(ctx, addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartServer_SymlinkDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	realDir := filepath.Join(dir, "real")
+	if err := os.Mkdir(realDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	linkDir := filepath.Join(dir, "link")
+	if err := os.Symlink(realDir, linkDir); err != nil {
+		t.Skip(err)
+	}
+
+	addr := "unix:" + filepath.Join(linkDir, "gated.sock")
+	if err := client.StartServer(context.Background(), addr); err == nil {
+		t.Fatal("nil error")
+	}
+	if fis, err := ioutil.ReadDir(realDir); err != nil {
+		t.Fatal(err)
+	} else if len(fis) != 0 {
+		t.Errorf("the file is created: %s", fis[0].Name())
+	}
+}
+
+func TestStopServer_NotGated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the pid file points to the test process itself, which is not gated.
+	addr := "unix:" + filepath.Join(dir, "gated.sock")
+	if err := ioutil.WriteFile(common.PIDPath(addr), []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.StopServer(context.Background(), addr); err == nil {
+		t.Fatal("nil error")
+	}
+}
@@ -0,0 +1,78 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// oNoFollow makes the open fail if the path is a symlink.
+const oNoFollow = syscall.O_NOFOLLOW
+
+// daemonSysProcAttr returns the attributes to detach the server process from the terminal of the client.
+func daemonSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// terminateProcess asks the process to shut down gracefully.
+func terminateProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
+
+// checkServerProcess returns the error if the process is not the running gated owned by the current user.
+// It uses `/proc` if available, and `ps` otherwise (e.g. macOS).
+func checkServerProcess(pid int) error {
+	uid, name, err := processOwnerAndName(pid)
+	if err != nil {
+		return err
+	}
+	if uid != os.Getuid() {
+		return errors.New("the process is owned by another user")
+	}
+	if name != "gated" {
+		return fmt.Errorf("the process is not gated: %s", name)
+	}
+	return nil
+}
+
+// processOwnerAndName returns the uid and the command name of the process.
+func processOwnerAndName(pid int) (int, string, error) {
+	procDir := filepath.Join("/proc", strconv.Itoa(pid))
+	if _, err := os.Stat("/proc/self"); err == nil {
+		fi, err := os.Stat(procDir)
+		if err != nil {
+			return 0, "", errors.New("the process is not running")
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return 0, "", errors.New("failed to get the owner of the process")
+		}
+		exe, err := os.Readlink(filepath.Join(procDir, "exe"))
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to get the executable of the process: %w", err)
+		}
+		return int(st.Uid), filepath.Base(strings.TrimSuffix(exe, " (deleted)")), nil
+	}
+
+	out, err := exec.Command("ps", "-o", "uid=,comm=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return 0, "", errors.New("the process is not running")
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return 0, "", fmt.Errorf("unexpected output of ps: %s", out)
+	}
+	uid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("unexpected output of ps: %s", out)
+	}
+	return uid, filepath.Base(strings.Join(fields[1:], " ")), nil
+}
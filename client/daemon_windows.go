@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// oNoFollow is not supported on windows, where creating the symlink requires the privilege.
+const oNoFollow = 0
+
+const (
+	createNewProcessGroup = 0x00000200
+	detachedProcess       = 0x00000008
+)
+
+// daemonSysProcAttr returns the attributes to detach the server process from the console of the client.
+func daemonSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: createNewProcessGroup | detachedProcess}
+}
+
+// terminateProcess kills the process. Windows doesn't support sending SIGTERM to another process.
+func terminateProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+// checkServerProcess returns the error if the process is not running. The owner and the name are not checked on
+// windows, where the process of another user can't be killed without the privilege.
+func checkServerProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return errors.New("the process is not running")
+	}
+	return p.Release()
+}
@@ -0,0 +1,14 @@
+package client
+
+import (
+	"github.com/go-noisegate/noisegate/common"
+)
+
+// requestEnv returns the environment variables of the request. The variables are collected from the current
+// environment if `env` is nil.
+func requestEnv(path string, env map[string]string) (map[string]string, error) {
+	if env != nil {
+		return env, nil
+	}
+	return common.CollectEnv(path)
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common"
+	"github.com/go-noisegate/noisegate/common/log"
+)
+
+// errInfoNotSupported means the server is older than the info API.
+var errInfoNotSupported = errors.New("the server doesn't support the info API")
+
+// ServerInfo returns the information of the server.
+func ServerInfo(ctx context.Context, serverAddr string) (common.InfoResponse, error) {
+	var info common.InfoResponse
+	resp, err := doRequest(ctx, serverAddr, common.InfoPath, nil)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return info, errInfoNotSupported
+	} else if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return info, fmt.Errorf("failed to get the server info: %s:\n%s", resp.Status, string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return info, fmt.Errorf("failed to decode the server info: %w", err)
+	}
+	return info, nil
+}
+
+// the information of the servers whose version is already checked, keyed by the address.
+// The value is nil if the server doesn't support the info API.
+var checkedServers sync.Map
+
+// checkServerVersion returns the error if the version of the server is not compatible with the client.
+// It prints the warning if the versions are different but compatible.
+// The server which doesn't support the info API is assumed to be compatible, and nil info is returned.
+func checkServerVersion(ctx context.Context, serverAddr string) (*common.InfoResponse, error) {
+	if info, ok := checkedServers.Load(serverAddr); ok {
+		return info.(*common.InfoResponse), nil
+	}
+
+	info, err := ServerInfo(ctx, serverAddr)
+	if err == errInfoNotSupported {
+		log.Debugf("the version of the server is unknown: %v\n", err)
+		checkedServers.Store(serverAddr, (*common.InfoResponse)(nil))
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !common.IsCompatibleVersion(common.Version, info.Version) {
+		return nil, fmt.Errorf("the server version %s is not compatible with the client version %s. Restart the server by `gate server restart`", info.Version, common.Version)
+	} else if info.Version != common.Version {
+		fmt.Fprintf(os.Stderr, "warning: the server version %s is different from the client version %s\n", info.Version, common.Version)
+	}
+	checkedServers.Store(serverAddr, &info)
+	return &info, nil
+}
+
+// checkRequestFields returns the error if the request sets the field which the API of the server doesn't support,
+// because the server ignores the unknown field. The fields with the zero value are not checked.
+// Nothing is checked if the info is nil or doesn't list the fields of the API.
+func checkRequestFields(info *common.InfoResponse, apiPath string, reqData interface{}) error {
+	if info == nil || reqData == nil {
+		return nil
+	}
+	supported, ok := info.RequestFields[apiPath]
+	if !ok {
+		return nil
+	}
+
+	raw, err := json.Marshal(reqData)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+	var unsupported []string
+	for name, value := range fields {
+		if isZeroJSON(value) || contains(supported, name) {
+			continue
+		}
+		unsupported = append(unsupported, name)
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("the server version %s doesn't support the fields of %s: %s. Restart the server by `gate server restart`", info.Version, apiPath, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// isZeroJSON returns true if the json value is the zero value of its type.
+func isZeroJSON(value json.RawMessage) bool {
+	switch string(value) {
+	case "null", `""`, "0", "false", "[]", "{}":
+		return true
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerInfoAction prints the information of the server.
+func ServerInfoAction(ctx context.Context, options ServerOptions) error {
+	info, err := ServerInfo(ctx, options.ServerAddr)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(options.Writer, "version: %s (client: %s)\n", info.Version, common.Version)
+	fmt.Fprintf(options.Writer, "go version: %s\n", info.GoVersion)
+	fmt.Fprintf(options.Writer, "uptime: %s\n", (time.Duration(info.Uptime) * time.Second).String())
+	var paths []string
+	for path := range info.RequestFields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(options.Writer, "%s: %s\n", path, strings.Join(info.RequestFields[path], ", "))
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
@@ -17,6 +18,35 @@ const testCommandDesc = testCommandUsage + `.
    Args after '--' are passed to the 'go test' command.`
 const hintCommandUsage = "Hint recent changes"
 const hintCommandDesc = hintCommandUsage + `.`
+const affectedCommandUsage = "List tests affected by the changes of the specified ranges"
+const affectedCommandDesc = affectedCommandUsage + `.
+
+   Unlike the 'hint' command, the ranges are not stored as the recent changes.
+   Args after '--' are passed to the 'go test' command.`
+const watchCommandUsage = "Watch the test jobs in real time"
+const watchCommandDesc = watchCommandUsage + `.
+
+   It prints the start, the test results and the finish of the jobs which test the packages under the directory.
+   The results of the passed tests are printed only when the tests run with the '-v' option.`
+const serverCommandUsage = "Manage the gated server"
+const serverCommandDesc = serverCommandUsage + `.
+
+   The server is started automatically when the other commands can't connect to it, unless the '--no-auto-start' option is specified.
+   The log of the automatically started server is written to the file next to the socket.`
+const failedCommandUsage = "List tests which failed and haven't passed since"
+const failedCommandDesc = failedCommandUsage + `.
+
+   These tests run in every 'test' command of the package until they pass, even if they are not affected by the recent changes.`
+const flakyCommandUsage = "List tests which failed but passed on retry"
+const flakyCommandDesc = flakyCommandUsage + `.
+
+   The failed tests are retried when the 'retries' setting or the '--retries' option is specified.
+   It shows how many times each test was flaky among the jobs which ran it, since the server started.`
+const explainCommandUsage = "Explain why each test is selected or not"
+const explainCommandDesc = explainCommandUsage + `.
+
+   For each selected test, it shows the chains from the changed identity to the test function.
+   Args after '--' are passed to the 'go test' command.`
 
 func main() {
 	app := &cli.App{
@@ -36,7 +66,15 @@ func main() {
 					log.EnableDebugLog(c.Bool("debug"))
 
 					query := c.Args().First()
-					options := client.TestOptions{ServerAddr: c.String("addr"), TestLogger: os.Stdout, Bypass: c.Bool("bypass")}
+					options := client.TestOptions{ServerAddr: c.String("addr"), TestLogger: os.Stdout, Bypass: c.Bool("bypass"), DryRun: c.Bool("dry-run"),
+						Selector: c.String("selector"), Retries: c.Int("retries")}
+					if overlayPath := c.String("overlay"); overlayPath != "" {
+						overlay, err := client.ReadOverlayFile(overlayPath)
+						if err != nil {
+							return err
+						}
+						options.Overlay = overlay
+					}
 					if c.Args().Len() > 1 && c.Args().Get(1) == "--" {
 						options.GoTestOptions = c.Args().Slice()[2:]
 					}
@@ -47,13 +85,26 @@ func main() {
 						Name:  "bypass",
 						Usage: "run all tests regardless of recent changes",
 					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "show the selected tests and the go test command without running them",
+					},
+					selectorFlag,
+					&cli.IntFlag{
+						Name:  "retries",
+						Usage: "retry each failed test up to `N` times, and report the tests which pass on retry as flaky",
+					},
+					&cli.StringFlag{
+						Name:  "overlay",
+						Usage: "read the unsaved file contents from the overlay `file` (same format as 'go build -overlay')",
+					},
 				},
 			},
 			{
 				Name:        "hint",
 				Usage:       hintCommandUsage,
 				Description: hintCommandDesc,
-				ArgsUsage:   "[filepath:#begin-end (e.g. sum.go:#1-2)]",
+				ArgsUsage:   "[filepath:#begin-end or filepath:Lline:Ccolumn-Lline:Ccolumn (e.g. sum.go:#1-2, sum.go:L10-L20)]",
 				Action: func(c *cli.Context) error {
 					if c.NArg() == 0 {
 						return errors.New("the target file is not specified")
@@ -62,22 +113,203 @@ func main() {
 					log.EnableDebugLog(c.Bool("debug"))
 
 					filepath := c.Args().First()
-					options := client.HintOptions{ServerAddr: c.String("addr")}
+					options := client.HintOptions{ServerAddr: c.String("addr"), ColumnUnit: c.String("column-unit")}
+					if overlayPath := c.String("overlay"); overlayPath != "" {
+						overlay, err := client.ReadOverlayFile(overlayPath)
+						if err != nil {
+							return err
+						}
+						options.Overlay = overlay
+					}
 					return client.HintAction(c.Context, filepath, options)
 				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "column-unit",
+						Usage: "`unit` of the columns in the line-based ranges ('byte' or 'utf-16')",
+						Value: common.ColumnUnitByte,
+					},
+					&cli.StringFlag{
+						Name:  "overlay",
+						Usage: "read the unsaved file contents from the overlay `file` (same format as 'go build -overlay')",
+					},
+				},
 			},
+			{
+				Name:        "affected",
+				Usage:       affectedCommandUsage,
+				Description: affectedCommandDesc,
+				ArgsUsage:   "[filepath:#begin-end or filepath:Lline:Ccolumn-Lline:Ccolumn (e.g. sum.go:#1-2, sum.go:L10-L20)] -- [go test options]",
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return errors.New("the target file is not specified")
+					}
+
+					log.EnableDebugLog(c.Bool("debug"))
+
+					query := c.Args().First()
+					options := client.AffectedOptions{ServerAddr: c.String("addr"), Writer: os.Stdout, JSON: c.Bool("json"), ColumnUnit: c.String("column-unit")}
+					if c.Args().Len() > 1 && c.Args().Get(1) == "--" {
+						options.GoTestOptions = c.Args().Slice()[2:]
+					}
+					return client.AffectedAction(c.Context, query, options)
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the result in json format",
+					},
+					&cli.StringFlag{
+						Name:  "column-unit",
+						Usage: "`unit` of the columns in the line-based ranges ('byte' or 'utf-16')",
+						Value: common.ColumnUnitByte,
+					},
+				},
+			},
+			{
+				Name:        "watch",
+				Usage:       watchCommandUsage,
+				Description: watchCommandDesc,
+				ArgsUsage:   "[workspace directory path (default: current directory)]",
+				Action: func(c *cli.Context) error {
+					log.EnableDebugLog(c.Bool("debug"))
+
+					workspace := "."
+					if c.NArg() > 0 {
+						workspace = c.Args().First()
+					}
+					options := client.WatchOptions{ServerAddr: c.String("addr"), Writer: os.Stdout, JSON: c.Bool("json"), Verbose: c.Bool("verbose")}
+					return client.WatchAction(c.Context, workspace, options)
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the events in json format",
+					},
+					&cli.BoolFlag{
+						Name:  "verbose",
+						Usage: "print the test output",
+					},
+				},
+			},
+			{
+				Name:        "failed",
+				Usage:       failedCommandUsage,
+				Description: failedCommandDesc,
+				ArgsUsage:   "[workspace directory path (default: current directory)]",
+				Action: func(c *cli.Context) error {
+					log.EnableDebugLog(c.Bool("debug"))
+
+					workspace := "."
+					if c.NArg() > 0 {
+						workspace = c.Args().First()
+					}
+					options := client.FailedOptions{ServerAddr: c.String("addr"), Writer: os.Stdout, JSON: c.Bool("json")}
+					return client.FailedAction(c.Context, workspace, options)
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the result in json format",
+					},
+				},
+			},
+			{
+				Name:        "flaky",
+				Usage:       flakyCommandUsage,
+				Description: flakyCommandDesc,
+				ArgsUsage:   "[workspace directory path (default: current directory)]",
+				Action: func(c *cli.Context) error {
+					log.EnableDebugLog(c.Bool("debug"))
+
+					workspace := "."
+					if c.NArg() > 0 {
+						workspace = c.Args().First()
+					}
+					options := client.FlakyOptions{ServerAddr: c.String("addr"), Writer: os.Stdout, JSON: c.Bool("json")}
+					return client.FlakyAction(c.Context, workspace, options)
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the result in json format",
+					},
+				},
+			},
+			{
+				Name:        "explain",
+				Usage:       explainCommandUsage,
+				Description: explainCommandDesc,
+				ArgsUsage:   "[directory path] -- [go test options]",
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return errors.New("the path is not specified")
+					}
+
+					log.EnableDebugLog(c.Bool("debug"))
+
+					query := c.Args().First()
+					options := client.ExplainOptions{ServerAddr: c.String("addr"), Writer: os.Stdout, JSON: c.Bool("json"), Selector: c.String("selector")}
+					if c.Args().Len() > 1 && c.Args().Get(1) == "--" {
+						options.GoTestOptions = c.Args().Slice()[2:]
+					}
+					return client.ExplainAction(c.Context, query, options)
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the result in json format",
+					},
+					selectorFlag,
+				},
+			},
+			{
+				Name:        "server",
+				Usage:       serverCommandUsage,
+				Description: serverCommandDesc,
+				Subcommands: []*cli.Command{
+					newServerCommand("status", "Show whether the server is running", client.ServerStatusAction),
+					newServerCommand("info", "Show the version and the supported features of the server", client.ServerInfoAction),
+					newServerCommand("start", "Start the server in the background", client.ServerStartAction),
+					newServerCommand("stop", "Stop the server", client.ServerStopAction),
+					newServerCommand("restart", "Restart the server", client.ServerRestartAction),
+				},
+			},
+		},
+		Before: func(c *cli.Context) error {
+			client.EnableAutoStart(!c.Bool("no-auto-start"))
+
+			if !c.IsSet("addr") {
+				// the address in the configuration file is used if the option is not specified.
+				curr, err := os.Getwd()
+				if err != nil {
+					return err
+				}
+				config, err := common.FindConfig(curr)
+				if err != nil {
+					return err
+				}
+				if config != nil && config.ServerAddr != "" {
+					return c.Set("addr", config.ServerAddr)
+				}
+			}
+			return nil
 		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "addr",
-				Usage: "gated server's `address`",
-				Value: "localhost:48059",
+				Usage: "gated server's `address` (unix:/path/to/socket or host:port). The address in the configuration file is used if not specified",
+				Value: common.DefaultServerAddr(),
 			},
 			&cli.BoolFlag{
 				Name:  "debug",
 				Usage: "print the debug logs",
 				Value: false,
 			},
+			&cli.BoolFlag{
+				Name:  "no-auto-start",
+				Usage: "do not start the server automatically",
+			},
 		},
 		HideHelpCommand: true,
 		Version:         common.Version,
@@ -88,3 +320,22 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// selectorFlag specifies how the tests are selected. The selector in the configuration file is used if not specified.
+var selectorFlag = &cli.StringFlag{
+	Name:  "selector",
+	Usage: "select the tests by the `selectors` joined with '+' (all, none, influenced, coverage, failed, changed-files)",
+}
+
+func newServerCommand(name, usage string, action func(context.Context, client.ServerOptions) error) *cli.Command {
+	return &cli.Command{
+		Name:  name,
+		Usage: usage,
+		Action: func(c *cli.Context) error {
+			log.EnableDebugLog(c.Bool("debug"))
+
+			options := client.ServerOptions{ServerAddr: c.String("addr"), Writer: os.Stdout}
+			return action(c.Context, options)
+		},
+	}
+}
@@ -3,12 +3,17 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/go-noisegate/noisegate/client"
 	"github.com/go-noisegate/noisegate/common"
 	"github.com/go-noisegate/noisegate/common/log"
 	"github.com/go-noisegate/noisegate/server"
@@ -19,18 +24,53 @@ func main() {
 	app := &cli.App{
 		Name:      filepath.Base(os.Args[0]),
 		Usage:     "Server for Noise Gate",
-		ArgsUsage: "[server address (default: \"localhost:48059\")]",
+		ArgsUsage: "[server address: unix:/path/to/socket or host:port (default: \"" + common.DefaultServerAddr() + "\")]",
 		Action: func(c *cli.Context) error {
-			addr := "localhost:48059"
+			addr := common.DefaultServerAddr()
 			if c.NArg() > 0 {
 				addr = c.Args().First()
 			}
 
 			log.EnableDebugLog(c.Bool("debug"))
 
-			return runServer(addr)
+			policy := serverPolicy{
+				allowedRoots:   c.StringSlice("allowed-root"),
+				allowedOptions: c.StringSlice("allow-option"),
+				deniedOptions:  c.StringSlice("deny-option"),
+				allowedEnv:     c.StringSlice("allow-env"),
+			}
+			if c.Bool("lsp") {
+				return runLSPServer(policy, c.String("forward-hints"))
+			}
+			return runServer(addr, policy)
 		},
 		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "allowed-root",
+				Usage: "allow the clients to test and hint only under the `directory` (can be repeated). Any directory is allowed if not specified",
+			},
+			&cli.StringSliceFlag{
+				Name:  "allow-option",
+				Usage: "allow the go test `option` denied by default (e.g. -exec, -toolexec, -o and -c), without the hyphen (can be repeated)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "deny-option",
+				Usage: "deny the go test `option` in addition to the default, without the hyphen (can be repeated)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "allow-env",
+				Usage: "allow the clients to send the environment variable `name` in addition to the go related ones (can be repeated)",
+			},
+			&cli.BoolFlag{
+				Name:  "lsp",
+				Usage: "serve the language server protocol over the stdio instead of the http. The tests run in this process, and the hints are also forwarded to the server at -forward-hints",
+				Value: false,
+			},
+			&cli.StringFlag{
+				Name:  "forward-hints",
+				Usage: "with -lsp, forward the hints to the server at the `address`, starting it if not running, so that `gate test` sees the changes in the editor. Empty disables the forwarding",
+				Value: common.DefaultServerAddr(),
+			},
 			&cli.BoolFlag{
 				Name:  "debug",
 				Usage: "print the debug logs",
@@ -47,28 +87,150 @@ func main() {
 	}
 }
 
-func runServer(addr string) error {
-	server := server.NewServer(addr)
+// serverPolicy represents what the clients can do.
+type serverPolicy struct {
+	allowedRoots   []string
+	allowedOptions []string
+	deniedOptions  []string
+	allowedEnv     []string
+}
+
+func (p serverPolicy) apply(s *server.Server) error {
+	for _, root := range p.allowedRoots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		s.AllowedRoots = append(s.AllowedRoots, absRoot)
+	}
+
+	var deniedOptions []string
+	for _, opt := range server.DefaultDeniedOptions {
+		allowed := false
+		for _, allowedOpt := range p.allowedOptions {
+			if opt == strings.TrimLeft(allowedOpt, "-") {
+				allowed = true
+			}
+		}
+		if !allowed {
+			deniedOptions = append(deniedOptions, opt)
+		}
+	}
+	for _, opt := range p.deniedOptions {
+		deniedOptions = append(deniedOptions, strings.TrimLeft(opt, "-"))
+	}
+	s.DeniedOptions = deniedOptions
+	s.AllowedEnv = append(append([]string{}, server.DefaultAllowedEnv...), p.allowedEnv...)
+	return nil
+}
+
+func runServer(addr string, policy serverPolicy) error {
+	s := server.NewServer(addr)
+	if err := policy.apply(s); err != nil {
+		return err
+	}
 	shutdownDoneCh := make(chan struct{})
 	go func() {
 		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, os.Interrupt)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 		<-sigCh
 
 		log.Println("shut down")
 		const timeout = 3 * time.Second
-		ctx, _ := context.WithTimeout(context.Background(), timeout)
-		if err := server.Shutdown(ctx); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
 			log.Printf("shutdown error: %v", err)
 		}
 		close(shutdownDoneCh)
 	}()
 
+	l, err := server.Listen(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	token, err := server.GenerateAuthToken()
+	if err != nil {
+		return err
+	}
+	tokenPath := common.TokenPath(addr)
+	if err := server.WriteAuthTokenFile(tokenPath, token); err != nil {
+		l.Close()
+		return err
+	}
+	defer os.Remove(tokenPath)
+	s.AuthToken = token
+
+	// the pid file is used by `gate server stop`.
+	pidPath := common.PIDPath(addr)
+	if err := ioutil.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to write the pid file: %w", err)
+	}
+	defer os.Remove(pidPath)
+
 	log.Printf("start the server at %s\n", addr)
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	if err := s.Serve(l); err != http.ErrServerClosed {
 		return fmt.Errorf("failed to start or close the server: %w", err)
 	}
 
 	<-shutdownDoneCh
 	return nil
 }
+
+func runLSPServer(policy serverPolicy, forwardAddr string) error {
+	s := server.NewServer("")
+	if err := policy.apply(s); err != nil {
+		return err
+	}
+	// the stdout is used for the protocol and the logs are written to the stderr.
+	// cancels the background work when the client exits.
+	defer s.Shutdown(context.Background())
+	lspServer := server.NewLSPServer(s, os.Stdin, os.Stdout)
+	if forwardAddr != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		lspServer.ForwardHint = newHintForwarder(ctx, forwardAddr)
+	}
+	log.Println("start the lsp server")
+	return lspServer.Serve(context.Background())
+}
+
+// the max number of the hints waiting to be forwarded. The hint is dropped if the queue is full.
+const maxPendingHints = 256
+
+type forwardedHint struct {
+	path    string
+	r       common.Range
+	content string
+}
+
+// newHintForwarder returns the forwarder which sends the hints to the server at the address in the background, in order.
+// The server is started if not running. The unsaved content is sent as the overlay.
+func newHintForwarder(ctx context.Context, addr string) server.HintForwarder {
+	client.EnableAutoStart(true)
+	hintCh := make(chan forwardedHint, maxPendingHints)
+	go func() {
+		for {
+			select {
+			case h := <-hintCh:
+				query := fmt.Sprintf("%s:#%d-%d", h.path, h.r.Begin, h.r.End)
+				options := client.HintOptions{ServerAddr: addr, Overlay: map[string]string{h.path: h.content}}
+				if err := client.HintAction(ctx, query, options); err != nil {
+					log.Printf("failed to forward the hint to %s: %v\n", addr, err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func(path string, r common.Range, content string) {
+		select {
+		case hintCh <- forwardedHint{path, r, content}:
+		default:
+			log.Printf("too many hints to forward. drop the hint of %s\n", path)
+		}
+	}
+}
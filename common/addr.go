@@ -0,0 +1,57 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const unixAddrPrefix = "unix:"
+
+// DefaultServerAddr returns the default address of the server, which is the unix domain socket in the per-user directory:
+// `$XDG_RUNTIME_DIR/noisegate/gated.sock`, or `noisegate-<uid>/gated.sock` in the temp directory if $XDG_RUNTIME_DIR is not set.
+func DefaultServerAddr() string {
+	return unixAddrPrefix + filepath.Join(defaultSocketDir(), "gated.sock")
+}
+
+func defaultSocketDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "noisegate")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("noisegate-%d", os.Getuid()))
+}
+
+// ParseServerAddr parses the address of the server. The address is `unix:/path/to/socket` or `host:port`.
+// It returns the network (`unix` or `tcp`) and the address for the network.
+func ParseServerAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixAddrPrefix)
+	}
+	return "tcp", addr
+}
+
+// TokenPath returns the path of the file which stores the authentication token of the server.
+func TokenPath(serverAddr string) string {
+	return serverFilePath(serverAddr, ".token")
+}
+
+// PIDPath returns the path of the file which stores the process id of the server.
+func PIDPath(serverAddr string) string {
+	return serverFilePath(serverAddr, ".pid")
+}
+
+// LogPath returns the path of the log file of the server started by the client.
+func LogPath(serverAddr string) string {
+	return serverFilePath(serverAddr, ".log")
+}
+
+// serverFilePath returns the path of the file related to the server.
+// The file is next to the socket if the address is the unix domain socket, or in the per-user directory if the address is tcp.
+func serverFilePath(serverAddr, ext string) string {
+	network, address := ParseServerAddr(serverAddr)
+	if network == "unix" {
+		return address + ext
+	}
+	return filepath.Join(defaultSocketDir(), "gated-"+strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(address)+ext)
+}
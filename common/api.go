@@ -2,7 +2,9 @@ package common
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
+	"time"
 )
 
 // These are just the internal APIs and no need to be the RESTful so far.
@@ -13,36 +15,246 @@ import (
 
 const cliAPIPrefix = "/cli"
 
+// AuthTokenHeader is the header to send the authentication token. The `token` query parameter is also accepted
+// for the clients which can't set the header, like EventSource.
+const AuthTokenHeader = "X-Noisegate-Token"
+
 // the API pathes
 const (
-	TestPath = cliAPIPrefix + "/test"
-	HintPath = cliAPIPrefix + "/hint"
+	TestPath     = cliAPIPrefix + "/test"
+	HintPath     = cliAPIPrefix + "/hint"
+	ExplainPath  = cliAPIPrefix + "/explain"
+	AffectedPath = cliAPIPrefix + "/affected"
+	EventsPath   = cliAPIPrefix + "/events"
+	InfoPath     = cliAPIPrefix + "/info"
+	FailedPath   = cliAPIPrefix + "/failed"
+	FlakyPath    = cliAPIPrefix + "/flaky"
 )
 
 // TestRequest represents the input data to the test API.
 type TestRequest struct {
-	Bypass        bool     `json:"bypass"`
+	Bypass bool `json:"bypass"`
+	// If true, the server shows the selected tests and the go test command without running them.
+	DryRun        bool     `json:"dry_run"`
 	Path          string   `json:"path"`
 	GoTestOptions []string `json:"go_test_options"`
+	// The contents of the unsaved files, keyed by the abs path. They are used instead of the files on the disk.
+	// They are merged with the overlay of the hint API and take precedence.
+	Overlay map[string]string `json:"overlay,omitempty"`
+	// The environment variables of the go test command, like `CGO_ENABLED` and `GOFLAGS`.
+	// They override the environment variables of the server.
+	Env map[string]string `json:"env,omitempty"`
+	// The selectors composed with `+`, like `influenced+failed`. See `SelectorAll` and so on.
+	// If empty, the selector in the configuration file is used. Ignored if `Bypass` is true.
+	Selector string `json:"selector,omitempty"`
+	// The max number of times each failed test function is retried in isolation. See `Config.Retries`.
+	// If 0, the number in the configuration file is used. Must not be more than `MaxRetries`.
+	Retries int `json:"retries,omitempty"`
+}
+
+// ExplainResponse represents the output data of the explain API. The input data is same as the test API.
+type ExplainResponse struct {
+	Changed []string      `json:"changed"`
+	Explain []Explanation `json:"explain"`
+}
+
+// Explanation explains why the test function is selected or not.
+type Explanation struct {
+	TestFunction string `json:"test_function"`
+	Selected     bool   `json:"selected"`
+	// The chains from the changed identities to the test function. Empty if the test function is not selected.
+	Chains [][]ChainElement `json:"chains"`
+}
+
+// ChainElement represents the identity in the chain. The identity uses the previous identity at the position.
+type ChainElement struct {
+	Name string `json:"name"`
+	// `file:line` format. Empty if the position is unknown.
+	Position string `json:"position"`
 }
 
 // HintRequest represents the input data to the hint API.
 type HintRequest struct {
 	Path   string  `json:"path"`
 	Ranges []Range `json:"ranges"`
+	// The unit of the columns in the line-based ranges. `ColumnUnitByte` if empty.
+	ColumnUnit string `json:"column_unit"`
+	// The contents of the unsaved files, keyed by the abs path. The ranges point to the content in the overlay if
+	// the file is included. The server keeps the content until the file on the disk is modified, or for an hour
+	// since the last hint which includes the file.
+	Overlay map[string]string `json:"overlay,omitempty"`
+}
+
+// AffectedRequest represents the input data to the affected API.
+// Unlike the hint API, the server doesn't store the ranges as the recent changes.
+type AffectedRequest struct {
+	Path   string  `json:"path"`
+	Ranges []Range `json:"ranges"`
+	// The unit of the columns in the line-based ranges. `ColumnUnitByte` if empty.
+	ColumnUnit    string   `json:"column_unit"`
+	GoTestOptions []string `json:"go_test_options"`
+	// The environment variables. See `TestRequest`.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// AffectedResponse represents the output data of the affected API.
+type AffectedResponse struct {
+	// The directory of the package to which the test functions belong.
+	PackageDir    string   `json:"package_dir"`
+	Changed       []string `json:"changed"`
+	TestFunctions []string `json:"test_functions"`
+}
+
+// FailedRequest represents the input data to the failed API.
+type FailedRequest struct {
+	// The workspace directory. The failed tests of the packages under the directory are listed.
+	Path string `json:"path"`
+}
+
+// FailedResponse represents the output data of the failed API.
+type FailedResponse struct {
+	// Sorted by the package directory.
+	Packages []FailedPackage `json:"packages"`
+}
+
+// FailedPackage represents the test functions of the package which failed and haven't passed since.
+type FailedPackage struct {
+	PackageDir    string   `json:"package_dir"`
+	TestFunctions []string `json:"test_functions"`
+}
+
+// FlakyRequest represents the input data to the flaky API.
+type FlakyRequest struct {
+	// The workspace directory. The flaky tests of the packages under the directory are listed.
+	Path string `json:"path"`
+}
+
+// FlakyResponse represents the output data of the flaky API.
+type FlakyResponse struct {
+	// Sorted by the package directory and the test function.
+	Tests []FlakyTest `json:"tests"`
 }
 
+// FlakyTest represents the test function which failed but passed on retry at least once.
+type FlakyTest struct {
+	PackageDir   string `json:"package_dir"`
+	TestFunction string `json:"test_function"`
+	// The number of the jobs which ran the test function, since the server started.
+	Runs int `json:"runs"`
+	// The number of the jobs in which the test function failed but passed on retry.
+	Flakes int `json:"flakes"`
+}
+
+// InfoResponse represents the output data of the info API. The info API accepts no input data.
+type InfoResponse struct {
+	Version string `json:"version"`
+	// The json fields of the input data each API accepts, keyed by the API path.
+	// The client can check whether the server supports the field before using it.
+	RequestFields map[string][]string `json:"request_fields"`
+	// The version of the go command which runs the tests (e.g. `go1.14.2`). Empty if unknown.
+	GoVersion string `json:"go_version"`
+	// The elapsed time since the server started, in seconds.
+	Uptime float64 `json:"uptime"`
+}
+
+// JSONFields returns the names of the json fields of the struct.
+func JSONFields(v interface{}) []string {
+	var fields []string
+	typ := reflect.Indirect(reflect.ValueOf(v)).Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// Event represents the event of the job. The events API streams the events as the server-sent events, where
+// the event name is the `Type` and the data is the json encoded event.
+// The events API accepts the `workspace` query parameter to receive only the events of the packages under the directory.
+type Event struct {
+	Type       string    `json:"type"`
+	JobID      int64     `json:"job_id"`
+	PackageDir string    `json:"package_dir"`
+	Time       time.Time `json:"time"`
+	// The selected test functions. Only for `EventTypeJobStarted`.
+	TestFunctions []string `json:"test_functions,omitempty"`
+	// The test functions which failed but passed on retry. Only for `EventTypeJobFinished`.
+	FlakyTestFunctions []string `json:"flaky_test_functions,omitempty"`
+	// Only for `EventTypeTestResult`.
+	TestFunction string `json:"test_function,omitempty"`
+	// `PASS`, `FAIL` or `SKIP` for `EventTypeTestResult`, and `JobResultSuccessful` or `JobResultFailed` for `EventTypeJobFinished`.
+	Result string `json:"result,omitempty"`
+	// The elapsed time in seconds. Only for `EventTypeTestResult` and `EventTypeJobFinished`.
+	Elapsed float64 `json:"elapsed,omitempty"`
+	// The line of the test output, without the newline. Only for `EventTypeOutput`.
+	Output string `json:"output,omitempty"`
+}
+
+// The types of the event.
+const (
+	EventTypeJobStarted  = "job_started"
+	EventTypeOutput      = "output"
+	EventTypeTestResult  = "test_result"
+	EventTypeJobFinished = "job_finished"
+)
+
+// The results of the job.
+const (
+	JobResultSuccessful = "successful"
+	JobResultFailed     = "failed"
+)
+
 // Range represents the some range of the file.
+// The range is specified by the byte offsets (`Begin` and `End`), or by the lines and columns if `BeginLine` is not 0.
 type Range struct {
 	Begin int64 `json:"begin"`
 	End   int64 `json:"end"`
+	// The lines and columns are 1-based. The column 0 means the beginning of the line if it's the begin column,
+	// and the end of the line if it's the end column.
+	BeginLine   int `json:"begin_line,omitempty"`
+	BeginColumn int `json:"begin_column,omitempty"`
+	EndLine     int `json:"end_line,omitempty"`
+	EndColumn   int `json:"end_column,omitempty"`
 }
 
+// IsLineBased returns true if the range is specified by the lines and columns.
+func (r Range) IsLineBased() bool {
+	return r.BeginLine != 0
+}
+
+// The units of the column.
+const (
+	// ColumnUnitByte counts the column in bytes. This is the default.
+	ColumnUnitByte = "byte"
+	// ColumnUnitUTF16 counts the column in UTF-16 code units, like the language server protocol.
+	ColumnUnitUTF16 = "utf-16"
+)
+
 // RangesToQuery converts the specified ranges to the query.
 func RangesToQuery(ranges []Range) string {
 	var rs []string
 	for _, r := range ranges {
+		if r.IsLineBased() {
+			rs = append(rs, fmt.Sprintf("%s-%s", linePositionToQuery(r.BeginLine, r.BeginColumn), linePositionToQuery(r.EndLine, r.EndColumn)))
+			continue
+		}
 		rs = append(rs, fmt.Sprintf("#%d-%d", r.Begin, r.End))
 	}
 	return strings.Join(rs, ",")
 }
+
+func linePositionToQuery(line, column int) string {
+	if column == 0 {
+		return fmt.Sprintf("L%d", line)
+	}
+	return fmt.Sprintf("L%d:C%d", line, column)
+}
@@ -0,0 +1,202 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigFileName is the name of the configuration file. It's usually put at the module root and checked in.
+const ConfigFileName = ".noisegate.yaml"
+
+// The names of the built-in selectors, which select the tests to run. They are composed with `+`, like `influenced+failed`,
+// and the tests any of them selects run.
+const (
+	// SelectorAll selects all the tests.
+	SelectorAll = "all"
+	// SelectorNone selects no test.
+	SelectorNone = "none"
+	// SelectorInfluenced selects the tests which use the changed declarations, using the static analysis. This is the default.
+	SelectorInfluenced = "influenced"
+	// SelectorCoverage selects the tests which covered the changed lines. The coverage of each test is collected
+	// after the tests pass.
+	SelectorCoverage = "coverage"
+	// SelectorFailed selects the tests which failed and haven't passed since. They are selected in addition to
+	// any selector other than `SelectorAll`, so there is usually no need to specify it.
+	SelectorFailed = "failed"
+	// SelectorChangedFiles selects the tests in the changed test files and the test files of the changed files
+	// (e.g. `sum_test.go` for `sum.go`).
+	SelectorChangedFiles = "changed-files"
+)
+
+var selectorNames = []string{SelectorAll, SelectorNone, SelectorInfluenced, SelectorCoverage, SelectorFailed, SelectorChangedFiles}
+
+// ValidateSelector returns the error if the selector includes the unknown name.
+func ValidateSelector(selector string) error {
+	for _, name := range strings.Split(selector, "+") {
+		found := false
+		for _, selectorName := range selectorNames {
+			if strings.TrimSpace(name) == selectorName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown selector: %s", name)
+		}
+	}
+	return nil
+}
+
+// MaxRetries is the max number of times each failed test function is retried.
+const MaxRetries = 10
+
+// Config represents the configuration file.
+type Config struct {
+	// The server address `gate` connects to if the address is not specified by the option.
+	ServerAddr string `yaml:"addr"`
+	// The go test options of all the packages, like `-race` and `-count=1`.
+	GoTestOptions []string `yaml:"go_test_options"`
+	// The go test options of the packages which match the pattern. They are appended to `GoTestOptions`.
+	Packages []PackageConfig `yaml:"packages"`
+	// The max number of the test jobs running at the same time in the directory of the configuration file. 0 means no limit.
+	Parallel int `yaml:"parallel"`
+	// The glob patterns of the files whose changes are ignored, relative to the directory of the configuration file.
+	// `**` matches any number of the directories. The pattern without `/` matches the file name in any directory.
+	Exclude []string `yaml:"exclude"`
+	// The names of the environment variables `gate` sends to the server in addition to the go related ones,
+	// like `DATABASE_URL` for the integration tests. They are set to the go test command if the server allows them.
+	Env []string `yaml:"env"`
+	// The selectors composed with `+`, like `influenced+coverage`. `SelectorInfluenced` if empty.
+	Selector string `yaml:"selector"`
+	// The max number of times each failed test function is retried in isolation. The test function which passes on
+	// retry is considered to be flaky, and doesn't fail the job. 0 means no retry.
+	Retries int `yaml:"retries"`
+	// The directory of the configuration file.
+	Dir string `yaml:"-"`
+}
+
+// PackageConfig represents the configuration of the packages.
+type PackageConfig struct {
+	// The relative path from the directory of the configuration file, like `./foo`.
+	// The pattern ending with `/...` matches the directory and its subdirectories.
+	Pattern       string   `yaml:"pattern"`
+	GoTestOptions []string `yaml:"go_test_options"`
+}
+
+// FindConfig reads the nearest configuration file in the directory or its ancestors.
+// It returns nil if the configuration file is not found.
+func FindConfig(dirPath string) (*Config, error) {
+	for d := filepath.Clean(dirPath); ; d = filepath.Dir(d) {
+		configPath := filepath.Join(d, ConfigFileName)
+		if _, err := os.Stat(configPath); err == nil {
+			return ReadConfig(configPath)
+		}
+		if d == filepath.Dir(d) {
+			return nil, nil
+		}
+	}
+}
+
+// ReadConfig reads the configuration file.
+func ReadConfig(configPath string) (*Config, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", configPath, err)
+	}
+	if config.Selector != "" {
+		if err := ValidateSelector(config.Selector); err != nil {
+			return nil, fmt.Errorf("%w in %s", err, configPath)
+		}
+	}
+	if config.Parallel < 0 {
+		return nil, fmt.Errorf("parallel must not be negative in %s: %d", configPath, config.Parallel)
+	}
+	if config.Retries < 0 || config.Retries > MaxRetries {
+		return nil, fmt.Errorf("retries must be between 0 and %d in %s: %d", MaxRetries, configPath, config.Retries)
+	}
+	config.Dir = filepath.Dir(configPath)
+	return &config, nil
+}
+
+// GoTestOptionsFor returns the go test options of the package.
+func (c *Config) GoTestOptionsFor(pkgDir string) []string {
+	opts := append([]string(nil), c.GoTestOptions...)
+	rel, err := filepath.Rel(c.Dir, pkgDir)
+	if err != nil {
+		return opts
+	}
+	rel = filepath.ToSlash(rel)
+
+	for _, pkg := range c.Packages {
+		if matchPackagePattern(path.Clean(pkg.Pattern), rel) {
+			opts = append(opts, pkg.GoTestOptions...)
+		}
+	}
+	return opts
+}
+
+func matchPackagePattern(pattern, rel string) bool {
+	if pattern == "..." {
+		return !strings.HasPrefix(rel, "../")
+	}
+	if strings.HasSuffix(pattern, "/...") {
+		base := strings.TrimSuffix(pattern, "/...")
+		return rel == base || strings.HasPrefix(rel, base+"/")
+	}
+	return rel == pattern
+}
+
+// IsExcluded returns true if the file matches any of the exclusion patterns.
+func (c *Config) IsExcluded(filePath string) bool {
+	rel, err := filepath.Rel(c.Dir, filePath)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if strings.HasPrefix(rel, "../") {
+		return false
+	}
+
+	for _, pattern := range c.Exclude {
+		if !strings.Contains(pattern, "/") {
+			pattern = "**/" + pattern
+		}
+		if matchGlob(strings.Split(strings.TrimPrefix(pattern, "./"), "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches the path elements with the pattern elements. The `**` element matches any number of the elements.
+func matchGlob(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchGlob(pattern[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+		return false
+	}
+	return matchGlob(pattern[1:], elems[1:])
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfig_GoTestOptionsFor(t *testing.T) {
+	config := &Config{
+		GoTestOptions: []string{"-race"},
+		Packages: []PackageConfig{
+			{Pattern: "./...", GoTestOptions: []string{"-count=1"}},
+			{Pattern: "./integration/...", GoTestOptions: []string{"-tags=integration"}},
+			{Pattern: "./slow", GoTestOptions: []string{"-timeout=10m"}},
+		},
+		Dir: "/path/to/module",
+	}
+
+	for i, testCase := range []struct {
+		pkgDir string
+		expect []string
+	}{
+		{"/path/to/module", []string{"-race", "-count=1"}},
+		{"/path/to/module/integration", []string{"-race", "-count=1", "-tags=integration"}},
+		{"/path/to/module/integration/db", []string{"-race", "-count=1", "-tags=integration"}},
+		{"/path/to/module/slow", []string{"-race", "-count=1", "-timeout=10m"}},
+		{"/path/to/module/slow/sub", []string{"-race", "-count=1"}},
+		{"/path/to/other", []string{"-race"}},
+	} {
+		actual := config.GoTestOptionsFor(testCase.pkgDir)
+		if !reflect.DeepEqual(testCase.expect, actual) {
+			t.Errorf("[%d] unexpected options: %v", i, actual)
+		}
+	}
+}
+
+func TestConfig_IsExcluded(t *testing.T) {
+	config := &Config{Exclude: []string{"*_gen.go", "vendor/**", "./docs/*.go"}, Dir: "/path/to/module"}
+
+	for i, testCase := range []struct {
+		path   string
+		expect bool
+	}{
+		{"/path/to/module/sum_gen.go", true},
+		{"/path/to/module/a/b/sum_gen.go", true},
+		{"/path/to/module/vendor/a/b.go", true},
+		{"/path/to/module/docs/doc.go", true},
+		{"/path/to/module/docs/sub/doc.go", false},
+		{"/path/to/module/sum.go", false},
+		{"/path/to/other/sum_gen.go", false},
+	} {
+		if actual := config.IsExcluded(testCase.path); actual != testCase.expect {
+			t.Errorf("[%d] unexpected result: %v", i, actual)
+		}
+	}
+}
+
+func TestValidateSelector(t *testing.T) {
+	if err := ValidateSelector("influenced + failed+changed-files"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, selector := range []string{"", "unknown", "influenced+"} {
+		if err := ValidateSelector(selector); err == nil {
+			t.Errorf("nil error: %s", selector)
+		}
+	}
+}
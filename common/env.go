@@ -0,0 +1,30 @@
+package common
+
+import (
+	"os"
+)
+
+// DefaultEnvNames are the names of the environment variables sent to the server by default.
+// They change how the go command builds and tests the package. GOFLAGS is not included because the server may deny
+// the options in it (e.g. `-exec`) and reject all the requests. Add it to the `env` setting to send it.
+var DefaultEnvNames = []string{"GOOS", "GOARCH", "CGO_ENABLED", "GOEXPERIMENT", "GOWORK", "GO111MODULE"}
+
+// CollectEnv returns the environment variables sent to the server with the request for the path.
+// They are the variables in `DefaultEnvNames` and the `env` setting of the configuration file. The unset variables are not included.
+func CollectEnv(path string) (map[string]string, error) {
+	names := DefaultEnvNames
+	config, err := FindConfig(path)
+	if err != nil {
+		return nil, err
+	} else if config != nil {
+		names = append(names[:len(names):len(names)], config.Env...)
+	}
+
+	env := make(map[string]string)
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+		}
+	}
+	return env, nil
+}
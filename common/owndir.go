@@ -0,0 +1,27 @@
+package common
+
+import (
+	"fmt"
+	"os"
+)
+
+// MakeOwnDir creates the directory with 0700 if not exist, and checks it's the directory owned by the current user.
+// The symlink is rejected even if it points to the directory of the current user.
+func MakeOwnDir(dir string) (os.FileInfo, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the directory: %w", err)
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil, fmt.Errorf("the directory is a symlink: %s", dir)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+	if err := checkOwner(dir, fi); err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkOwner returns the error if the file is not owned by the current user.
+func checkOwner(path string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to get the owner: %s", path)
+	}
+	if int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("owned by another user: %s", path)
+	}
+	return nil
+}
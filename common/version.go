@@ -1,4 +1,21 @@
 package common
 
+import "strings"
+
 // Version represents the current version of noise gate.
 const Version = "0.1.0"
+
+// IsCompatibleVersion returns true if the client and the server of these versions can work together.
+// The major versions must be same, and so do the minor versions if the major version is 0.
+func IsCompatibleVersion(v1, v2 string) bool {
+	parts1 := strings.SplitN(strings.TrimPrefix(v1, "v"), ".", 3)
+	parts2 := strings.SplitN(strings.TrimPrefix(v2, "v"), ".", 3)
+	if len(parts1) < 2 || len(parts2) < 2 {
+		return v1 == v2
+	}
+
+	if parts1[0] != parts2[0] {
+		return false
+	}
+	return parts1[0] != "0" || parts1[1] == parts2[1]
+}
@@ -7,4 +7,5 @@ require (
 	github.com/stretchr/testify v1.5.1
 	github.com/urfave/cli/v2 v2.2.0
 	golang.org/x/tools v0.0.0-20200423205358-59e73619c742
+	gopkg.in/yaml.v2 v2.4.0
 )
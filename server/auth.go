@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+// GenerateAuthToken generates the random token to authenticate the clients.
+func GenerateAuthToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate the token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// WriteAuthTokenFile writes the token to the file which only the current user can read.
+// The file is written to the temp file and renamed, so that the existing file or the symlink planted at the path is
+// replaced rather than written through. The directory must be owned by the current user (see `common.MakeOwnDir`).
+func WriteAuthTokenFile(path, token string) error {
+	dir := filepath.Dir(path)
+	if _, err := common.MakeOwnDir(dir); err != nil {
+		return fmt.Errorf("invalid token directory: %w", err)
+	}
+
+	// TempFile creates the new file with 0600.
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create the token file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(token); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write the token: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write the token: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to write the token: %w", err)
+	}
+	return nil
+}
+
+// authenticate rejects the request if the token is not valid. All the requests are accepted if `AuthToken` is empty.
+func (s *Server) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.AuthToken != "" {
+			// the token is not accepted in the query parameter, which may be left in the logs.
+			token := r.Header.Get(common.AuthTokenHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.AuthToken)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("invalid token\n"))
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+func TestAuthenticate(t *testing.T) {
+	server := NewServer("")
+	server.AuthToken = "secret"
+
+	for _, testdata := range []struct {
+		header, query string
+		expect        int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"wrong", "", http.StatusUnauthorized},
+		{"secret", "", http.StatusBadRequest}, // authenticated, but the body is empty
+		{"", "secret", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", common.HintPath+"?token="+testdata.query, nil)
+		if testdata.header != "" {
+			req.Header.Set(common.AuthTokenHeader, testdata.header)
+		}
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, req)
+		if w.Code != testdata.expect {
+			t.Errorf("unexpected code: %d, %v", w.Code, testdata)
+		}
+	}
+}
+
+func TestWriteAuthTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gated.token")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := GenerateAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 {
+		t.Errorf("wrong token: %s", token)
+	}
+	if err := WriteAuthTokenFile(path, token); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, _ := os.Stat(path)
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("wrong permission: %v", fi.Mode().Perm())
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != token {
+		t.Errorf("wrong content: %s", content)
+	}
+
+	// the symlink is replaced, not followed.
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	linkPath := filepath.Join(dir, "link.token")
+	if err := os.Symlink(target, linkPath); err != nil {
+		t.Skip(err)
+	}
+	if err := WriteAuthTokenFile(linkPath, token); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(target); len(content) != 0 {
+		t.Errorf("the token is written to the symlink target: %s", content)
+	}
+	if fi, _ := os.Lstat(linkPath); fi.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("the symlink is not replaced")
+	}
+}
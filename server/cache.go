@@ -0,0 +1,238 @@
+package server
+
+import (
+	"crypto/sha256"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common/log"
+)
+
+// the max number of the packages the cache keeps. The least recently used package is evicted.
+const maxCachedPackages = 64
+
+// the coarsest granularity of the modification time among the file systems (e.g. FAT). The file modified within this
+// duration before it's read may be modified again without changing the modification time.
+const modTimeGranularity = 2 * time.Second
+
+// packageCache caches the parsed and type-checked packages between the jobs.
+// Only the modified files are parsed again, and the package is type-checked again only if any file is modified.
+type packageCache struct {
+	entries map[packageCacheKey]*packageCacheEntry
+	mtx     sync.Mutex
+}
+
+type packageCacheKey struct {
+	dirPath string
+	// see `buildConfig.key`.
+	buildConfig string
+}
+
+type packageCacheEntry struct {
+	fset     *token.FileSet
+	files    map[string]cachedFile
+	pkg      *ast.Package
+	typesPkg *types.Package
+	info     *types.Info
+	indexes  map[string]*usageIndex
+	// the total size of the current files and the files parsed so far. The file set keeps the old files,
+	// so it's discarded when too many files are parsed again.
+	size, parsedSize int
+	importer         *exportImporter
+	// the export data listed in the background.
+	exports *exportList
+	// the modification times of go.mod and go.sum when the export data is listed.
+	moduleFilesModTime time.Time
+	lastUsed           time.Time
+	mtx                sync.Mutex
+}
+
+type cachedFile struct {
+	hash [sha256.Size]byte
+	// the stat of the file when it's read. Zero if the file is read from the overlay.
+	stat fileStat
+	// the time when the file is read.
+	readAt time.Time
+	size   int
+	file   *ast.File
+	index  *usageIndex
+}
+
+// unchanged returns true if the file is surely not modified since it's read, judging from the stat.
+// The stat is not trusted if the file was modified within the granularity of the modification time before it's read,
+// because the modification may be followed by another one which keeps the size and the modification time.
+func (f cachedFile) unchanged(stat fileStat) bool {
+	return stat != (fileStat{}) && f.stat == stat && f.readAt.Sub(stat.modTime) > modTimeGranularity
+}
+
+// cachedPackage represents the parsed and type-checked package. Its values must not be modified.
+type cachedPackage struct {
+	fset     *token.FileSet
+	pkg      *ast.Package
+	typesPkg *types.Package
+	info     *types.Info
+	// the usage indexes of the files, keyed by the abs path.
+	indexes map[string]*usageIndex
+}
+
+var defaultPackageCache = newPackageCache()
+
+func newPackageCache() *packageCache {
+	return &packageCache{entries: make(map[packageCacheKey]*packageCacheEntry)}
+}
+
+// load returns the parsed and type-checked package. The external test files are parsed, but not type-checked.
+// The usage index of the file is built when the file is parsed, so only the indexes of the modified files are updated.
+// The file whose size and modification time are not changed since the last load is not even read (see `cachedFile.unchanged`).
+func (c *packageCache) load(conf buildConfig, metadata *packageMetadata) cachedPackage {
+	e := c.entry(packageCacheKey{metadata.Dir, conf.key()})
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.fset == nil || e.parsedSize > 8*(e.size+1) {
+		e.fset = token.NewFileSet()
+		e.files = nil
+		e.importer = nil
+		e.parsedSize = 0
+	}
+	if modTime := moduleFilesModTime(metadata.Dir); e.exports == nil || !modTime.Equal(e.moduleFilesModTime) {
+		e.exports = startListExports(metadata.Dir, conf)
+		e.moduleFilesModTime = modTime
+		e.importer = nil
+	}
+	// the packages are imported from the source until the export data is listed. Once listed, the package is
+	// type-checked again with the export data, which respects the build tags.
+	if e.importer == nil || !e.importer.complete && e.exports.ready() {
+		e.importer = newExportImporter(e.fset, metadata.Dir, e.exports)
+		e.info = nil
+	}
+
+	files := make(map[string]cachedFile)
+	modified := len(metadata.GoFiles) != len(e.files)
+	size := 0
+	var astFiles []*ast.File // the files to type-check
+	pkgName := strings.TrimSuffix(metadata.Name, "_test")
+	for _, filename := range metadata.GoFiles {
+		path := filepath.Join(metadata.Dir, filename)
+		// the file not in the overlay is not read again if its stat is not changed.
+		var stat fileStat
+		if _, ok := conf.overlay[path]; !ok {
+			stat = metadata.FileStats[filename]
+		}
+		if cached, ok := e.files[path]; ok && cached.unchanged(stat) {
+			files[path] = cached
+			size += cached.size
+			if cached.file.Name.Name == pkgName {
+				astFiles = append(astFiles, cached.file)
+			}
+			continue
+		}
+
+		readAt := time.Now()
+		src, err := readFile(conf.ctxt, path)
+		if err != nil {
+			log.Printf("failed to read %s: %v\n", path, err)
+			continue
+		}
+		size += len(src)
+
+		hash := sha256.Sum256(src)
+		if cached, ok := e.files[path]; ok && cached.hash == hash {
+			cached.stat, cached.readAt = stat, readAt
+			files[path] = cached
+			if cached.file.Name.Name == pkgName {
+				astFiles = append(astFiles, cached.file)
+			}
+			continue
+		}
+
+		modified = true
+		e.parsedSize += len(src)
+		f, err := parser.ParseFile(e.fset, path, src, parser.ParseComments)
+		if err != nil {
+			log.Printf("failed to parse %s: %v\n", path, err)
+		}
+		if f != nil {
+			files[path] = cachedFile{hash, stat, readAt, len(src), f, newUsageIndex(path, f)}
+			if f.Name.Name == pkgName {
+				astFiles = append(astFiles, f)
+			}
+		}
+	}
+	e.files = files
+	e.size = size
+
+	if modified || e.info == nil {
+		astFileMap := make(map[string]*ast.File)
+		indexes := make(map[string]*usageIndex)
+		for path, f := range files {
+			astFileMap[path] = f.file
+			indexes[path] = f.index
+		}
+		e.pkg = &ast.Package{Name: metadata.Name, Files: astFileMap}
+		e.indexes = indexes
+		e.typesPkg, e.info = typeCheck(e.fset, metadata.Name, astFiles, e.importer)
+	}
+	return cachedPackage{fset: e.fset, pkg: e.pkg, typesPkg: e.typesPkg, info: e.info, indexes: e.indexes}
+}
+
+// entry returns the cache entry of the key. The least recently used entry is evicted if the cache is full.
+func (c *packageCache) entry(key packageCacheKey) *packageCacheEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		if len(c.entries) >= maxCachedPackages {
+			var oldestKey packageCacheKey
+			var oldest *packageCacheEntry
+			for k, v := range c.entries {
+				if oldest == nil || v.lastUsed.Before(oldest.lastUsed) {
+					oldestKey, oldest = k, v
+				}
+			}
+			delete(c.entries, oldestKey)
+		}
+		e = &packageCacheEntry{}
+		c.entries[key] = e
+	}
+	e.lastUsed = time.Now()
+	return e
+}
+
+func typeCheck(fset *token.FileSet, pkgName string, files []*ast.File, importer types.Importer) (*types.Package, *types.Info) {
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{Importer: importer}
+	conf.Error = func(err error) {
+		// log.Debugf("type check error: %v", err) // too verbose and less important in our case
+	}
+	pkg, _ := conf.Check(pkgName, fset, files, info)
+	return pkg, info
+}
+
+// moduleFilesModTime returns the latest modification time of go.mod and go.sum of the module.
+// The export data of the dependencies may be changed when these files are modified.
+func moduleFilesModTime(dirPath string) time.Time {
+	var latest time.Time
+	moduleDir := findModuleDir(dirPath)
+	if moduleDir == "" {
+		return latest
+	}
+	for _, name := range []string{"go.mod", "go.sum"} {
+		if fi, err := os.Stat(filepath.Join(moduleDir, name)); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"go/ast"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackageCache_Load(t *testing.T) {
+	cwd, _ := os.Getwd()
+	pkgPath := filepath.Join(cwd, "testdata", "typical")
+	metadata := &packageMetadata{Dir: pkgPath, Name: "testdata", GoFiles: []string{"sum.go", "sum_test.go"}}
+	cache := newPackageCache()
+
+	cached := cache.load(buildConfig{ctxt: &build.Default}, metadata)
+	sumPath := filepath.Join(pkgPath, "sum.go")
+	testPath := filepath.Join(pkgPath, "sum_test.go")
+	if len(cached.pkg.Files) != 2 {
+		t.Fatalf("wrong number of files: %d", len(cached.pkg.Files))
+	}
+
+	// the imported types are resolved.
+	found := false
+	for id, obj := range cached.info.Uses {
+		if id.Name == "T" && obj.Pkg() != nil && obj.Pkg().Path() == "testing" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("testing.T is not resolved")
+	}
+
+	// only the modified file is parsed again.
+	overlay := map[string][]byte{testPath: []byte("package testdata\n\nimport \"testing\"\n\nfunc TestSum(t *testing.T) {\n}\n")}
+	newCached := cache.load(buildConfig{ctxt: newOverlayContext(&build.Default, overlay)}, metadata)
+	if newCached.pkg.Files[sumPath] != cached.pkg.Files[sumPath] || newCached.indexes[sumPath] != cached.indexes[sumPath] {
+		t.Errorf("the unmodified file is parsed again")
+	}
+	if newCached.pkg.Files[testPath] == cached.pkg.Files[testPath] || newCached.indexes[testPath] == cached.indexes[testPath] {
+		t.Errorf("the modified file is not parsed again")
+	}
+	if newCached.info == cached.info {
+		t.Errorf("the package is not type-checked again")
+	}
+
+	// nothing is modified.
+	sameCached := cache.load(buildConfig{ctxt: newOverlayContext(&build.Default, overlay)}, metadata)
+	if sameCached.pkg != newCached.pkg || sameCached.info != newCached.info {
+		t.Errorf("the package is not cached")
+	}
+	var decls []string
+	for _, d := range sameCached.pkg.Files[testPath].Decls {
+		if fd, ok := d.(*ast.FuncDecl); ok {
+			decls = append(decls, fd.Name.Name)
+		}
+	}
+	if len(decls) != 1 || decls[0] != "TestSum" {
+		t.Errorf("wrong decls: %v", decls)
+	}
+}
+
+func TestPackageCache_LoadSameStat(t *testing.T) {
+	cwd, _ := os.Getwd()
+	pkgPath := filepath.Join(cwd, "testdata", "typical")
+	fis, err := readDir(nil, pkgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := &packageMetadata{Dir: pkgPath, Name: "testdata", GoFiles: []string{"sum.go", "sum_test.go"}, FileStats: newFileStats(fis)}
+	cache := newPackageCache()
+	cached := cache.load(buildConfig{ctxt: &build.Default}, metadata)
+
+	// the file is not read if the stat is not changed, so the content in the build context is ignored.
+	testPath := filepath.Join(pkgPath, "sum_test.go")
+	overlay := map[string][]byte{testPath: []byte("package testdata\n")}
+	newCached := cache.load(buildConfig{ctxt: newOverlayContext(&build.Default, overlay)}, metadata)
+	if newCached.pkg.Files[testPath] != cached.pkg.Files[testPath] {
+		t.Errorf("the file is read again")
+	}
+
+	// the file in the overlay is always read.
+	newCached = cache.load(buildConfig{ctxt: newOverlayContext(&build.Default, overlay), overlay: overlay}, metadata)
+	if newCached.pkg.Files[testPath] == cached.pkg.Files[testPath] {
+		t.Errorf("the file in the overlay is not read")
+	}
+
+	// the file is read if the stat is changed.
+	metadata.FileStats = map[string]fileStat{}
+	newCached = cache.load(buildConfig{ctxt: &build.Default}, metadata)
+	if newCached.pkg.Files[testPath] == cached.pkg.Files[testPath] {
+		t.Errorf("the file is not read")
+	}
+}
+
+func TestPackageCache_LoadRewrittenWithSameStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sum.go")
+	if err := ioutil.WriteFile(path, []byte("package sum\n\nfunc Sum() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fis, err := readDir(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := &packageMetadata{Dir: dir, Name: "sum", GoFiles: []string{"sum.go"}, FileStats: newFileStats(fis)}
+	cache := newPackageCache()
+	cache.load(buildConfig{ctxt: &build.Default}, metadata)
+
+	// rewrite the file within the granularity of the modification time. The size and the modification time are not changed.
+	if err := ioutil.WriteFile(path, []byte("package sum\n\nfunc Mul() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	fis, err = readDir(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStats := metadata.FileStats
+	metadata.FileStats = newFileStats(fis)
+	if metadata.FileStats["sum.go"] != oldStats["sum.go"] {
+		t.Fatalf("the stat is changed")
+	}
+
+	newCached := cache.load(buildConfig{ctxt: &build.Default}, metadata)
+	if newCached.typesPkg.Scope().Lookup("Mul") == nil {
+		t.Errorf("the rewritten file is not read")
+	}
+}
+
+func TestPackageCache_Evict(t *testing.T) {
+	cache := newPackageCache()
+	for i := 0; i < maxCachedPackages+1; i++ {
+		cache.entry(packageCacheKey{dirPath: filepath.Join("/path", string(rune('a'+i%26)), string(rune('a'+i/26)))})
+	}
+	if len(cache.entries) != maxCachedPackages {
+		t.Errorf("wrong number of entries: %d", len(cache.entries))
+	}
+}
@@ -1,25 +1,69 @@
 package server
 
-import "sync"
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// the max number of the changes of go.mod and go.sum the module keeps. The oldest change is dropped even if
+// some package hasn't tested it, so that the package which never tests again doesn't keep the changes forever.
+// The package still tests the newer changes.
+const maxModuleChanges = 256
 
 type changeManager struct {
-	m   map[string][]Change
-	mtx sync.Mutex
+	m map[string][]Change
+	// the changes of go.mod and go.sum, keyed by the module root directory.
+	// These changes may affect all the packages in the module, so they are kept until all the packages test them.
+	modChanges map[string]*moduleChangeLog
+	// the contents of the unsaved files, keyed by the abs path.
+	overlays map[string]overlayEntry
+	mtx      sync.Mutex
+}
+
+// moduleChangeLog is the changes of go.mod and go.sum in the module.
+// Each change has the sequence number, which is its index if no change is trimmed.
+type moduleChangeLog struct {
+	// the sequence number of changes[0].
+	offset  int
+	changes []Change
+	// the sequence number of the next change the package has to test, keyed by the package directory.
+	done map[string]int
+}
+
+// moduleChangesMark is the position in the module change log up to which the job tests.
+// The zero value means the package is not in any module.
+type moduleChangesMark struct {
+	moduleDirPath string
+	next          int
+}
+
+type overlayEntry struct {
+	content    []byte
+	receivedAt time.Time
+	// the content is deleted after this time. Zero if it's kept until the file is saved or `DeleteOverlay` is called.
+	expiresAt time.Time
 }
 
 // Change represents the change of some region in the file.
 type Change struct {
+	// the relative path from the package directory. Usually it's the base name, but may include the directory
+	// when the file is the test data or the embedded file.
 	Basename string
 	// [begin, end], inclusive
 	Begin, End int64
 }
 
-func newChangeManager() changeManager {
-	return changeManager{m: make(map[string][]Change)}
+func newChangeManager() *changeManager {
+	return &changeManager{
+		m:          make(map[string][]Change),
+		modChanges: make(map[string]*moduleChangeLog),
+		overlays:   make(map[string]overlayEntry),
+	}
 }
 
 // Add adds the new change.
-func (m changeManager) Add(dirPath string, ch Change) {
+func (m *changeManager) Add(dirPath string, ch Change) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
@@ -27,7 +71,7 @@ func (m changeManager) Add(dirPath string, ch Change) {
 }
 
 // Find finds the current change list.
-func (m changeManager) Find(dirPath string) []Change {
+func (m *changeManager) Find(dirPath string) []Change {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
@@ -35,9 +79,129 @@ func (m changeManager) Find(dirPath string) []Change {
 }
 
 // Delete deletes the current change list.
-func (m changeManager) Delete(dirPath string) {
+func (m *changeManager) Delete(dirPath string) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
 	delete(m.m, dirPath)
 }
+
+// AddModuleChange adds the new change of go.mod or go.sum.
+func (m *changeManager) AddModuleChange(moduleDirPath string, ch Change) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	l, ok := m.modChanges[moduleDirPath]
+	if !ok {
+		l = &moduleChangeLog{done: make(map[string]int)}
+		m.modChanges[moduleDirPath] = l
+	}
+	l.changes = append(l.changes, ch)
+	if len(l.changes) > maxModuleChanges {
+		l.trim(l.offset + len(l.changes) - maxModuleChanges)
+	}
+}
+
+// FindModuleChanges finds the changes of go.mod or go.sum which the package has not tested yet.
+// It also returns the mark to pass to `DeleteModuleChanges` after the package tests these changes.
+// The package seen for the first time has to test all the changes which are not trimmed yet.
+func (m *changeManager) FindModuleChanges(moduleDirPath, dirPath string) ([]Change, moduleChangesMark) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	l, ok := m.modChanges[moduleDirPath]
+	if !ok {
+		return nil, moduleChangesMark{moduleDirPath, 0}
+	}
+	done, ok := l.done[dirPath]
+	if !ok {
+		done = l.offset
+		l.done[dirPath] = done
+	}
+	mark := moduleChangesMark{moduleDirPath, l.offset + len(l.changes)}
+	return l.changes[done-l.offset:], mark
+}
+
+// DeleteModuleChanges marks the changes of go.mod and go.sum up to the mark as tested by the package.
+// The changes added after the mark is taken are not affected. The changes all the packages have tested are trimmed.
+func (m *changeManager) DeleteModuleChanges(dirPath string, mark moduleChangesMark) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	l, ok := m.modChanges[mark.moduleDirPath]
+	if !ok {
+		return
+	}
+	next := mark.next
+	if next < l.offset {
+		next = l.offset
+	}
+	if done, ok := l.done[dirPath]; !ok || done < next {
+		l.done[dirPath] = next
+	}
+
+	minDone := l.offset + len(l.changes)
+	for _, done := range l.done {
+		if done < minDone {
+			minDone = done
+		}
+	}
+	if minDone > l.offset {
+		l.trim(minDone)
+	}
+}
+
+// trim drops the changes before the sequence number. The package which hasn't tested them yet tests the rest.
+func (l *moduleChangeLog) trim(next int) {
+	l.changes = append([]Change(nil), l.changes[next-l.offset:]...)
+	l.offset = next
+	for dirPath, done := range l.done {
+		if done < next {
+			l.done[dirPath] = next
+		}
+	}
+}
+
+// AddOverlay adds the content of the unsaved file. The older content of the same file is replaced.
+// The content expires after the `ttl` unless it's replaced again. 0 means the content doesn't expire.
+func (m *changeManager) AddOverlay(path string, content []byte, ttl time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	entry := overlayEntry{content: content, receivedAt: time.Now()}
+	if ttl > 0 {
+		entry.expiresAt = entry.receivedAt.Add(ttl)
+	}
+	m.overlays[path] = entry
+}
+
+// DeleteOverlay deletes the content of the unsaved file, e.g. when the file is closed without saving.
+func (m *changeManager) DeleteOverlay(path string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	delete(m.overlays, path)
+}
+
+// FindOverlays finds the contents of the unsaved files.
+// The content is deleted if the file on the disk is modified after the content is added, because it means the file is saved.
+// The expired content is deleted too.
+func (m *changeManager) FindOverlays() map[string][]byte {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := time.Now()
+	overlays := make(map[string][]byte)
+	for path, entry := range m.overlays {
+		if !entry.expiresAt.IsZero() && now.After(entry.expiresAt) {
+			delete(m.overlays, path)
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(entry.receivedAt) {
+			delete(m.overlays, path)
+			continue
+		}
+		overlays[path] = entry.content
+	}
+	return overlays
+}
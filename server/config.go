@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/go-noisegate/noisegate/common"
+	"github.com/go-noisegate/noisegate/common/log"
+)
+
+// applyConfig applies the configuration file of the package to the test request, and returns the selector and
+// the go test options.
+// The selector is the first one found in: `all` if bypassed, the selector of the request, and the selector of the
+// configuration. `influenced` if none is found. The failed tests are always selected until they pass.
+// The go test options in the configuration come first so that the options in the request can override them.
+// The merged options are checked against the policy because the configuration file may come from the untrusted repository.
+func (s *Server) applyConfig(pkgDir string, bypass bool, selectorSpec string, opts []string) (Selector, []string, error) {
+	config, err := common.FindConfig(pkgDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if config != nil {
+		opts = append(config.GoTestOptionsFor(pkgDir), opts...)
+		if err := s.checkGoTestOptions(pkgDir, opts); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch {
+	case bypass:
+		selectorSpec = common.SelectorAll
+	case selectorSpec != "":
+	case config != nil && config.Selector != "":
+		selectorSpec = config.Selector
+	default:
+		selectorSpec = common.SelectorInfluenced
+	}
+	selector, err := NewSelector(selectorSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+	return withFailedSelector(selector), opts, nil
+}
+
+// findChangeSelector returns the selector which finds the tests affected by the changes in the way of
+// the selector of the configuration. Unlike the selector of `applyConfig`, it doesn't select the tests
+// unrelated to the changes (e.g. the failed tests). `influenced` if the configuration has no such selector.
+func findChangeSelector(pkgDir string) Selector {
+	config, err := common.FindConfig(pkgDir)
+	if err != nil {
+		log.Printf("failed to read the config: %v\n", err)
+		return influencedSelector{}
+	} else if config == nil || config.Selector == "" {
+		return influencedSelector{}
+	}
+
+	selector, err := NewSelector(config.Selector)
+	if err != nil {
+		log.Printf("failed to create the selector: %v\n", err)
+		return influencedSelector{}
+	}
+	if selector = changeSelector(selector); selector == nil {
+		return influencedSelector{}
+	}
+	return selector
+}
+
+// findRetries returns the max number of times each failed test function is retried. The number in the request
+// takes precedence over the configuration file.
+func findRetries(pkgDir string, requested int) int {
+	if requested > 0 {
+		return requested
+	}
+	config, err := common.FindConfig(pkgDir)
+	if err != nil || config == nil {
+		return 0
+	}
+	return config.Retries
+}
+
+// isExcluded returns true if the changes of the file are ignored by the configuration file.
+func isExcluded(path string) bool {
+	config, err := common.FindConfig(filepath.Dir(path))
+	if err != nil {
+		log.Printf("failed to read the config: %v\n", err)
+		return false
+	}
+	return config != nil && config.IsExcluded(path)
+}
+
+// acquireJobSlot waits until the number of the running jobs in the directory of the configuration file
+// becomes less than the `parallel` setting. The caller must call the returned function to release the slot.
+func (s *Server) acquireJobSlot(ctx context.Context, pkgDir string) (func(), error) {
+	config, err := common.FindConfig(pkgDir)
+	if err != nil || config == nil || config.Parallel == 0 {
+		return func() {}, nil
+	}
+
+	s.jobSlotsMtx.Lock()
+	slots, ok := s.jobSlots[config.Dir]
+	if !ok || cap(slots) != config.Parallel {
+		slots = make(chan struct{}, config.Parallel)
+		s.jobSlots[config.Dir] = slots
+	}
+	s.jobSlotsMtx.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
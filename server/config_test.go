@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+func TestHandleTest_Config(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	dirPath := filepath.Join(curr, "testdata", "config", "sub")
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin": 25, "end": 25}]}`, filepath.Join(dirPath, "sum.go"))))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+	req = httptest.NewRequest("GET", common.HintPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin": 26, "end": 26}]}`, filepath.Join(dirPath, "sum_gen.go"))))
+	w = httptest.NewRecorder()
+	server.handleHint(w, req)
+
+	req = httptest.NewRequest("GET", common.TestPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "dry_run": true, "go_test_options": ["-v"]}`, dirPath)))
+	w = httptest.NewRecorder()
+	server.handleTest(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected code: %d", w.Code)
+	}
+
+	out, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(out), "Command: go test -count=1 -short -v -run '^TestSum$' .") {
+		t.Errorf("unexpected content: %s", string(out))
+	}
+	if changes := server.changeManager.Find(dirPath); len(changes) != 1 || changes[0].Basename != "sum.go" {
+		t.Errorf("the excluded change is stored: %#v", changes)
+	}
+}
+
+func TestApplyConfig_DeniedOption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, common.ConfigFileName), []byte("go_test_options: [\"-exec=evil\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer("")
+	if _, _, err := server.applyConfig(dir, false, "", nil); err == nil {
+		t.Errorf("nil error")
+	}
+}
+
+func TestApplyConfig_SelectAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, common.ConfigFileName), []byte("selector: all\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer("")
+	selector, opts, err := server.applyConfig(dir, false, "", []string{"-v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := selector.(allSelector); !ok || len(opts) != 1 || opts[0] != "-v" {
+		t.Errorf("unexpected result: %#v, %v", selector, opts)
+	}
+}
+
+func TestApplyConfig_Selector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, common.ConfigFileName), []byte("selector: influenced+failed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer("")
+	for i, testCase := range []struct {
+		bypass   bool
+		selector string
+		expected Selector
+	}{
+		{false, "", unionSelector{influencedSelector{}, failedSelector{}}},
+		{false, "changed-files", unionSelector{changedFilesSelector{}, failedSelector{}}},
+		{true, "changed-files", allSelector{}},
+	} {
+		selector, _, err := server.applyConfig(dir, testCase.bypass, testCase.selector, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(testCase.expected, selector) {
+			t.Errorf("[%d] unexpected selector: %#v", i, selector)
+		}
+	}
+
+	if _, _, err := server.applyConfig(dir, false, "unknown", nil); err == nil {
+		t.Errorf("nil error")
+	}
+}
+
+func TestAcquireJobSlot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, common.ConfigFileName), []byte("parallel: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer("")
+	release, err := server.acquireJobSlot(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := server.acquireJobSlot(ctx, dir); err == nil {
+		t.Errorf("the slot is acquired twice")
+	}
+
+	release()
+	if release, err := server.acquireJobSlot(context.Background(), dir); err != nil {
+		t.Error(err)
+	} else {
+		release()
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common"
+	"github.com/go-noisegate/noisegate/common/log"
+)
+
+// findCoveredTests finds the test functions which covered the changed lines when the coverage was collected.
+// Unlike `findInfluencedTests`, it finds the call via the reflection, the interface and so on, but the coverage must be
+// collected in advance (see `collectCoverage`). The changes are analyzed by `findInfluencedTests` instead if the coverage
+// is not collected yet. The changes of the test files and the non-go files are always analyzed by `findInfluencedTests`,
+// because the coverage profile doesn't cover them. So are the changes of the files modified since the coverage was collected,
+// because the line numbers in the profile may not match the current content.
+func findCoveredTests(conf buildConfig, dirPath string, changes []Change) ([]Influence, error) {
+	profile := defaultCoverageStore.find(dirPath)
+	if profile == nil {
+		log.Debugf("the coverage of %s is not collected yet\n", dirPath)
+		return findInfluencedTests(conf, dirPath, changes)
+	}
+
+	var staticChanges []Change
+	var ins []Influence
+	found := make(map[string]struct{})
+	for _, ch := range changes {
+		if !isGoSourceFile(ch.Basename) || strings.HasSuffix(ch.Basename, "_test.go") {
+			staticChanges = append(staticChanges, ch)
+			continue
+		}
+
+		path := ch.Basename
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dirPath, path)
+		}
+		content, err := readFile(conf.ctxt, path)
+		if err != nil {
+			log.Printf("failed to read %s: %v\n", path, err)
+			continue
+		}
+		if hash, ok := profile.hashes[filepath.Base(path)]; !ok || hash != sha256.Sum256(content) {
+			log.Debugf("%s is modified since the coverage was collected\n", path)
+			staticChanges = append(staticChanges, ch)
+			continue
+		}
+		begin, end := offsetToLine(content, ch.Begin), offsetToLine(content, ch.End)
+		id := coverageIdentity{filepath.Base(path), begin, end}
+		if _, ok := found[id.Name()]; ok {
+			continue
+		}
+		found[id.Name()] = struct{}{}
+
+		head := chain{{id.Name(), token.Position{Filename: path, Line: begin}}}
+		testFunctions := make(map[string]chain)
+		for _, testFunction := range profile.testsCovering(id.filename, begin, end) {
+			testFunctions[testFunction] = head.extend(testFunction, token.Position{})
+		}
+		ins = append(ins, Influence{from: id, to: testFunctions})
+	}
+
+	staticIns, err := findInfluencedTests(conf, dirPath, staticChanges)
+	if err != nil {
+		return nil, err
+	}
+	return append(ins, staticIns...), nil
+}
+
+// offsetToLine returns the 1-based line number of the offset.
+func offsetToLine(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+// coverageProfile represents which test functions cover which lines of the package.
+type coverageProfile struct {
+	// the covered blocks, keyed by the base name of the file.
+	blocks map[string][]coverBlock
+	// the hashes of the go files when the coverage is collected, keyed by the base name of the file.
+	hashes map[string][sha256.Size]byte
+}
+
+// coverBlock represents the lines [startLine, endLine] and the test functions which cover them.
+type coverBlock struct {
+	startLine, endLine int
+	testFunctions      []string
+}
+
+// testsCovering returns the test functions which cover any of the lines [begin, end] of the file.
+func (p *coverageProfile) testsCovering(filename string, begin, end int) []string {
+	var testFunctions []string
+	found := make(map[string]struct{})
+	for _, b := range p.blocks[filename] {
+		if b.endLine < begin || end < b.startLine {
+			continue
+		}
+		for _, f := range b.testFunctions {
+			if _, ok := found[f]; !ok {
+				found[f] = struct{}{}
+				testFunctions = append(testFunctions, f)
+			}
+		}
+	}
+	return testFunctions
+}
+
+// coverageStore keeps the latest coverage profile of each package. It also makes sure only one collection runs
+// in each package.
+type coverageStore struct {
+	profiles   map[string]*coverageProfile
+	collecting map[string]struct{}
+	mtx        sync.Mutex
+}
+
+var defaultCoverageStore = newCoverageStore()
+
+func newCoverageStore() *coverageStore {
+	return &coverageStore{profiles: make(map[string]*coverageProfile), collecting: make(map[string]struct{})}
+}
+
+// find returns the coverage profile of the package. nil if not collected.
+func (s *coverageStore) find(dirPath string) *coverageProfile {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.profiles[dirPath]
+}
+
+func (s *coverageStore) store(dirPath string, profile *coverageProfile) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.profiles[dirPath] = profile
+}
+
+// startCollecting returns false if the collection is already running in the package.
+// The caller must call `finishCollecting` if it returns true.
+func (s *coverageStore) startCollecting(dirPath string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.collecting[dirPath]; ok {
+		return false
+	}
+	s.collecting[dirPath] = struct{}{}
+	return true
+}
+
+func (s *coverageStore) finishCollecting(dirPath string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.collecting, dirPath)
+}
+
+// startCoverageCollection collects the coverage of the tests in the package of the job in the background,
+// if the selector of the package uses the coverage and any go file is modified since the last collection.
+// It's called when the job passes, so that the coverage reflects the latest working code.
+// The collection is canceled when the server is shut down.
+func (s *Server) startCoverageCollection(job *Job) {
+	if !usesCoverage(job.DirPath) || !defaultCoverageStore.startCollecting(job.DirPath) {
+		return
+	}
+
+	var testFunctions []string
+	for _, t := range job.Tasks {
+		testFunctions = append(testFunctions, t.TestFunction)
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer defaultCoverageStore.finishCollecting(job.DirPath)
+
+		if prev := defaultCoverageStore.find(job.DirPath); prev != nil && reflect.DeepEqual(prev.hashes, hashGoFiles(job.DirPath)) {
+			log.Debugf("the coverage of %s is up to date\n", job.DirPath)
+			return
+		}
+
+		start := time.Now()
+		profile, err := collectCoverage(s.ctx, job.DirPath, testFunctions, job.GoTestOptions, job.env)
+		if err != nil {
+			log.Printf("failed to collect the coverage of %s: %v\n", job.DirPath, err)
+			return
+		}
+		defaultCoverageStore.store(job.DirPath, profile)
+		log.Debugf("coverage collection time: %v\n", time.Since(start))
+	}()
+}
+
+// usesCoverage returns true if the selector of the package uses the coverage.
+func usesCoverage(dirPath string) bool {
+	config, err := common.FindConfig(dirPath)
+	if err != nil || config == nil || config.Selector == "" {
+		return false
+	}
+	selector, err := NewSelector(config.Selector)
+	return err == nil && containsSelector(selector, func(s Selector) bool {
+		_, ok := s.(coverageSelector)
+		return ok
+	})
+}
+
+// collectCoverage runs each test function separately with the `-coverprofile` option, and returns which test
+// functions cover which lines. It takes a while because the test runs as many times as the number of the test functions.
+// `env` is the environment variables of the go command, in the `key=value` form.
+func collectCoverage(ctx context.Context, dirPath string, testFunctions, goTestOpts, env []string) (*coverageProfile, error) {
+	tempDir, err := ioutil.TempDir("", "noisegate-coverage")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	// the options after `-args` are passed to the test binary.
+	var testBinaryArgs []string
+	for i, opt := range goTestOpts {
+		if opt == "-args" || opt == "--args" {
+			goTestOpts, testBinaryArgs = goTestOpts[:i], goTestOpts[i:]
+			break
+		}
+	}
+
+	hashes := hashGoFiles(dirPath)
+	profile := &coverageProfile{blocks: make(map[string][]coverBlock), hashes: make(map[string][sha256.Size]byte)}
+	for i, testFunction := range testFunctions {
+		profilePath := filepath.Join(tempDir, fmt.Sprintf("%d.out", i))
+		args := append([]string{"test"}, goTestOpts...)
+		args = append(args, "-count=1", "-covermode=set", "-coverprofile="+profilePath, "-run", "^"+testFunction+"$", ".")
+		args = append(args, testBinaryArgs...)
+		cmd := exec.CommandContext(ctx, "go", args...)
+		cmd.Dir = dirPath
+		cmd.Env = env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			// the failed test still has the coverage.
+			log.Debugf("failed to run %s: %v\n%s", testFunction, err, out)
+		}
+
+		f, err := os.Open(profilePath)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Debugf("no coverage profile of %s: %v\n", testFunction, err)
+			continue
+		}
+		blocks, err := parseCoverProfile(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for filename, bs := range blocks {
+			for _, b := range bs {
+				b.testFunctions = []string{testFunction}
+				profile.blocks[filename] = append(profile.blocks[filename], b)
+			}
+		}
+	}
+
+	// the files modified during the collection are not trusted.
+	for filename, hash := range hashGoFiles(dirPath) {
+		if hashes[filename] == hash {
+			profile.hashes[filename] = hash
+		}
+	}
+	return profile, nil
+}
+
+// hashGoFiles returns the hashes of the go files in the directory, keyed by the base name.
+func hashGoFiles(dirPath string) map[string][sha256.Size]byte {
+	hashes := make(map[string][sha256.Size]byte)
+	fis, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		log.Debugf("failed to read %s: %v\n", dirPath, err)
+		return hashes
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".go" {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dirPath, fi.Name()))
+		if err != nil {
+			continue
+		}
+		hashes[fi.Name()] = sha256.Sum256(content)
+	}
+	return hashes
+}
+
+// parseCoverProfile parses the coverage profile and returns the covered blocks, keyed by the base name of the file.
+// The format of each line is `import/path/file.go:startLine.startCol,endLine.endCol numStmts count`.
+func parseCoverProfile(r io.Reader) (map[string][]coverBlock, error) {
+	blocks := make(map[string][]coverBlock)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		i := strings.LastIndex(line, ":")
+		if len(fields) != 3 || i == -1 {
+			return nil, fmt.Errorf("invalid coverage profile line: %s", line)
+		}
+		if fields[2] == "0" {
+			continue
+		}
+
+		var startLine, startCol, endLine, endCol int
+		if _, err := fmt.Sscanf(line[i+1:], "%d.%d,%d.%d", &startLine, &startCol, &endLine, &endCol); err != nil {
+			return nil, fmt.Errorf("invalid coverage profile line: %s", line)
+		}
+		filename := filepath.Base(filepath.FromSlash(line[:i]))
+		blocks[filename] = append(blocks[filename], coverBlock{startLine: startLine, endLine: endLine})
+	}
+	return blocks, scanner.Err()
+}
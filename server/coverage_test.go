@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCoverProfile(t *testing.T) {
+	profile := `mode: set
+example.com/calc/calc.go:5.35,7.2 1 1
+example.com/calc/calc.go:9.35,11.2 1 0
+example.com/calc/sub/calc.go:3.10,4.2 1 1
+`
+	blocks, err := parseCoverProfile(strings.NewReader(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string][]coverBlock{"calc.go": {{startLine: 5, endLine: 7}, {startLine: 3, endLine: 4}}}
+	if !reflect.DeepEqual(expect, blocks) {
+		t.Errorf("unexpected blocks: %#v", blocks)
+	}
+
+	if _, err := parseCoverProfile(strings.NewReader("calc.go 1 1\n")); err == nil {
+		t.Errorf("nil error")
+	}
+}
+
+func TestCoverageProfile_TestsCovering(t *testing.T) {
+	profile := &coverageProfile{blocks: map[string][]coverBlock{
+		"calc.go": {{5, 7, []string{"TestAdd"}}, {9, 11, []string{"TestMul"}}, {5, 7, []string{"TestCalc"}}},
+	}}
+	for i, testCase := range []struct {
+		begin, end int
+		expect     []string
+	}{
+		{6, 6, []string{"TestAdd", "TestCalc"}},
+		{7, 9, []string{"TestAdd", "TestMul", "TestCalc"}},
+		{8, 8, nil},
+	} {
+		if actual := profile.testsCovering("calc.go", testCase.begin, testCase.end); !reflect.DeepEqual(testCase.expect, actual) {
+			t.Errorf("[%d] unexpected tests: %v", i, actual)
+		}
+	}
+}
+
+func TestCollectCoverage(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "coverage")
+	profile, err := collectCoverage(context.Background(), dirPath, []string{"TestAdd", "TestMulByName"}, []string{"-v"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tests := profile.testsCovering("calc.go", 10, 10); !reflect.DeepEqual([]string{"TestMulByName"}, tests) {
+		t.Errorf("unexpected tests: %v", tests)
+	}
+	if tests := profile.testsCovering("calc.go", 6, 6); !reflect.DeepEqual([]string{"TestAdd"}, tests) {
+		t.Errorf("unexpected tests: %v", tests)
+	}
+}
+
+func TestFindCoveredTests(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "coverage")
+	content, _ := ioutil.ReadFile(filepath.Join(dirPath, "calc.go"))
+	offset := int64(strings.Index(string(content), "a * b"))
+	changes := []Change{{"calc.go", offset, offset}}
+
+	// the coverage is not collected yet.
+	ins, err := findCoveredTests(buildConfig{ctxt: &build.Default}, dirPath, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ins) != 1 || len(ins[0].to) != 0 {
+		t.Errorf("unexpected influences: %#v", ins)
+	}
+
+	defaultCoverageStore.store(dirPath, &coverageProfile{blocks: map[string][]coverBlock{"calc.go": {{9, 11, []string{"TestMulByName"}}}}, hashes: hashGoFiles(dirPath)})
+	defer defaultCoverageStore.store(dirPath, nil)
+	ins, err = findCoveredTests(buildConfig{ctxt: &build.Default}, dirPath, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ins) != 1 || ins[0].from.Name() != "calc.go:L10" {
+		t.Fatalf("unexpected influences: %#v", ins)
+	}
+	if _, ok := ins[0].to["TestMulByName"]; !ok {
+		t.Errorf("unexpected influence to: %#v", ins[0].to)
+	}
+
+	// the file is modified since the coverage was collected.
+	overlay := map[string][]byte{filepath.Join(dirPath, "calc.go"): append([]byte("// new line\n"), content...)}
+	ins, err = findCoveredTests(buildConfig{ctxt: newOverlayContext(&build.Default, overlay), overlay: overlay}, dirPath, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ins) != 1 || ins[0].from.Name() == "calc.go:L10" {
+		t.Errorf("unexpected influences: %#v", ins)
+	}
+}
+
+func TestNewJob_CoverageStrategy(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "coverage")
+	content, _ := ioutil.ReadFile(filepath.Join(dirPath, "calc.go"))
+	offset := int64(strings.Index(string(content), "a * b"))
+
+	defaultCoverageStore.store(dirPath, &coverageProfile{blocks: map[string][]coverBlock{"calc.go": {{9, 11, []string{"TestMulByName"}}}}, hashes: hashGoFiles(dirPath)})
+	defer defaultCoverageStore.store(dirPath, nil)
+	job, err := NewJob(dirPath, findChangeSelector(dirPath), []Change{{"calc.go", offset, offset}}, nil, nil, nil, nil, &strings.Builder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the static analysis finds nothing because the method is called by the name.
+	if names := job.changedIdentityNames(); !reflect.DeepEqual([]string{"Calculator.Mul", "calc.go:L10"}, names) {
+		t.Errorf("unexpected changed identities: %v", names)
+	}
+	if len(job.TaskSets) != 1 || len(job.TaskSets[0].Tasks) != 1 || job.TaskSets[0].Tasks[0].TestFunction != "TestMulByName" {
+		t.Errorf("unexpected task sets: %#v", job.TaskSets)
+	}
+}
+
+func TestServer_StartCoverageCollection(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "coverage")
+	job, err := NewJob(dirPath, allSelector{}, nil, nil, nil, nil, nil, &strings.Builder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer defaultCoverageStore.store(dirPath, nil)
+
+	server := NewServer("")
+	server.startCoverageCollection(job)
+	server.background.Wait()
+	profile := defaultCoverageStore.find(dirPath)
+	if profile == nil {
+		t.Fatal("the coverage is not collected")
+	}
+	if tests := profile.testsCovering("calc.go", 10, 10); !reflect.DeepEqual([]string{"TestMulByName"}, tests) {
+		t.Errorf("unexpected tests: %v", tests)
+	}
+	if _, ok := profile.hashes["calc.go"]; !ok {
+		t.Errorf("the hash is not stored: %v", profile.hashes)
+	}
+
+	// no file is modified since the last collection.
+	server.startCoverageCollection(job)
+	server.background.Wait()
+	if defaultCoverageStore.find(dirPath) != profile {
+		t.Errorf("the coverage is collected again")
+	}
+}
+
+func TestServer_StartCoverageCollectionShutdown(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "coverage")
+	job, err := NewJob(dirPath, allSelector{}, nil, nil, nil, nil, nil, &strings.Builder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer defaultCoverageStore.store(dirPath, nil)
+
+	server := NewServer("")
+	server.startCoverageCollection(job)
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if defaultCoverageStore.find(dirPath) != nil {
+		t.Errorf("the collection is not canceled")
+	}
+}
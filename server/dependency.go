@@ -4,20 +4,97 @@ import (
 	"fmt"
 	"go/ast"
 	"go/build"
-	"go/parser"
 	"go/token"
 	"go/types"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/go-noisegate/noisegate/common"
 	"github.com/go-noisegate/noisegate/common/log"
 	"golang.org/x/tools/go/ast/astutil"
 )
 
-type influence struct {
+// Influence represents the test functions selected by the change, or by the other reason like `all tests`.
+type Influence struct {
 	from identity
-	to   map[string]struct{}
+	// the affected test functions. The value explains how the change reaches the test function.
+	to map[string]chain
+}
+
+// From returns the name of the changed identity, or the reason like `(all tests)` if the test functions are selected
+// by the other reason.
+func (in Influence) From() string {
+	return in.from.Name()
+}
+
+// TestFunctions returns the names of the affected test functions in the sorted order.
+func (in Influence) TestFunctions() []string {
+	var testFunctions []string
+	for testFunction := range in.to {
+		testFunctions = append(testFunctions, testFunction)
+	}
+	sort.Strings(testFunctions)
+	return testFunctions
+}
+
+// Chain returns how the change reaches the test function. The position of each element is the abs path of the file
+// and the line where the identity uses the previous one. It returns nil if the test function is not affected.
+func (in Influence) Chain(testFunction string) []common.ChainElement {
+	c, ok := in.to[testFunction]
+	if !ok {
+		return nil
+	}
+	return c.elements("")
+}
+
+// chain is the list of the identities from the changed identity to the test function.
+// Each identity uses the previous one at the position.
+type chain []usage
+
+type usage struct {
+	name     string
+	position token.Position
+}
+
+// extend returns the new chain which has the new identity at the end.
+func (c chain) extend(name string, position token.Position) chain {
+	newChain := make(chain, len(c), len(c)+1)
+	copy(newChain, c)
+	if len(c) > 0 && c[len(c)-1].name == name {
+		// e.g. the changed identity is the test function itself.
+		return newChain
+	}
+	return append(newChain, usage{name, position})
+}
+
+// join returns the new chain which has the `other` chain at the end.
+// The first identity of `other` uses the last identity of `c` at the specified position.
+func (c chain) join(other chain, position token.Position) chain {
+	newChain := c.extend(other[0].name, position)
+	return append(newChain, other[1:]...)
+}
+
+// elements returns the elements of the chain. The file path of the position is relative to `dirPath` if not empty.
+func (c chain) elements(dirPath string) []common.ChainElement {
+	var elems []common.ChainElement
+	for _, u := range c {
+		elem := common.ChainElement{Name: u.name}
+		if u.position.IsValid() {
+			filename := u.position.Filename
+			if dirPath != "" {
+				if rel, err := filepath.Rel(dirPath, filename); err == nil {
+					filename = rel
+				}
+			}
+			elem.Position = fmt.Sprintf("%s:%d", filename, u.position.Line)
+		}
+		elems = append(elems, elem)
+	}
+	return elems
 }
 
 // findInfluencedTests finds the test functions which affected by the specified changes.
@@ -26,13 +103,14 @@ type influence struct {
 // 2. For each change, find the affected test functions:
 //   2-1. Finds the function or general declaration which encloses the change.
 //   2-2a. If the declaration is the test function, the function is affected.
-//   2-2b. Otherwise, finds the entities which uses the declaration, by traversing the AST tree.
-//         Then, check if the ascendant AST nodes of entities are the test function declaration. If so, the function is affected.
-func findInfluencedTests(ctxt *build.Context, dirPath string, changes []Change) ([]influence, error) {
+//   2-2b. Otherwise, finds the entities in the test functions which use the declaration, by looking up the test nodes
+//         of the usage index of each file. The index knows the test function of each entity, so the function is affected.
+// If the changed file is not the go file, see `findInfluences`.
+func findInfluencedTests(conf buildConfig, dirPath string, changes []Change) ([]Influence, error) {
 	if len(changes) == 0 {
 		return nil, nil
 	}
-	pkg, err := newParsedPackage(ctxt, dirPath)
+	pkg, err := newParsedPackage(conf, dirPath)
 	if err != nil {
 		if _, ok := err.(*build.NoGoError); ok {
 			return nil, nil
@@ -40,136 +118,694 @@ func findInfluencedTests(ctxt *build.Context, dirPath string, changes []Change)
 		return nil, err
 	}
 
-	var ins []influence
+	var ins []Influence
 	for _, ch := range changes {
-		for offset := ch.Begin; offset <= ch.End; offset++ {
-			in, err := pkg.findInfluence(ch.Basename, offset)
-			if err != nil {
-				log.Print(err)
-				continue
-			}
-			if in.from != nil {
-				ins = append(ins, in)
-			}
+		chIns, err := pkg.findInfluences(ch)
+		if err != nil {
+			log.Print(err)
+			continue
 		}
+		ins = append(ins, chIns...)
 	}
 	return ins, nil
 }
 
 type parsedPackage struct {
-	pkgDir string
-	pkg    *ast.Package
-	fset   *token.FileSet
-	info   *types.Info
-	found  map[string]struct{}
+	ctxt     *build.Context
+	pkgDir   string
+	pkg      *ast.Package
+	fset     *token.FileSet
+	typesPkg *types.Package
+	info     *types.Info
+	// the usage indexes of the files, keyed by the abs path.
+	indexes map[string]*usageIndex
+	found   map[string]struct{}
 }
 
 // `packageDir` must be abs.
-func newParsedPackage(ctxt *build.Context, packageDir string) (parsedPackage, error) {
-	pkg, err := ctxt.ImportDir(packageDir, build.IgnoreVendor)
+func newParsedPackage(conf buildConfig, packageDir string) (parsedPackage, error) {
+	metadata, err := loadPackageMetadata(conf, packageDir)
 	if err != nil {
 		return parsedPackage{}, err
 	}
 
-	filenames := pkg.GoFiles
-	filenames = append(filenames, pkg.TestGoFiles...)
-	filenames = append(filenames, pkg.XTestGoFiles...) // TODO: better XTest package support
+	cached := defaultPackageCache.load(conf, metadata)
+	return parsedPackage{ctxt: conf.ctxt, pkgDir: packageDir, pkg: cached.pkg, fset: cached.fset, typesPkg: cached.typesPkg, info: cached.info,
+		indexes: cached.indexes, found: make(map[string]struct{})}, nil
+}
 
-	fset := token.NewFileSet()
-	parsedFiles := make(map[string]*ast.File)
-	var files []*ast.File // redundant, but types package needs this
-	for _, file := range filenames {
-		path := filepath.Join(packageDir, file)
-		f, err := parser.ParseFile(fset, path, nil, 0)
-		if err != nil {
-			log.Printf("failed to parse %s: %v\n", path, err)
-		}
-		if f != nil {
-			parsedFiles[path] = f
-			files = append(files, f)
-		}
+// findInfluences finds the influences of the change. How to find them depends on the type of the changed file:
+// * go.mod or go.sum: see `findModuleInfluences`.
+// * assembly file: see `findAssemblyInfluences`.
+// * C source or header file: see `findCgoInfluence`.
+// * other non-go file: see `findFileInfluence`.
+func (p parsedPackage) findInfluences(ch Change) ([]Influence, error) {
+	relPath := p.relPath(ch.Basename)
+	switch {
+	case isModuleFile(relPath):
+		return p.findModuleInfluences(ch)
+	case isAssemblyFile(relPath):
+		return p.findAssemblyInfluences(ch)
 	}
 
-	// NewPackage returns the error when there are unresolved identities, which is ignorable here.
-	astPkg, _ := ast.NewPackage(fset, parsedFiles, nil, nil)
-
-	info := types.Info{
-		Types: make(map[ast.Expr]types.TypeAndValue),
-		Defs:  make(map[*ast.Ident]types.Object),
-		Uses:  make(map[*ast.Ident]types.Object),
+	var in Influence
+	var err error
+	switch {
+	case isCgoSourceFile(relPath):
+		in, err = p.findCgoInfluence(fileIdentity{filepath.ToSlash(relPath)})
+	case !isGoSourceFile(relPath):
+		in, err = p.findFileInfluence(ch.Basename)
+	default:
+		var ins []Influence
+		for offset := ch.Begin; offset <= ch.End; offset++ {
+			in, err := p.findInfluence(ch.Basename, offset)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			if in.from != nil {
+				ins = append(ins, in)
+			}
+		}
+		return ins, nil
 	}
-	var conf types.Config
-	conf.Error = func(err error) {
-		// log.Debugf("type check error: %v", err) // too verbose and less important in our case
+	if err != nil || in.from == nil {
+		return nil, err
 	}
-	_, _ = conf.Check(astPkg.Name, fset, files, &info)
-	return parsedPackage{pkgDir: packageDir, pkg: astPkg, fset: fset, info: &info, found: make(map[string]struct{})}, nil
+	return []Influence{in}, nil
 }
 
-func (p parsedPackage) findInfluence(filename string, offset int64) (influence, error) {
+func (p parsedPackage) findInfluence(filename string, offset int64) (Influence, error) {
 	id, err := p.findEnclosingIdentity(filename, offset)
 	if err != nil {
-		return influence{}, err
+		return Influence{}, err
 	}
 	if id == nil {
-		return influence{}, nil
+		if p.inCgoPreamble(filename, offset) {
+			return p.findCgoInfluence(cgoIdentity{})
+		}
+		return Influence{}, nil
 	}
+	return p.findIdentityInfluence(id)
+}
 
+// findIdentityInfluence finds the test functions which use the specified identity.
+// It returns the empty influence if the identity is already checked.
+func (p parsedPackage) findIdentityInfluence(id identity) (Influence, error) {
 	if _, ok := p.found[id.Name()]; ok {
-		return influence{}, nil
+		return Influence{}, nil
 	}
 	p.found[id.Name()] = struct{}{}
 
-	var users []*ast.Ident
+	testFunctions, err := p.findTestFunctionsUsing(id)
+	if err != nil {
+		return Influence{}, err
+	}
+	return Influence{from: id, to: testFunctions}, nil
+}
+
+// findTestFunctionsUsing returns the test functions which use the specified identity.
+// If the identity is the test function, the function itself is returned.
+func (p parsedPackage) findTestFunctionsUsing(id identity) (map[string]chain, error) {
+	var users []testUser
 	if id.IsTestFunc() {
-		users = append(users, id.ASTIdentity())
+		r, f := p.findTestFunction(id.ASTIdentity())
+		users = append(users, testUser{id.ASTIdentity(), r, f})
 	} else {
-		users, err = p.findUsers(id)
+		var err error
+		users, err = p.findTestUsers(id)
 		if err != nil {
-			return influence{}, err
+			return nil, err
 		}
 	}
 
-	testFunctions := make(map[string]struct{})
+	head := chain{{id.Name(), p.identPosition(id.ASTIdentity())}}
+	testFunctions := make(map[string]chain)
 	testSuites := make(map[string]*ast.Ident)
+	suiteChains := make(map[string]chain)
 	for _, u := range users {
-		if r, f := p.findTestFunction(u); r == nil && f != "" {
-			testFunctions[f] = struct{}{}
-		} else if r != nil && f != "" {
-			testSuites[r.Name] = r
+		if u.testFunction == "" {
+			continue
+		}
+
+		if u.receiver == nil {
+			if _, ok := testFunctions[u.testFunction]; !ok {
+				testFunctions[u.testFunction] = head.extend(u.testFunction, p.identPosition(u.ident))
+			}
+		} else if _, ok := testSuites[u.receiver.Name]; !ok {
+			testSuites[u.receiver.Name] = u.receiver
+			suiteChains[u.receiver.Name] = head.extend(fmt.Sprintf("%s.%s", u.receiver.Name, u.testFunction), p.identPosition(u.ident))
 		}
 	}
 
-	for _, s := range testSuites {
-		if r := p.findTestSuiteRunner(s); r != "" {
-			testFunctions[r] = struct{}{}
+	for name, s := range testSuites {
+		if r, u := p.findTestSuiteRunner(s); r != "" {
+			if _, ok := testFunctions[r]; !ok {
+				testFunctions[r] = suiteChains[name].extend(r, p.identPosition(u))
+			}
 		}
 	}
+	return testFunctions, nil
+}
+
+// findTestFunctionsAffectedBy is similar to `findTestFunctionsUsing`, but it also considers the declarations
+// which use the specified identity as changed. It's useful when the identity's value is changed without any
+// change in the go files. For example, the variable to which the file is embedded.
+func (p parsedPackage) findTestFunctionsAffectedBy(id identity) (map[string]chain, error) {
+	testFunctions, err := p.findTestFunctionsUsing(id)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := p.findUsers(id)
+	if err != nil {
+		return nil, err
+	}
+	head := chain{{id.Name(), p.identPosition(id.ASTIdentity())}}
+	for _, u := range users {
+		position := p.fset.Position(u.Pos())
+		userID, err := p.findEnclosingIdentity(position.Filename, int64(position.Offset))
+		if err != nil || userID == nil || userID.Name() == id.Name() {
+			continue
+		}
 
-	return influence{from: id, to: testFunctions}, nil
+		fs, err := p.findTestFunctionsUsing(userID)
+		if err != nil {
+			return nil, err
+		}
+		for f, c := range fs {
+			if _, ok := testFunctions[f]; !ok {
+				testFunctions[f] = head.join(c, position)
+			}
+		}
+	}
+	return testFunctions, nil
 }
 
-// findEnclosingIdentity finds the top level declaration to which the node at the specified `offset` belongs.
-// For example, if the `offset` specifies the position in the function body, it returns the identity of that function.
-func (p parsedPackage) findEnclosingIdentity(filename string, offset int64) (identity, error) {
-	if !path.IsAbs(filename) {
+// findFileInfluence finds the test functions which use the non-go file. The file is used if:
+// * the file is embedded to the variable by the `//go:embed` directive, or
+// * the path of the file (or its parent directory) is written as the string literal, like `filepath.Join("testdata", "golden.txt")`.
+// `filename` is the relative path from the package directory.
+func (p parsedPackage) findFileInfluence(filename string) (Influence, error) {
+	filename = filepath.ToSlash(p.relPath(filename))
+
+	id := fileIdentity{filename}
+	if _, ok := p.found[id.Name()]; ok {
+		return Influence{}, nil
+	}
+	p.found[id.Name()] = struct{}{}
+
+	head := chain{{id.Name(), token.Position{}}}
+	testFunctions := make(map[string]chain)
+	for _, f := range p.pkg.Files {
+		for _, v := range p.findEmbeddingVars(f, filename) {
+			fs, err := p.findTestFunctionsAffectedBy(defaultIdentity{v})
+			if err != nil {
+				return Influence{}, err
+			}
+			for testFunction, c := range fs {
+				if _, ok := testFunctions[testFunction]; !ok {
+					testFunctions[testFunction] = append(head[:1:1], c...)
+				}
+			}
+		}
+
+		for _, pos := range p.findPathLiterals(f, filename) {
+			position := p.fset.Position(pos)
+			userID, err := p.findEnclosingIdentity(position.Filename, int64(position.Offset))
+			if err != nil {
+				return Influence{}, err
+			}
+			if userID == nil {
+				continue
+			}
+
+			fs, err := p.findTestFunctionsUsing(userID)
+			if err != nil {
+				return Influence{}, err
+			}
+			for testFunction, c := range fs {
+				if _, ok := testFunctions[testFunction]; !ok {
+					testFunctions[testFunction] = head.join(c, position)
+				}
+			}
+		}
+	}
+
+	return Influence{from: id, to: testFunctions}, nil
+}
+
+// findCgoInfluence finds the test functions affected by the change of the C code, i.e. the cgo preamble or
+// the C source file. All the functions which use cgo are considered as changed.
+func (p parsedPackage) findCgoInfluence(from identity) (Influence, error) {
+	if _, ok := p.found[from.Name()]; ok {
+		return Influence{}, nil
+	}
+	p.found[from.Name()] = struct{}{}
+
+	testFunctions, err := p.findTestFunctionsAffectedBy(cgoIdentity{})
+	if err != nil {
+		return Influence{}, err
+	}
+	for _, c := range testFunctions {
+		c[0] = usage{from.Name(), token.Position{}}
+	}
+	return Influence{from: from, to: testFunctions}, nil
+}
+
+// inCgoPreamble returns true if the offset points to the cgo preamble, which is the comment of the `import "C"`.
+func (p parsedPackage) inCgoPreamble(filename string, offset int64) bool {
+	if !filepath.IsAbs(filename) {
 		filename = filepath.Join(p.pkgDir, filename)
 	}
-	var pos token.Pos
-	p.fset.Iterate(func(f *token.File) bool {
-		if f.Name() == filename {
-			if int(offset) <= f.Size() {
-				pos = f.Pos(int(offset))
+	f, ok := p.pkg.Files[filename]
+	if !ok {
+		return false
+	}
+	tokenFile := p.fset.File(f.Pos())
+	if tokenFile == nil || int(offset) > tokenFile.Size() {
+		return false
+	}
+	pos := tokenFile.Pos(int(offset))
+
+	for _, decl := range f.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.IMPORT {
+			continue
+		}
+
+		for _, spec := range genDecl.Specs {
+			importSpec := spec.(*ast.ImportSpec)
+			if importSpec.Path.Value != `"C"` {
+				continue
+			}
+			doc := importSpec.Doc
+			if doc == nil && !genDecl.Lparen.IsValid() {
+				doc = genDecl.Doc
+			}
+			if doc != nil && doc.Pos() <= pos && pos < doc.End() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var patternAssemblyFunc = regexp.MustCompile(`^TEXT\s+[^\s·]*·([^\s(<·]+)`)
+
+// findAssemblyInfluences finds the test functions which use the functions implemented in the changed range of
+// the assembly file. The go declaration of the function is found by the symbol name of the `TEXT` directive.
+func (p parsedPackage) findAssemblyInfluences(ch Change) ([]Influence, error) {
+	filename := ch.Basename
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(p.pkgDir, filename)
+	}
+	content, err := readFile(p.ctxt, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// the function spans from its `TEXT` directive to the next `TEXT` directive.
+	var funcNames []string
+	var currFuncName string
+	var offset int64
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if match := patternAssemblyFunc.FindStringSubmatch(line); match != nil {
+			currFuncName = match[1]
+		}
+		lineEnd := offset + int64(len(line))
+		if currFuncName != "" && offset <= ch.End && ch.Begin < lineEnd {
+			if len(funcNames) == 0 || funcNames[len(funcNames)-1] != currFuncName {
+				funcNames = append(funcNames, currFuncName)
+			}
+		}
+		offset = lineEnd
+	}
+
+	var ins []Influence
+	for _, funcName := range funcNames {
+		id := p.findFuncIdentity(funcName)
+		if id == nil {
+			log.Debugf("the go declaration of %s is not found\n", funcName)
+			continue
+		}
+
+		in, err := p.findIdentityInfluence(id)
+		if err != nil {
+			return nil, err
+		}
+		if in.from != nil {
+			ins = append(ins, in)
+		}
+	}
+	return ins, nil
+}
+
+// findFuncIdentity returns the identity of the (non-method) function declared in the package.
+func (p parsedPackage) findFuncIdentity(funcName string) identity {
+	for filename, f := range p.pkg.Files {
+		for _, decl := range f.Decls {
+			if funcDecl, ok := decl.(*ast.FuncDecl); ok && funcDecl.Recv == nil && funcDecl.Name.Name == funcName {
+				return functionIdentity{strings.TrimSuffix(p.pkg.Name, "_test"), filename, funcDecl.Name}
+			}
+		}
+	}
+	return nil
+}
+
+// findModuleInfluences finds the test functions affected by the change of go.mod or go.sum.
+// If the changed range includes the module which the package imports, all the test functions in the package are affected
+// because the behavior of the imported package may be changed in any way.
+// The change of the other directives in go.mod, such as the `go` directive, affects all the packages.
+func (p parsedPackage) findModuleInfluences(ch Change) ([]Influence, error) {
+	filename := ch.Basename
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(p.pkgDir, filename)
+	}
+	content, err := readFile(p.ctxt, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	modulePaths, affectsAll := findChangedModules(filepath.Base(filename), content, ch.Begin, ch.End)
+	var ins []Influence
+	addInfluence := func(id identity, importSpec *ast.ImportSpec) {
+		if _, ok := p.found[id.Name()]; ok {
+			return
+		}
+		p.found[id.Name()] = struct{}{}
+
+		head := chain{{id.Name(), token.Position{}}}
+		if importSpec != nil {
+			head = head.extend(importSpec.Path.Value, p.fset.Position(importSpec.Pos()))
+		}
+		testFunctions := make(map[string]chain)
+		for name, testFunction := range p.findAllTestFunctions() {
+			testFunctions[name] = head.extend(name, p.identPosition(testFunction))
+		}
+		ins = append(ins, Influence{from: id, to: testFunctions})
+	}
+
+	if affectsAll {
+		addInfluence(moduleIdentity{filepath.Base(filename)}, nil)
+	}
+	for _, modulePath := range modulePaths {
+		if importSpec := p.findModuleImport(modulePath); importSpec != nil {
+			addInfluence(moduleIdentity{modulePath}, importSpec)
+		}
+	}
+	return ins, nil
+}
+
+// findChangedModules returns the paths of the modules written in the changed range of go.mod or go.sum.
+// `affectsAll` is true if the range includes the directive which affects all the packages in the module (e.g. `go 1.14`).
+func findChangedModules(filename string, content []byte, begin, end int64) (modulePaths []string, affectsAll bool) {
+	found := make(map[string]struct{})
+	addModulePath := func(modulePath string) {
+		if _, ok := found[modulePath]; !ok {
+			found[modulePath] = struct{}{}
+			modulePaths = append(modulePaths, modulePath)
+		}
+	}
+
+	var block string
+	var offset int64
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		lineBegin, lineEnd := offset, offset+int64(len(line))
+		offset = lineEnd
+		inRange := lineBegin <= end && begin < lineEnd
+
+		if i := strings.Index(line, "//"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if filename == "go.sum" {
+			if inRange && len(fields) > 0 {
+				addModulePath(fields[0])
+			}
+			continue
+		}
+
+		var directive string
+		var args []string
+		if block != "" {
+			if len(fields) == 1 && fields[0] == ")" {
+				block = ""
+				continue
+			}
+			directive, args = block, fields
+		} else if len(fields) > 0 {
+			directive, args = fields[0], fields[1:]
+			if len(args) == 1 && args[0] == "(" {
+				block = directive
+				continue
+			}
+		}
+		if !inRange || len(args) == 0 {
+			continue
+		}
+
+		switch directive {
+		case "require", "exclude", "replace":
+			addModulePath(strings.Trim(args[0], `"`))
+		case "module", "go", "toolchain", "godebug":
+			affectsAll = true
+		}
+	}
+	return modulePaths, affectsAll
+}
+
+// findModuleImport returns the import spec of the package in the specified module.
+// It returns nil if the package doesn't import the module.
+func (p parsedPackage) findModuleImport(modulePath string) *ast.ImportSpec {
+	for _, f := range p.pkg.Files {
+		for _, importSpec := range f.Imports {
+			importPath, _ := strconv.Unquote(importSpec.Path.Value)
+			if importPath == modulePath || strings.HasPrefix(importPath, modulePath+"/") {
+				return importSpec
+			}
+		}
+	}
+	return nil
+}
+
+// findAllTestFunctions returns all the test functions in the package.
+func (p parsedPackage) findAllTestFunctions() map[string]*ast.Ident {
+	testFunctions := make(map[string]*ast.Ident)
+	for filename, f := range p.pkg.Files {
+		if !strings.HasSuffix(filename, "_test.go") {
+			continue
+		}
+		for _, decl := range f.Decls {
+			funcDecl, ok := decl.(*ast.FuncDecl)
+			if !ok || funcDecl.Recv != nil || funcDecl.Name.Name == "TestMain" || !strings.HasPrefix(funcDecl.Name.Name, "Test") {
+				continue
+			}
+			testFunctions[funcDecl.Name.Name] = funcDecl.Name
+		}
+	}
+	return testFunctions
+}
+
+// relPath returns the relative path from the package directory.
+func (p parsedPackage) relPath(filename string) string {
+	if !filepath.IsAbs(filename) {
+		return filepath.Clean(filename)
+	}
+	rel, err := filepath.Rel(p.pkgDir, filename)
+	if err != nil {
+		return filename
+	}
+	return rel
+}
+
+// findEmbeddingVars returns the variables to which the specified file is embedded.
+func (p parsedPackage) findEmbeddingVars(f *ast.File, filename string) []*ast.Ident {
+	var vars []*ast.Ident
+	for _, decl := range f.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.VAR {
+			continue
+		}
+
+		for _, spec := range genDecl.Specs {
+			valueSpec := spec.(*ast.ValueSpec)
+			doc := valueSpec.Doc
+			if doc == nil && len(genDecl.Specs) == 1 {
+				doc = genDecl.Doc
+			}
+			if doc == nil || len(valueSpec.Names) == 0 {
+				continue
+			}
+
+			for _, pattern := range parseEmbedPatterns(doc) {
+				if embedPatternMatches(pattern, filename) {
+					vars = append(vars, valueSpec.Names[0])
+					break
+				}
+			}
+		}
+	}
+	return vars
+}
+
+// parseEmbedPatterns returns the patterns written in the `//go:embed` directives.
+func parseEmbedPatterns(doc *ast.CommentGroup) []string {
+	var patterns []string
+	for _, c := range doc.List {
+		if !strings.HasPrefix(c.Text, "//go:embed ") {
+			continue
+		}
+
+		args := strings.TrimPrefix(c.Text, "//go:embed ")
+		for len(args) > 0 {
+			args = strings.TrimLeft(args, " \t")
+			if args == "" {
+				break
+			}
+
+			var arg string
+			if args[0] == '"' || args[0] == '`' {
+				end := strings.IndexByte(args[1:], args[0])
+				if end == -1 {
+					break
+				}
+				arg, args = args[1:end+1], args[end+2:]
+			} else if i := strings.IndexAny(args, " \t"); i != -1 {
+				arg, args = args[:i], args[i:]
+			} else {
+				arg, args = args, ""
+			}
+			patterns = append(patterns, strings.TrimPrefix(arg, "all:"))
+		}
+	}
+	return patterns
+}
+
+// embedPatternMatches returns true if the pattern matches the file or its parent directory.
+func embedPatternMatches(pattern, filename string) bool {
+	for name := filename; name != "." && name != "/"; name = path.Dir(name) {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// findPathLiterals returns the positions of the string literals which specify the file or its parent directory.
+// `filepath.Join` and `path.Join` are considered if the leading args are the string literals.
+func (p parsedPackage) findPathLiterals(f *ast.File, filename string) []token.Pos {
+	var positions []token.Pos
+	ast.Inspect(f, func(n ast.Node) bool {
+		var literalPath string
+		switch v := n.(type) {
+		case *ast.BasicLit:
+			if v.Kind != token.STRING {
+				return true
+			}
+			literalPath, _ = strconv.Unquote(v.Value)
+		case *ast.CallExpr:
+			sel, ok := v.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "Join" {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); !ok || (x.Name != "filepath" && x.Name != "path") {
+				return true
+			}
+
+			var elems []string
+			for _, arg := range v.Args {
+				lit, ok := arg.(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					break
+				}
+				elem, _ := strconv.Unquote(lit.Value)
+				elems = append(elems, elem)
+			}
+			if len(elems) == 0 {
+				return true
+			}
+			if pathSpecifiesFile(path.Join(elems...), filename) {
+				positions = append(positions, n.Pos())
 			}
 			return false
+		default:
+			return true
+		}
+
+		if pathSpecifiesFile(literalPath, filename) {
+			positions = append(positions, n.Pos())
 		}
 		return true
 	})
+	return positions
+}
+
+// pathSpecifiesFile returns true if `literalPath` is the file or its parent directory.
+func pathSpecifiesFile(literalPath, filename string) bool {
+	if literalPath == "" {
+		return false
+	}
+	literalPath = path.Clean(filepath.ToSlash(literalPath))
+	if literalPath == "." || literalPath == "/" {
+		return false
+	}
+	return literalPath == filename || strings.HasPrefix(filename, literalPath+"/")
+}
+
+// isModuleFile returns true if the file is go.mod or go.sum.
+func isModuleFile(filename string) bool {
+	base := filepath.Base(filename)
+	return base == "go.mod" || base == "go.sum"
+}
+
+// isAssemblyFile returns true if the file is the go assembly file.
+func isAssemblyFile(filename string) bool {
+	return filepath.Ext(filename) == ".s" && !inTestdata(filename)
+}
+
+// isCgoSourceFile returns true if the file is the C (or C++, Objective-C) source or header file which cgo compiles.
+func isCgoSourceFile(filename string) bool {
+	switch filepath.Ext(filename) {
+	case ".c", ".h", ".cc", ".cpp", ".cxx", ".hh", ".hpp", ".hxx", ".m":
+		return !inTestdata(filename)
+	}
+	return false
+}
+
+// isGoSourceFile returns true if the file is the go file and not the test data.
+func isGoSourceFile(filename string) bool {
+	return strings.HasSuffix(filename, ".go") && !inTestdata(filename)
+}
+
+// inTestdata returns true if the relative path includes the `testdata` directory.
+func inTestdata(filename string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(filename), "/") {
+		if elem == "testdata" {
+			return true
+		}
+	}
+	return false
+}
+
+// findEnclosingIdentity finds the top level declaration to which the node at the specified `offset` belongs.
+// For example, if the `offset` specifies the position in the function body, it returns the identity of that function.
+func (p parsedPackage) findEnclosingIdentity(filename string, offset int64) (identity, error) {
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(p.pkgDir, filename)
+	}
+	// the file set may have the old versions of the file, so find the file from the package.
+	var pos token.Pos
+	f, ok := p.pkg.Files[filename]
+	if ok {
+		if tokenFile := p.fset.File(f.Pos()); tokenFile != nil && int(offset) <= tokenFile.Size() {
+			pos = tokenFile.Pos(int(offset))
+		}
+	}
 	if pos == token.NoPos {
 		return nil, fmt.Errorf("invalid filename or offset: %s:#%d (build tags are not specified?)", filename, offset)
 	}
 
-	f := p.pkg.Files[filename]
 	nodes, _ := astutil.PathEnclosingInterval(f, pos, pos)
 	for _, n := range nodes {
 		if decl, ok := n.(*ast.FuncDecl); ok {
@@ -182,7 +818,7 @@ func (p parsedPackage) findEnclosingIdentity(filename string, offset int64) (ide
 			return methodIdentity{
 				filename:             filename,
 				funcIdentity:         decl.Name,
-				receiverTypeIdentity: p.findIdentityFromType(receiverType),
+				receiverTypeIdentity: findIdentityFromType(receiverType),
 			}, nil
 		}
 
@@ -202,7 +838,7 @@ func (p parsedPackage) findEnclosingIdentity(filename string, offset int64) (ide
 
 // Ignores the star part which is not important for this package.
 // For example, it returns `T` when the type is `*T`.
-func (p parsedPackage) findIdentityFromType(e ast.Expr) *ast.Ident {
+func findIdentityFromType(e ast.Expr) *ast.Ident {
 	switch v := e.(type) {
 	case *ast.Ident:
 		return v
@@ -215,18 +851,90 @@ func (p parsedPackage) findIdentityFromType(e ast.Expr) *ast.Ident {
 }
 
 func (p parsedPackage) findUsers(id identity) ([]*ast.Ident, error) {
+	name := id.MatchName()
+	if name == "" {
+		return nil, nil
+	}
+
+	_, isMethod := id.(methodIdentity)
 	var users []*ast.Ident
-	ast.Inspect(p.pkg, func(n ast.Node) bool {
-		if other, ok := id.Match(n); ok {
-			users = append(users, other)
-			return false
+	for _, filename := range p.sortedFilenames() {
+		for _, n := range p.usageIndex(filename).lookup(name) {
+			if other, ok := id.Match(n); ok {
+				if !isMethod || !p.isMethodOfOtherPackage(other) {
+					users = append(users, other)
+				}
+			}
 		}
-		return true
-	})
+	}
+	return users, nil
+}
 
+// testUser is the identity which uses the other identity in the test function.
+type testUser struct {
+	ident *ast.Ident
+	// the receiver type of the test suite method. Nil if the test function is not the method.
+	receiver     *ast.Ident
+	testFunction string
+}
+
+// findTestUsers is similar to `findUsers`, but returns only the users in the test functions, with the test functions.
+// It looks up the test nodes of the index, so the test function which encloses each user is not searched.
+func (p parsedPackage) findTestUsers(id identity) ([]testUser, error) {
+	name := id.MatchName()
+	if name == "" {
+		return nil, nil
+	}
+
+	_, isMethod := id.(methodIdentity)
+	var users []testUser
+	for _, filename := range p.sortedFilenames() {
+		for _, n := range p.usageIndex(filename).lookupTests(name) {
+			if other, ok := id.Match(n.node); ok {
+				if !isMethod || !p.isMethodOfOtherPackage(other) {
+					users = append(users, testUser{other, n.receiver, n.testFunction})
+				}
+			}
+		}
+	}
 	return users, nil
 }
 
+func (p parsedPackage) sortedFilenames() []string {
+	var filenames []string
+	for filename := range p.pkg.Files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// usageIndex returns the cached index of the file, or builds it if not cached.
+func (p parsedPackage) usageIndex(filename string) *usageIndex {
+	if index, ok := p.indexes[filename]; ok {
+		return index
+	}
+	return newUsageIndex(filename, p.pkg.Files[filename])
+}
+
+// isMethodOfOtherPackage returns true if the identity is the method of the concrete type declared in the other package,
+// including the method promoted from the embedded struct of the other package. Such method never calls the changed method
+// in this package. It returns false if the type of the identity is unknown or the method is the interface method.
+func (p parsedPackage) isMethodOfOtherPackage(id *ast.Ident) bool {
+	if p.info == nil || p.typesPkg == nil {
+		return false
+	}
+	fn, ok := p.info.Uses[id].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg() == p.typesPkg {
+		return false
+	}
+	sig, ok := fn.Type().(*types.Signature)
+	if !ok || sig.Recv() == nil {
+		return false
+	}
+	return !types.IsInterface(sig.Recv().Type())
+}
+
 // findTestFunction returns the test function name which uses the specified identity.
 func (p parsedPackage) findTestFunction(id *ast.Ident) (receiver *ast.Ident, funcName string) {
 	position := p.fset.Position(id.Pos())
@@ -237,44 +945,60 @@ func (p parsedPackage) findTestFunction(id *ast.Ident) (receiver *ast.Ident, fun
 	nodes, _ := astutil.PathEnclosingInterval(p.pkg.Files[position.Filename], id.Pos(), id.Pos())
 	for _, n := range nodes {
 		if decl, ok := n.(*ast.FuncDecl); ok {
-			if decl.Recv == nil {
-				if strings.HasPrefix(decl.Name.Name, "Test") {
-					return nil, decl.Name.Name
-				}
-				continue
-			}
-
-			if !isTestSuiteFunction(decl.Name.Name) {
-				continue
-			}
-
-			receiverType := decl.Recv.List[0].Type
-			receiverIdentity := p.findIdentityFromType(receiverType)
-			if receiverIdentity == nil {
-				continue
-			}
-			return receiverIdentity, decl.Name.Name
+			return findTestFunctionOf(decl)
 		}
 	}
 	return nil, ""
 }
 
-func (p parsedPackage) findTestSuiteRunner(id *ast.Ident) string {
-	users, err := p.findUsers(defaultIdentity{id})
+// findTestFunctionOf returns the test function name if the function is the test function or the test suite method.
+// The receiver is the receiver type of the test suite method.
+func findTestFunctionOf(decl *ast.FuncDecl) (receiver *ast.Ident, funcName string) {
+	if decl.Recv == nil {
+		if strings.HasPrefix(decl.Name.Name, "Test") {
+			return nil, decl.Name.Name
+		}
+		return nil, ""
+	}
+
+	if !isTestSuiteFunction(decl.Name.Name) {
+		return nil, ""
+	}
+
+	receiverIdentity := findIdentityFromType(decl.Recv.List[0].Type)
+	if receiverIdentity == nil {
+		return nil, ""
+	}
+	return receiverIdentity, decl.Name.Name
+}
+
+// findTestSuiteRunner returns the test function which runs the test suite, and the identity used in the function.
+func (p parsedPackage) findTestSuiteRunner(id *ast.Ident) (string, *ast.Ident) {
+	users, err := p.findTestUsers(defaultIdentity{id})
 	if err != nil {
-		return ""
+		return "", nil
 	}
 
 	for _, u := range users {
-		if r, f := p.findTestFunction(u); r == nil && f != "" {
-			return f
+		if u.receiver == nil && u.testFunction != "" {
+			return u.testFunction, u.ident
 		}
 	}
-	return ""
+	return "", nil
+}
+
+// identPosition returns the position of the identity. It returns the invalid position if the identity is nil.
+func (p parsedPackage) identPosition(id *ast.Ident) token.Position {
+	if id == nil {
+		return token.Position{}
+	}
+	return p.fset.Position(id.Pos())
 }
 
 type identity interface {
 	Match(ast.Node) (*ast.Ident, bool)
+	// MatchName returns the name of the nodes `Match` may match (see `usageIndex`). Empty if `Match` never matches.
+	MatchName() string
 	Name() string
 	IsTestFunc() bool
 	ASTIdentity() *ast.Ident
@@ -293,6 +1017,10 @@ func (id defaultIdentity) Match(n ast.Node) (*ast.Ident, bool) {
 	return nil, false
 }
 
+func (id defaultIdentity) MatchName() string {
+	return id.Ident.Name
+}
+
 func (id defaultIdentity) Name() string {
 	return id.Ident.Name
 }
@@ -328,6 +1056,10 @@ func (id functionIdentity) Match(n ast.Node) (*ast.Ident, bool) {
 	return nil, false
 }
 
+func (id functionIdentity) MatchName() string {
+	return id.Ident.Name
+}
+
 func (id functionIdentity) Name() string {
 	return id.Ident.Name
 }
@@ -340,6 +1072,142 @@ func (id functionIdentity) ASTIdentity() *ast.Ident {
 	return id.Ident
 }
 
+// selectionIdentity represents the reason why the test functions are selected other than the changes,
+// like `failed last time`.
+type selectionIdentity struct {
+	reason string
+}
+
+func (id selectionIdentity) Match(n ast.Node) (*ast.Ident, bool) {
+	return nil, false
+}
+
+func (id selectionIdentity) MatchName() string {
+	return ""
+}
+
+func (id selectionIdentity) Name() string {
+	return "(" + id.reason + ")"
+}
+
+func (id selectionIdentity) IsTestFunc() bool {
+	return false
+}
+
+func (id selectionIdentity) ASTIdentity() *ast.Ident {
+	return nil
+}
+
+// fileIdentity represents the file, like the embedded file, the test data or the changed file.
+type fileIdentity struct {
+	// the slash-separated relative path from the package directory.
+	path string
+}
+
+func (id fileIdentity) Match(n ast.Node) (*ast.Ident, bool) {
+	return nil, false
+}
+
+func (id fileIdentity) MatchName() string {
+	return ""
+}
+
+func (id fileIdentity) Name() string {
+	return id.path
+}
+
+func (id fileIdentity) IsTestFunc() bool {
+	return false
+}
+
+func (id fileIdentity) ASTIdentity() *ast.Ident {
+	return nil
+}
+
+// cgoIdentity represents the C code which the package uses via cgo.
+type cgoIdentity struct{}
+
+// Match matches the cgo reference like `C.sum`. It doesn't check if the file imports "C" because
+// the package named `C` is rare.
+func (id cgoIdentity) Match(n ast.Node) (*ast.Ident, bool) {
+	if sel, ok := n.(*ast.SelectorExpr); ok {
+		if x, ok := sel.X.(*ast.Ident); ok && x.Name == "C" {
+			return x, true
+		}
+	}
+	return nil, false
+}
+
+func (id cgoIdentity) MatchName() string {
+	return "C"
+}
+
+func (id cgoIdentity) Name() string {
+	return "C"
+}
+
+func (id cgoIdentity) IsTestFunc() bool {
+	return false
+}
+
+func (id cgoIdentity) ASTIdentity() *ast.Ident {
+	return nil
+}
+
+// moduleIdentity represents the module required by go.mod.
+type moduleIdentity struct {
+	path string
+}
+
+func (id moduleIdentity) Match(n ast.Node) (*ast.Ident, bool) {
+	return nil, false
+}
+
+func (id moduleIdentity) MatchName() string {
+	return ""
+}
+
+func (id moduleIdentity) Name() string {
+	return id.path
+}
+
+func (id moduleIdentity) IsTestFunc() bool {
+	return false
+}
+
+func (id moduleIdentity) ASTIdentity() *ast.Ident {
+	return nil
+}
+
+// coverageIdentity represents the changed lines of the go file, which the coverage profile covers.
+type coverageIdentity struct {
+	filename           string
+	startLine, endLine int
+}
+
+func (id coverageIdentity) Match(n ast.Node) (*ast.Ident, bool) {
+	return nil, false
+}
+
+func (id coverageIdentity) MatchName() string {
+	return ""
+}
+
+func (id coverageIdentity) Name() string {
+	if id.startLine == id.endLine {
+		return fmt.Sprintf("%s:L%d", id.filename, id.startLine)
+	}
+	return fmt.Sprintf("%s:L%d-L%d", id.filename, id.startLine, id.endLine)
+}
+
+func (id coverageIdentity) IsTestFunc() bool {
+	return false
+}
+
+func (id coverageIdentity) ASTIdentity() *ast.Ident {
+	return nil
+}
+
 type methodIdentity struct {
 	filename             string
 	funcIdentity         *ast.Ident
@@ -354,6 +1222,10 @@ func (id methodIdentity) Match(n ast.Node) (*ast.Ident, bool) {
 	return nil, false
 }
 
+func (id methodIdentity) MatchName() string {
+	return id.funcIdentity.Name
+}
+
 func (id methodIdentity) Name() string {
 	return fmt.Sprintf("%s.%s", id.receiverTypeIdentity.Name, id.funcIdentity.Name)
 }
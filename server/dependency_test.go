@@ -1,11 +1,15 @@
 package server
 
 import (
+	"bytes"
+	"fmt"
 	"go/ast"
 	"go/build"
 	"go/token"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"testing"
 )
@@ -36,12 +40,24 @@ const (
 	FuncTestExampleBodyBegin          = 363
 	FuncSetupTestBodyBegin            = 422
 	FuncTestExampleTestSuiteBodyBegin = 467
+	// sum_amd64.s
+	AsmSumBodyBegin = 84
+	// cgo/sum.go
+	CgoPreambleBegin = 16
+	// go.mod
+	GoModGoDirectiveBegin = 26
+	GoModDepBegin         = 46
+	GoModOtherBegin       = 70
+	// go.sum
+	GoSumOtherBegin = 149
+	// imported/writer.go
+	MethodWriterWriteBodyBegin = 102
 )
 
 func TestFindInfluencedTests_Function(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum.go", FuncSumDeclBegin, FuncSumDeclBegin}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum.go", FuncSumDeclBegin, FuncSumDeclBegin}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -59,10 +75,40 @@ func TestFindInfluencedTests_Function(t *testing.T) {
 	}
 }
 
+func TestFindInfluencedTests_Chain(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "dependency")
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum.go", FuncSumDeclBegin, FuncSumDeclBegin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(influences) != 1 {
+		t.Fatalf("wrong # of influences: %d", len(influences))
+	}
+
+	for testFunction, expect := range map[string][]struct {
+		name string
+		line int
+	}{
+		"TestSum":              {{"Sum", 5}, {"TestSum", 10}},
+		"TestExampleTestSuite": {{"Sum", 5}, {"ExampleTestSuite.TestExample", 29}, {"TestExampleTestSuite", 36}},
+	} {
+		c := influences[0].to[testFunction]
+		if len(c) != len(expect) {
+			t.Fatalf("wrong chain: %#v", c)
+		}
+		for i, u := range c {
+			if u.name != expect[i].name || u.position.Line != expect[i].line {
+				t.Errorf("wrong usage: %#v", u)
+			}
+		}
+	}
+}
+
 func TestFindInfluencedTests_TestFunction(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum_test.go", FuncTestSumBodyBegin, FuncTestSumBodyBegin}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum_test.go", FuncTestSumBodyBegin, FuncTestSumBodyBegin}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,7 +126,7 @@ func TestFindInfluencedTests_TestFunction(t *testing.T) {
 func TestFindInfluencedTests_TestSuiteFunction(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum_test.go", FuncTestExampleBodyBegin, FuncTestExampleBodyBegin}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum_test.go", FuncTestExampleBodyBegin, FuncTestExampleBodyBegin}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -98,7 +144,7 @@ func TestFindInfluencedTests_TestSuiteFunction(t *testing.T) {
 func TestFindInfluencedTests_TestSuiteType(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum_test.go", TypeExampleTestSuiteDeclBegin, TypeExampleTestSuiteDeclBegin}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum_test.go", TypeExampleTestSuiteDeclBegin, TypeExampleTestSuiteDeclBegin}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -116,7 +162,7 @@ func TestFindInfluencedTests_TestSuiteType(t *testing.T) {
 func TestFindInfluencedTests_TestSuiteSetup(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum_test.go", FuncSetupTestBodyBegin, FuncSetupTestBodyBegin}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum_test.go", FuncSetupTestBodyBegin, FuncSetupTestBodyBegin}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,7 +180,7 @@ func TestFindInfluencedTests_TestSuiteSetup(t *testing.T) {
 func TestFindInfluencedTests_Interface(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum.go", MethodCalcSumBodyBegin, MethodCalcSumBodyBegin}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum.go", MethodCalcSumBodyBegin, MethodCalcSumBodyBegin}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -149,10 +195,48 @@ func TestFindInfluencedTests_Interface(t *testing.T) {
 	}
 }
 
+func TestFindInfluencedTests_MethodOfImportedType(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "imported")
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"writer.go", MethodWriterWriteBodyBegin, MethodWriterWriteBodyBegin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(influences) != 1 {
+		t.Fatalf("wrong # of influences: %d", len(influences))
+	}
+
+	var funcs []string
+	for f := range influences[0].to {
+		funcs = append(funcs, f)
+	}
+	sort.Strings(funcs)
+	// the calls of bytes.Buffer.Write, including the promoted method, are not the users.
+	if !reflect.DeepEqual([]string{"TestInterface", "TestWriter"}, funcs) {
+		t.Errorf("unexpected funcs: %v", funcs)
+	}
+}
+
+func TestFindImporterFlags(t *testing.T) {
+	for i, testCase := range []struct {
+		opts   []string
+		expect []string
+	}{
+		{[]string{"-v", "-mod=vendor"}, []string{"-mod=vendor"}},
+		{[]string{"--mod", "readonly", "-modfile=go.test.mod"}, []string{"-mod=readonly", "-modfile=go.test.mod"}},
+		{[]string{"-tags", "a", "-args", "-mod=vendor"}, nil},
+		{[]string{"-mod"}, nil},
+	} {
+		if actual := findImporterFlags(testCase.opts); !reflect.DeepEqual(testCase.expect, actual) {
+			t.Errorf("[%d] unexpected flags: %v", i, actual)
+		}
+	}
+}
+
 func TestFindInfluencedTests_XTestPackage(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum.go", FuncXSumBodyBegin, FuncXSumBodyBegin}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum.go", FuncXSumBodyBegin, FuncXSumBodyBegin}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -170,7 +254,7 @@ func TestFindInfluencedTests_XTestPackage(t *testing.T) {
 func TestFindInfluencedTests_IdentityNotFound(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum_test.go", 0, 0}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum_test.go", 0, 0}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -182,7 +266,7 @@ func TestFindInfluencedTests_IdentityNotFound(t *testing.T) {
 func TestFindInfluencedTests_NoGoFile(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "no_go_files")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"README.md", 0, 0}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"README.md", 0, 0}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -194,7 +278,7 @@ func TestFindInfluencedTests_NoGoFile(t *testing.T) {
 func TestFindInfluencedTests_MultipleChanges(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum.go", FuncSumDeclBegin, FuncSumDeclBegin}, {"sum.go", FuncT1IncBodyBegin, FuncT1IncBodyBegin}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum.go", FuncSumDeclBegin, FuncSumDeclBegin}, {"sum.go", FuncT1IncBodyBegin, FuncT1IncBodyBegin}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -211,7 +295,7 @@ func TestFindInfluencedTests_MultipleChanges(t *testing.T) {
 func TestFindInfluencedTests_ChangeWithRange(t *testing.T) {
 	cwd, _ := os.Getwd()
 	dirPath := filepath.Join(cwd, "testdata", "dependency")
-	influences, err := findInfluencedTests(&build.Default, dirPath, []Change{{"sum_test.go", 0, FuncTestExampleTestSuiteBodyBegin}})
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum_test.go", 0, FuncTestExampleTestSuiteBodyBegin}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -225,10 +309,226 @@ func TestFindInfluencedTests_ChangeWithRange(t *testing.T) {
 	}
 }
 
+func TestFindInfluencedTests_EmbeddedFile(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "embed")
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{filepath.Join("static", "hello.txt"), 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(influences) != 1 {
+		t.Fatalf("wrong # of influences: %d", len(influences))
+	}
+	if influences[0].from.Name() != "static/hello.txt" {
+		t.Errorf("wrong 'from': %s", influences[0].from.Name())
+	}
+	if len(influences[0].to) != 2 {
+		t.Fatalf("wrong # of funcs: %#v", influences[0].to)
+	}
+	for _, f := range []string{"TestHello", "TestAssets"} {
+		if _, ok := influences[0].to[f]; !ok {
+			t.Errorf("no expected func %s: %#v", f, influences[0].to)
+		}
+	}
+}
+
+func TestFindInfluencedTests_Testdata(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "embed")
+	for _, testCase := range []struct {
+		filename string
+		expect   []string
+	}{
+		{"golden.txt", []string{"TestGolden", "TestHelper"}},
+		{"other.txt", []string{"TestHelper"}},
+	} {
+		influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{filepath.Join("testdata", testCase.filename), 0, 0}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(influences) != 1 {
+			t.Fatalf("wrong # of influences: %d", len(influences))
+		}
+		if len(influences[0].to) != len(testCase.expect) {
+			t.Fatalf("wrong # of funcs: %#v", influences[0].to)
+		}
+		for _, f := range testCase.expect {
+			if _, ok := influences[0].to[f]; !ok {
+				t.Errorf("no expected func %s: %#v", f, influences[0].to)
+			}
+		}
+	}
+}
+
+func TestFindInfluencedTests_Assembly(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "asm")
+	influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{{"sum_amd64.s", AsmSumBodyBegin, AsmSumBodyBegin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(influences) != 1 {
+		t.Fatalf("wrong # of influences: %d", len(influences))
+	}
+	if influences[0].from.Name() != "Sum" {
+		t.Errorf("wrong 'from': %s", influences[0].from.Name())
+	}
+	if len(influences[0].to) != 1 {
+		t.Fatalf("wrong # of funcs: %#v", influences[0].to)
+	}
+	if _, ok := influences[0].to["TestSum"]; !ok {
+		t.Errorf("no expected func: %#v", influences[0].to)
+	}
+}
+
+func TestFindInfluencedTests_Cgo(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "cgo")
+	ctxt := build.Default
+	ctxt.CgoEnabled = true
+	for _, ch := range []Change{
+		{"sum.c", 0, 0},
+		{"sum.h", 0, 0},
+		{"sum.go", CgoPreambleBegin, CgoPreambleBegin},
+	} {
+		influences, err := findInfluencedTests(buildConfig{ctxt: &ctxt}, dirPath, []Change{ch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(influences) != 1 {
+			t.Fatalf("wrong # of influences: %d", len(influences))
+		}
+		if len(influences[0].to) != 1 {
+			t.Fatalf("wrong # of funcs: %#v", influences[0].to)
+		}
+		if _, ok := influences[0].to["TestSum"]; !ok {
+			t.Errorf("no expected func: %#v", influences[0].to)
+		}
+	}
+}
+
+func TestFindInfluencedTests_ModuleFiles(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "gomod")
+	for _, testCase := range []struct {
+		change Change
+		from   []string
+	}{
+		{Change{filepath.Join(dirPath, "go.mod"), GoModDepBegin, GoModDepBegin}, []string{"example.com/dep"}},
+		{Change{filepath.Join(dirPath, "go.mod"), GoModOtherBegin, GoModOtherBegin}, nil},
+		{Change{filepath.Join(dirPath, "go.mod"), GoModGoDirectiveBegin, GoModGoDirectiveBegin}, []string{"go.mod"}},
+		{Change{filepath.Join(dirPath, "go.sum"), 0, 0}, []string{"example.com/dep"}},
+		{Change{filepath.Join(dirPath, "go.sum"), GoSumOtherBegin, GoSumOtherBegin}, nil},
+	} {
+		influences, err := findInfluencedTests(buildConfig{ctxt: &build.Default}, dirPath, []Change{testCase.change})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(influences) != len(testCase.from) {
+			t.Fatalf("wrong # of influences: %d", len(influences))
+		}
+		for i, from := range testCase.from {
+			if influences[i].from.Name() != from {
+				t.Errorf("wrong 'from': %s", influences[i].from.Name())
+			}
+			if len(influences[i].to) != 2 {
+				t.Errorf("wrong # of funcs: %#v", influences[i].to)
+			}
+		}
+	}
+}
+
+func TestFindChangedModules(t *testing.T) {
+	goMod := []byte(`module example.com/a
+
+go 1.13
+
+require example.com/b v1.0.0 // indirect
+
+require (
+	example.com/c v1.0.0
+	example.com/d v1.0.0
+)
+
+replace example.com/c => ../c
+`)
+	for _, testCase := range []struct {
+		begin, end int64
+		modules    []string
+		affectsAll bool
+	}{
+		{0, 0, nil, true},
+		{int64(bytes.Index(goMod, []byte("require example.com/b"))), int64(bytes.Index(goMod, []byte("indirect"))), []string{"example.com/b"}, false},
+		{int64(bytes.Index(goMod, []byte("example.com/c"))), int64(bytes.Index(goMod, []byte("example.com/d"))), []string{"example.com/c", "example.com/d"}, false},
+		{int64(bytes.Index(goMod, []byte("require ("))), int64(bytes.Index(goMod, []byte("require ("))), nil, false},
+		{int64(bytes.Index(goMod, []byte("replace"))), int64(bytes.Index(goMod, []byte("replace"))), []string{"example.com/c"}, false},
+	} {
+		modules, affectsAll := findChangedModules("go.mod", goMod, testCase.begin, testCase.end)
+		if !reflect.DeepEqual(testCase.modules, modules) || testCase.affectsAll != affectsAll {
+			t.Errorf("wrong result: %#v, %v", modules, affectsAll)
+		}
+	}
+}
+
+func TestParseEmbedPatterns(t *testing.T) {
+	for _, testCase := range []struct {
+		comment string
+		expect  []string
+	}{
+		{"//go:embed a.txt", []string{"a.txt"}},
+		{"//go:embed a.txt static/*.html", []string{"a.txt", "static/*.html"}},
+		{"//go:embed \"a b.txt\" `c.txt`", []string{"a b.txt", "c.txt"}},
+		{"//go:embed all:static", []string{"static"}},
+		{"// go:embed a.txt", nil},
+	} {
+		doc := &ast.CommentGroup{List: []*ast.Comment{{Text: testCase.comment}}}
+		actual := parseEmbedPatterns(doc)
+		if !reflect.DeepEqual(testCase.expect, actual) {
+			t.Errorf("wrong patterns: %#v", actual)
+		}
+	}
+}
+
+func TestEmbedPatternMatches(t *testing.T) {
+	for _, testCase := range []struct {
+		pattern, filename string
+		expect            bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"*.txt", "a.txt", true},
+		{"static", "static/a/b.txt", true},
+		{"static/*", "static/a/b.txt", true},
+		{"static/*.html", "static/a.txt", false},
+		{"a.txt", "static/a.txt", false},
+	} {
+		if actual := embedPatternMatches(testCase.pattern, testCase.filename); actual != testCase.expect {
+			t.Errorf("wrong result: %s, %s", testCase.pattern, testCase.filename)
+		}
+	}
+}
+
+func TestIsGoSourceFile(t *testing.T) {
+	for _, testCase := range []struct {
+		filename string
+		expect   bool
+	}{
+		{"sum.go", true},
+		{"sum_test.go", true},
+		{"/path/to/sum.go", true},
+		{"README.md", false},
+		{filepath.Join("testdata", "sum.go"), false},
+		{filepath.Join("testdata", "golden.txt"), false},
+	} {
+		if actual := isGoSourceFile(testCase.filename); actual != testCase.expect {
+			t.Errorf("wrong result: %s", testCase.filename)
+		}
+	}
+}
+
 func TestNewParsedPackage(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, err := newParsedPackage(&build.Default, pkgPath)
+	pkg, err := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -256,7 +556,7 @@ func TestNewParsedPackage(t *testing.T) {
 func TestFindEnclosingIdentity_PackageDecl(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	begin, end := int64(0), int64(FuncSumDeclBegin)
 	for o := begin; o < end; o++ {
@@ -273,7 +573,7 @@ func TestFindEnclosingIdentity_PackageDecl(t *testing.T) {
 func TestFindEnclosingIdentity_SimpleFunc(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	begin, end := int64(FuncSumDeclBegin), int64(FuncSumBodyEnd)
 	for _, o := range []int64{begin - 1, end} {
@@ -296,7 +596,7 @@ func TestFindEnclosingIdentity_SimpleFunc(t *testing.T) {
 func TestFindEnclosingIdentity_InvalidOffset(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	_, err := pkg.findEnclosingIdentity("sum.go", 1024*1024)
 	if err == nil {
@@ -307,7 +607,7 @@ func TestFindEnclosingIdentity_InvalidOffset(t *testing.T) {
 func TestFindEnclosingIdentity_NestedFunc(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	id, err := pkg.findEnclosingIdentity("sum.go", FuncNestedSumNestedFuncEnd)
 	if err != nil {
@@ -321,7 +621,7 @@ func TestFindEnclosingIdentity_NestedFunc(t *testing.T) {
 func TestFindEnclosingIdentity_TopLevelVar(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	begin, end := int64(VarV1DeclBegin), int64(VarV1DeclEnd)
 	for _, o := range []int64{begin - 1, end} {
@@ -344,7 +644,7 @@ func TestFindEnclosingIdentity_TopLevelVar(t *testing.T) {
 func TestFindEnclosingIdentity_TopLevelVarList(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	begin, end := int64(VarsDeclBegin), int64(VarsDeclEnd)
 	for _, o := range []int64{begin - 1, end} {
@@ -367,7 +667,7 @@ func TestFindEnclosingIdentity_TopLevelVarList(t *testing.T) {
 func TestFindEnclosingIdentity_TopLevelConst(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	begin, end := int64(ConstC1DeclBegin), int64(ConstC1DeclEnd)
 	for _, o := range []int64{begin - 1, end} {
@@ -390,7 +690,7 @@ func TestFindEnclosingIdentity_TopLevelConst(t *testing.T) {
 func TestFindEnclosingIdentity_Type(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	begin, end := int64(TypeT1DeclBegin), int64(TypeT1DeclEnd)
 	for _, o := range []int64{begin - 1, end} {
@@ -413,7 +713,7 @@ func TestFindEnclosingIdentity_Type(t *testing.T) {
 func TestFindEnclosingIdentity_Method(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	begin, end := int64(FuncT1IncDeclBegin), int64(FuncT1IncBodyEnd)
 	for _, o := range []int64{begin - 1, end} {
@@ -436,7 +736,7 @@ func TestFindEnclosingIdentity_Method(t *testing.T) {
 func TestFindEnclosingIdentity_PointerReceiverMethod(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	begin, end := int64(FuncT1DecDeclBegin), int64(FuncT1DecBodyEnd)
 	for _, o := range []int64{begin - 1, end} {
@@ -459,7 +759,7 @@ func TestFindEnclosingIdentity_PointerReceiverMethod(t *testing.T) {
 func TestFindUsers_FuncUseFunc(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	id, _ := pkg.findEnclosingIdentity("sum.go", FuncSumDeclBegin)
 	users, err := pkg.findUsers(id)
@@ -479,7 +779,7 @@ func TestFindUsers_FuncUseFunc(t *testing.T) {
 func TestFindUsers_FuncUseVar(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	id, _ := pkg.findEnclosingIdentity("sum.go", VarV1DeclBegin)
 	users, err := pkg.findUsers(id)
@@ -499,7 +799,7 @@ func TestFindUsers_FuncUseVar(t *testing.T) {
 func TestFindUsers_FuncUseConst(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	id, _ := pkg.findEnclosingIdentity("sum.go", ConstC1DeclBegin)
 	users, err := pkg.findUsers(id)
@@ -519,7 +819,7 @@ func TestFindUsers_FuncUseConst(t *testing.T) {
 func TestFindUsers_FuncUseType(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	id, _ := pkg.findEnclosingIdentity("sum.go", TypeT1DeclBegin)
 	users, err := pkg.findUsers(id)
@@ -562,7 +862,7 @@ func sortByPosition(pkg parsedPackage, ids []*ast.Ident) {
 func TestFindUsers_FuncUseMethod(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	id, _ := pkg.findEnclosingIdentity("sum.go", FuncT1IncDeclBegin)
 	users, err := pkg.findUsers(id)
@@ -586,7 +886,7 @@ func TestFindUsers_FuncUseMethod(t *testing.T) {
 func TestFindUsers_FuncUsePointerReceiverMethod(t *testing.T) {
 	cwd, _ := os.Getwd()
 	pkgPath := filepath.Join(cwd, "testdata", "dependency")
-	pkg, _ := newParsedPackage(&build.Default, pkgPath)
+	pkg, _ := newParsedPackage(buildConfig{ctxt: &build.Default}, pkgPath)
 
 	id, _ := pkg.findEnclosingIdentity("sum.go", FuncT1DecDeclBegin)
 	users, err := pkg.findUsers(id)
@@ -606,3 +906,67 @@ func TestFindUsers_FuncUsePointerReceiverMethod(t *testing.T) {
 		}
 	}
 }
+
+// BenchmarkFindInfluencedTests_LargePackage measures the selection after the package is cached, i.e. the cost of each hint
+// when the package is not modified. The package has 100 source files and 100 test files, 10 functions and
+// 10 test functions each. `Select` excludes the cost to check if the files are modified.
+func BenchmarkFindInfluencedTests_LargePackage(b *testing.B) {
+	dir, err := ioutil.TempDir("", "noisegate-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const numFiles, numFuncs = 100, 10
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/large\n\ngo 1.13\n"), 0644); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < numFiles; i++ {
+		var src, testSrc bytes.Buffer
+		src.WriteString("package large\n\n")
+		testSrc.WriteString("package large\n\nimport \"testing\"\n\n")
+		for j := 0; j < numFuncs; j++ {
+			fmt.Fprintf(&src, "func Func%d_%d(a int) int {\n\treturn Func%d_%d(a) + 1\n}\n\n", i, j, (i+1)%numFiles, j)
+			fmt.Fprintf(&testSrc, "func TestFunc%d_%d(t *testing.T) {\n\tif Func%d_%d(1) == 0 {\n\t\tt.Error(\"zero\")\n\t}\n}\n\n", i, j, i, j)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d.go", i)), src.Bytes(), 0644); err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d_test.go", i)), testSrc.Bytes(), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// the beginning of Func0_0
+	changes := []Change{{"file0.go", 16, 16}}
+	conf := buildConfig{ctxt: &build.Default}
+	influences, err := findInfluencedTests(conf, dir, changes)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(influences) == 0 {
+		b.Fatal("no influence")
+	}
+
+	b.Run("LoadAndSelect", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := findInfluencedTests(conf, dir, changes); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Select", func(b *testing.B) {
+		pkg, err := newParsedPackage(conf, dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			pkg.found = make(map[string]struct{})
+			if _, err := pkg.findInfluences(changes[0]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
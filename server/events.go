@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common"
+	"github.com/go-noisegate/noisegate/common/log"
+)
+
+// the number of the events buffered per subscriber. The events are dropped if the subscriber is too slow.
+const eventBufferSize = 256
+
+// eventHub delivers the job events to the subscribers.
+type eventHub struct {
+	subscribers map[*eventSubscriber]struct{}
+	closed      bool
+	mtx         sync.Mutex
+}
+
+type eventSubscriber struct {
+	// the subscriber receives only the events of the packages under this directory. All the events if empty.
+	workspace string
+	ch        chan common.Event
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+// Subscribe subscribes the events of the packages under the workspace directory.
+// The channel is closed when the subscriber unsubscribes or the hub is closed.
+func (h *eventHub) Subscribe(workspace string) *eventSubscriber {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	sub := &eventSubscriber{workspace: workspace, ch: make(chan common.Event, eventBufferSize)}
+	if h.closed {
+		close(sub.ch)
+		return sub
+	}
+	h.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe unsubscribes the events.
+func (h *eventHub) Unsubscribe(sub *eventSubscriber) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// Publish sends the event to the subscribers. It doesn't block even if some subscriber is slow.
+func (h *eventHub) Publish(ev common.Event) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for sub := range h.subscribers {
+		if !inWorkspace(sub.workspace, ev.PackageDir) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			log.Debugf("drop the event: %s\n", ev.Type)
+		}
+	}
+}
+
+// Close unsubscribes all the subscribers.
+func (h *eventHub) Close() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for sub := range h.subscribers {
+		close(sub.ch)
+	}
+	h.subscribers = make(map[*eventSubscriber]struct{})
+	h.closed = true
+}
+
+func inWorkspace(workspace, dirPath string) bool {
+	if workspace == "" {
+		return true
+	}
+	rel, err := filepath.Rel(workspace, dirPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+var patternTestResult = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP): (\S+) \(([0-9.]+)s\)`)
+
+// eventWriter publishes the written test output as the events, line by line.
+// If the line is the result of the test function (e.g. `--- PASS: TestSum (0.00s)`), the test result event is also published.
+// Note that `go test` prints the results of the passed tests only when the `-v` option is specified.
+type eventWriter struct {
+	hub   *eventHub
+	jobID int64
+	dir   string
+	buf   bytes.Buffer
+	mtx   sync.Mutex
+}
+
+func newEventWriter(hub *eventHub, job *Job) *eventWriter {
+	return &eventWriter{hub: hub, jobID: job.ID, dir: job.DirPath}
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i == -1 {
+			break
+		}
+		w.publishLine(strings.TrimSuffix(string(w.buf.Next(i+1)), "\n"))
+	}
+	return len(p), nil
+}
+
+// Flush publishes the remaining output.
+func (w *eventWriter) Flush() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.publishLine(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+func (w *eventWriter) publishLine(line string) {
+	now := time.Now()
+	w.hub.Publish(common.Event{Type: common.EventTypeOutput, JobID: w.jobID, PackageDir: w.dir, Time: now, Output: line})
+
+	if match := patternTestResult.FindStringSubmatch(line); match != nil {
+		elapsed, _ := strconv.ParseFloat(match[3], 64)
+		w.hub.Publish(common.Event{Type: common.EventTypeTestResult, JobID: w.jobID, PackageDir: w.dir, Time: now,
+			TestFunction: match[2], Result: match[1], Elapsed: elapsed})
+	}
+}
+
+// the interval to send the comment to keep the connection alive.
+const eventKeepAliveInterval = 30 * time.Second
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	workspace := r.URL.Query().Get("workspace")
+	if workspace != "" {
+		if !filepath.IsAbs(workspace) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("the workspace must be abs"))
+			return
+		}
+		workspace = filepath.Clean(workspace)
+		if err := s.checkPath(workspace); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming is not supported"))
+		return
+	}
+
+	log.Printf("subscribe the events of %s\n", workspace)
+	sub := s.eventHub.Subscribe(workspace)
+	defer s.eventHub.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("failed to encode the event: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+func TestEventHub(t *testing.T) {
+	hub := newEventHub()
+	subA := hub.Subscribe("/path/to/a")
+	subAll := hub.Subscribe("")
+
+	hub.Publish(common.Event{Type: common.EventTypeJobStarted, PackageDir: "/path/to/a/pkg"})
+	hub.Publish(common.Event{Type: common.EventTypeJobStarted, PackageDir: "/path/to/ab"})
+
+	if len(subA.ch) != 1 || (<-subA.ch).PackageDir != "/path/to/a/pkg" {
+		t.Errorf("wrong events")
+	}
+	if len(subAll.ch) != 2 {
+		t.Errorf("wrong number of events: %d", len(subAll.ch))
+	}
+
+	hub.Unsubscribe(subA)
+	if _, ok := <-subA.ch; ok {
+		t.Errorf("not closed")
+	}
+	hub.Close()
+	for range subAll.ch {
+	}
+	if sub := hub.Subscribe(""); !isClosed(sub.ch) {
+		t.Errorf("not closed")
+	}
+}
+
+func isClosed(ch chan common.Event) bool {
+	select {
+	case _, ok := <-ch:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func TestEventWriter(t *testing.T) {
+	hub := newEventHub()
+	sub := hub.Subscribe("")
+	w := newEventWriter(hub, &Job{ID: 1, DirPath: "/path/to/pkg"})
+
+	fmt.Fprint(w, "=== RUN   TestSum\n--- PASS: TestSum (0.01s)\n    --- FAIL: TestSum/sub")
+	fmt.Fprint(w, "test (1.50s)\nFAIL")
+	w.Flush()
+
+	var events []common.Event
+	for len(sub.ch) > 0 {
+		events = append(events, <-sub.ch)
+	}
+	if len(events) != 6 {
+		t.Fatalf("wrong number of events: %#v", events)
+	}
+	if ev := events[2]; ev.Type != common.EventTypeTestResult || ev.TestFunction != "TestSum" || ev.Result != "PASS" || ev.Elapsed != 0.01 {
+		t.Errorf("wrong event: %#v", ev)
+	}
+	if ev := events[4]; ev.Type != common.EventTypeTestResult || ev.TestFunction != "TestSum/subtest" || ev.Result != "FAIL" || ev.Elapsed != 1.5 {
+		t.Errorf("wrong event: %#v", ev)
+	}
+	if ev := events[5]; ev.Type != common.EventTypeOutput || ev.Output != "FAIL" || ev.JobID != 1 {
+		t.Errorf("wrong event: %#v", ev)
+	}
+}
+
+func TestInWorkspace(t *testing.T) {
+	for _, testdata := range []struct {
+		workspace, dirPath string
+		expect             bool
+	}{
+		{"", "/path/to/pkg", true},
+		{"/path/to", "/path/to/pkg", true},
+		{"/path/to", "/path/to", true},
+		{"/path/to", "/path/top", false},
+		{"/path/to", "/path", false},
+		{"/path/to", "/path/to/..data", true},
+	} {
+		if actual := inWorkspace(testdata.workspace, testdata.dirPath); actual != testdata.expect {
+			t.Errorf("wrong result: %v, %v", testdata, actual)
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	server := NewServer("")
+	httpServer := httptest.NewServer(server.Handler)
+	defer httpServer.Close()
+
+	curr, _ := os.Getwd()
+	dirPath := filepath.Join(curr, "testdata", "typical")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, httpServer.URL+common.EventsPath+"?workspace="+url.QueryEscape(curr), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("wrong content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	job, err := NewJob(dirPath, influencedSelector{}, []Change{{"sum_test.go", 60, 60}}, nil, []string{"-v"}, nil, nil, &strings.Builder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.runJob(context.Background(), job, moduleChangesMark{})
+
+	var events []common.Event
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev common.Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+		if ev.Type == common.EventTypeJobFinished {
+			break
+		}
+	}
+
+	if ev := events[0]; ev.Type != common.EventTypeJobStarted || ev.JobID != job.ID || len(ev.TestFunctions) != 1 || ev.TestFunctions[0] != "TestSum" {
+		t.Errorf("wrong event: %#v", ev)
+	}
+	found := false
+	for _, ev := range events {
+		if ev.Type == common.EventTypeTestResult && ev.TestFunction == "TestSum" && ev.Result == "PASS" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no test result event: %#v", events)
+	}
+	if ev := events[len(events)-1]; ev.Type != common.EventTypeJobFinished || ev.Result != common.JobResultSuccessful {
+		t.Errorf("wrong event: %#v", ev)
+	}
+}
+
+func TestHandleEvents_Shutdown(t *testing.T) {
+	server := NewServer("")
+	httpServer := httptest.NewUnstartedServer(server.Handler)
+	httpServer.Config = server.Server
+	httpServer.Start()
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + common.EventsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("failed to shutdown: %v", err)
+	}
+}
+
+func TestHandleEvents_RelativePath(t *testing.T) {
+	server := NewServer("")
+
+	req := httptest.NewRequest("GET", common.EventsPath+"?workspace=relative", nil)
+	w := httptest.NewRecorder()
+	server.handleEvents(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+}
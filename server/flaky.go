@@ -0,0 +1,75 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+// flakeStore tracks how often each test function is flaky, per package. A test function is flaky in the job if
+// it fails but passes on retry.
+type flakeStore struct {
+	// keyed by the package directory and then the test function.
+	stats map[string]map[string]*flakeStat
+	mtx   sync.Mutex
+}
+
+type flakeStat struct {
+	runs, flakes int
+}
+
+func newFlakeStore() *flakeStore {
+	return &flakeStore{stats: make(map[string]map[string]*flakeStat)}
+}
+
+// record records the test functions the job ran and the flaky ones among them.
+func (s *flakeStore) record(job *Job) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	stats, ok := s.stats[job.DirPath]
+	if !ok {
+		stats = make(map[string]*flakeStat)
+		s.stats[job.DirPath] = stats
+	}
+	for _, t := range job.Tasks {
+		if !t.Important {
+			continue
+		}
+		if _, ok := stats[t.TestFunction]; !ok {
+			stats[t.TestFunction] = &flakeStat{}
+		}
+		stats[t.TestFunction].runs++
+	}
+	for _, testFunction := range job.flakyTests {
+		if stat, ok := stats[testFunction]; ok {
+			stat.flakes++
+		}
+	}
+}
+
+// list returns the test functions which were flaky at least once, in the packages under the workspace directory.
+func (s *flakeStore) list(workspace string) []common.FlakyTest {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var tests []common.FlakyTest
+	for dirPath, stats := range s.stats {
+		if !inWorkspace(workspace, dirPath) {
+			continue
+		}
+		for testFunction, stat := range stats {
+			if stat.flakes > 0 {
+				tests = append(tests, common.FlakyTest{PackageDir: dirPath, TestFunction: testFunction, Runs: stat.runs, Flakes: stat.flakes})
+			}
+		}
+	}
+	sort.Slice(tests, func(i, j int) bool {
+		if tests[i].PackageDir != tests[j].PackageDir {
+			return tests[i].PackageDir < tests[j].PackageDir
+		}
+		return tests[i].TestFunction < tests[j].TestFunction
+	})
+	return tests
+}
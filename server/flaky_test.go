@@ -0,0 +1,33 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+func TestFlakeStore(t *testing.T) {
+	store := newFlakeStore()
+	newJob := func(dirPath string, flaky ...string) *Job {
+		job := &Job{DirPath: dirPath, flakyTests: flaky}
+		job.Tasks = []*Task{{TestFunction: "TestA", Important: true}, {TestFunction: "TestB", Important: true}, {TestFunction: "TestC"}}
+		return job
+	}
+
+	store.record(newJob("/path/to/a", "TestB"))
+	store.record(newJob("/path/to/a"))
+	store.record(newJob("/path/to/b", "TestA"))
+	store.record(newJob("/path/to/other", "TestA"))
+
+	expected := []common.FlakyTest{
+		{PackageDir: "/path/to/a", TestFunction: "TestB", Runs: 2, Flakes: 1},
+		{PackageDir: "/path/to/b", TestFunction: "TestA", Runs: 1, Flakes: 1},
+	}
+	if tests := store.list("/path/to/a"); len(tests) != 1 || !reflect.DeepEqual(expected[0], tests[0]) {
+		t.Errorf("unexpected tests: %#v", tests)
+	}
+	if tests := store.list("/path/to/b"); !reflect.DeepEqual(expected[1:], tests) {
+		t.Errorf("unexpected tests: %#v", tests)
+	}
+}
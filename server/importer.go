@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common/log"
+)
+
+// exportImporter imports the packages from the export data which `go list -export` generates.
+// If the export data is not available (e.g. the dependency has the compile error or the export data is not listed
+// yet), the package is imported from the source code instead, but the build tags are not respected in that case.
+type exportImporter struct {
+	gc      types.Importer
+	source  types.ImporterFrom
+	dirPath string
+	// the paths of the export data, keyed by the import path. Nil if not available.
+	exports map[string]string
+	// true if the importer is created after the export data is listed (or failed to be listed).
+	complete bool
+}
+
+// newExportImporter returns the importer which uses the export data listed so far. The importer doesn't wait for
+// the export data, so the caller creates the importer again once `list` is done.
+func newExportImporter(fset *token.FileSet, dirPath string, list *exportList) *exportImporter {
+	imp := &exportImporter{dirPath: dirPath}
+	if list != nil && list.ready() {
+		imp.exports, imp.complete = list.exports, true
+	}
+	imp.gc = importer.ForCompiler(fset, "gc", imp.lookup)
+	imp.source = importer.ForCompiler(fset, "source", nil).(types.ImporterFrom)
+	return imp
+}
+
+// Import imports the package.
+func (imp *exportImporter) Import(path string) (*types.Package, error) {
+	return imp.ImportFrom(path, imp.dirPath, 0)
+}
+
+// ImportFrom imports the package. `dir` is the directory of the file which imports the package.
+func (imp *exportImporter) ImportFrom(path, dir string, mode types.ImportMode) (*types.Package, error) {
+	pkg, err := imp.gc.Import(path)
+	if err == nil {
+		return pkg, nil
+	}
+	log.Debugf("import %s from the source: %v\n", path, err)
+	return imp.source.ImportFrom(path, dir, mode)
+}
+
+func (imp *exportImporter) lookup(importPath string) (io.ReadCloser, error) {
+	exportPath, ok := imp.exports[importPath]
+	if !ok {
+		return nil, fmt.Errorf("the export data of %s is not found", importPath)
+	}
+	return os.Open(exportPath)
+}
+
+// the max time to list the export data. The dependencies are compiled, so it may take a while.
+const listExportsTimeout = 3 * time.Minute
+
+// exportList is the export data of the dependencies listed in the background.
+type exportList struct {
+	done    chan struct{}
+	exports map[string]string
+}
+
+// startListExports starts listing the export data of the dependencies of the package in the background.
+// It's called when the package is first seen, so that the later jobs can use the export data without waiting.
+func startListExports(dirPath string, conf buildConfig) *exportList {
+	list := &exportList{done: make(chan struct{})}
+	go func() {
+		defer close(list.done)
+		ctx, cancel := context.WithTimeout(context.Background(), listExportsTimeout)
+		defer cancel()
+
+		start := time.Now()
+		exports, err := listExports(ctx, dirPath, conf)
+		if err != nil {
+			log.Printf("failed to list the export data of %s: %v\n", dirPath, err)
+			return
+		}
+		log.Debugf("list the export data of %s: %v\n", dirPath, time.Since(start))
+		list.exports = exports
+	}()
+	return list
+}
+
+// ready returns true if the listing is done, successfully or not.
+func (l *exportList) ready() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// the go build flags which change how the dependencies are resolved.
+var importerFlagNames = []string{"mod", "modfile"}
+
+// findImporterFlags returns the go build flags in the go test options which change how the dependencies are resolved,
+// in the `-name=value` form. The build tags are not included. The options after `-args` are not checked.
+func findImporterFlags(goTestOpts []string) []string {
+	var flags []string
+	for _, flagName := range importerFlagNames {
+		for _, value := range findFlagValues(goTestOpts, flagName) {
+			flags = append(flags, fmt.Sprintf("-%s=%s", flagName, value))
+		}
+	}
+	return flags
+}
+
+// listExports returns the paths of the export data of the dependencies of the package and its tests.
+// The dependencies are compiled if necessary, so it may take a while at the first time.
+func listExports(ctx context.Context, dirPath string, conf buildConfig) (map[string]string, error) {
+	args := []string{"list", "-e", "-export", "-deps", "-test", "-f", "{{if .Export}}{{.ImportPath}}\t{{.Export}}{{end}}"}
+	args = append(args, conf.goFlags()...)
+	args = append(args, ".")
+
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = dirPath
+	cmd.Env = conf.environ()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, stderr.String())
+	}
+
+	exports := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, "\t")
+		if i == -1 {
+			continue
+		}
+		importPath, exportPath := line[:i], line[i+1:]
+		if strings.HasSuffix(importPath, "]") {
+			// the package recompiled for the test, like `pkg [pkg.test]`.
+			continue
+		}
+		exports[importPath] = exportPath
+	}
+	return exports, nil
+}
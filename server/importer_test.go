@@ -0,0 +1,48 @@
+package server
+
+import (
+	"go/build"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImporter(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "imported")
+	list := startListExports(dirPath, buildConfig{ctxt: &build.Default})
+	<-list.done
+	imp := newExportImporter(token.NewFileSet(), dirPath, list)
+	if !imp.complete {
+		t.Errorf("not complete")
+	}
+	pkg, err := imp.Import("bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Scope().Lookup("Buffer") == nil {
+		t.Errorf("bytes.Buffer is not found")
+	}
+	if _, ok := imp.exports["bytes"]; !ok {
+		t.Errorf("the export data is not used: %v", imp.exports)
+	}
+}
+
+func TestExportImporter_FallbackToSource(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "imported")
+	list := &exportList{done: make(chan struct{})} // not listed yet
+	imp := newExportImporter(token.NewFileSet(), dirPath, list)
+	if imp.complete {
+		t.Errorf("complete before the export data is listed")
+	}
+
+	pkg, err := imp.ImportFrom("strings", dirPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Scope().Lookup("Builder") == nil {
+		t.Errorf("strings.Builder is not found")
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"go/ast"
+	"strings"
+)
+
+// usageIndex indexes the nodes of the file which may use the identities, keyed by the name. With the index,
+// the users of the identity are found without traversing the entire package. See `identity.MatchName`.
+// The index is built when the file is parsed and cached with the file, so it's updated only when the file is modified.
+type usageIndex struct {
+	// the nodes in the order of appearance.
+	nodes map[string][]ast.Node
+	// the nodes in the test functions, keyed by the name like `nodes`. Only the test file has them.
+	// It's the reverse index from the declarations to the test functions which reference them, so the affected
+	// test functions are found without looking for the function which encloses each user.
+	testNodes map[string][]testNode
+}
+
+// testNode is the node in the test function or the test suite method.
+type testNode struct {
+	node ast.Node
+	// the receiver type of the test suite method (e.g. `Suite` of `func (s *Suite) TestSum()`). Nil if the node is in the test function.
+	receiver     *ast.Ident
+	testFunction string
+}
+
+// newUsageIndex builds the index of the file. The following nodes are indexed:
+// * the identifier, by its name.
+// * the call expression whose function is the identifier (e.g. `Sum(1, 2)`), by the function name.
+// * the selector expression (e.g. `pkg.Sum`), by the selector name and the name of the left-hand side identifier.
+// If the file is the test file, the nodes in the test functions are indexed with the test functions too.
+func newUsageIndex(filename string, f *ast.File) *usageIndex {
+	index := &usageIndex{nodes: make(map[string][]ast.Node), testNodes: make(map[string][]testNode)}
+	indexNodes(f, func(name string, n ast.Node) {
+		index.nodes[name] = append(index.nodes[name], n)
+	})
+	if !strings.HasSuffix(filename, "_test.go") {
+		return index
+	}
+
+	for _, decl := range f.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		receiver, testFunction := findTestFunctionOf(funcDecl)
+		if testFunction == "" {
+			continue
+		}
+		indexNodes(funcDecl, func(name string, n ast.Node) {
+			index.testNodes[name] = append(index.testNodes[name], testNode{n, receiver, testFunction})
+		})
+	}
+	return index
+}
+
+func indexNodes(root ast.Node, add func(name string, n ast.Node)) {
+	ast.Inspect(root, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Ident:
+			add(n.Name, n)
+		case *ast.CallExpr:
+			if fun, ok := n.Fun.(*ast.Ident); ok {
+				add(fun.Name, n)
+			}
+		case *ast.SelectorExpr:
+			add(n.Sel.Name, n)
+			if x, ok := n.X.(*ast.Ident); ok && x.Name != n.Sel.Name {
+				add(x.Name, n)
+			}
+		}
+		return true
+	})
+}
+
+// lookup returns the nodes indexed by the name.
+func (index *usageIndex) lookup(name string) []ast.Node {
+	return index.nodes[name]
+}
+
+// lookupTests returns the nodes in the test functions indexed by the name.
+func (index *usageIndex) lookupTests(name string) []testNode {
+	return index.testNodes[name]
+}
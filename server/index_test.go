@@ -0,0 +1,109 @@
+package server
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+)
+
+func TestUsageIndex_Lookup(t *testing.T) {
+	src := `package sum
+
+import "C"
+
+func Sum(a, b int) int {
+	return a + b
+}
+
+func Sum3(a, b, c int) int {
+	return Sum(Sum(a, b), c) + int(C.sum(1, 2))
+}
+
+func (s Summer) Sum() int {
+	return s.inner.Sum()
+}
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "sum.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := newUsageIndex("sum.go", f)
+
+	var idents, calls, selectors int
+	for _, n := range index.lookup("Sum") {
+		switch n.(type) {
+		case *ast.Ident:
+			idents++
+		case *ast.CallExpr:
+			calls++
+		case *ast.SelectorExpr:
+			selectors++
+		}
+	}
+	if idents != 5 || calls != 2 || selectors != 1 {
+		t.Errorf("wrong number of nodes: %d, %d, %d", idents, calls, selectors)
+	}
+
+	nodes := index.lookup("C")
+	found := false
+	for _, n := range nodes {
+		if _, ok := (cgoIdentity{}).Match(n); ok {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("the cgo reference is not indexed: %v", nodes)
+	}
+
+	if nodes := index.lookup("NotExist"); len(nodes) != 0 {
+		t.Errorf("unexpected nodes: %v", nodes)
+	}
+}
+
+func TestUsageIndex_LookupTests(t *testing.T) {
+	src := `package sum
+
+func helper() int {
+	return Sum(1, 2)
+}
+
+func TestSum(t *testing.T) {
+	Sum(1, 2)
+}
+
+func (s *SumSuite) TestSum3() {
+	Sum(Sum(1, 2), 3)
+}
+
+func (s *SumSuite) helper() {
+	Sum(1, 2)
+}
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "sum_test.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := newUsageIndex("sum_test.go", f)
+
+	testFunctions := make(map[string]int)
+	for _, n := range index.lookupTests("Sum") {
+		name := n.testFunction
+		if n.receiver != nil {
+			name = n.receiver.Name + "." + name
+		}
+		testFunctions[name]++
+	}
+	expected := map[string]int{"TestSum": 2, "SumSuite.TestSum3": 4}
+	if !reflect.DeepEqual(expected, testFunctions) {
+		t.Errorf("wrong test functions: %v", testFunctions)
+	}
+
+	index = newUsageIndex("sum.go", f)
+	if nodes := index.lookupTests("Sum"); len(nodes) != 0 {
+		t.Errorf("the non-test file has the test nodes: %v", nodes)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common"
+	"github.com/go-noisegate/noisegate/common/log"
+)
+
+// the input data each API accepts.
+var apiRequests = map[string]interface{}{
+	common.TestPath:     common.TestRequest{},
+	common.HintPath:     common.HintRequest{},
+	common.ExplainPath:  common.TestRequest{},
+	common.AffectedPath: common.AffectedRequest{},
+	common.FailedPath:   common.FailedRequest{},
+	common.FlakyPath:    common.FlakyRequest{},
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	fields := make(map[string][]string)
+	for path, req := range apiRequests {
+		fields[path] = common.JSONFields(req)
+	}
+
+	resp := common.InfoResponse{
+		Version:       common.Version,
+		RequestFields: fields,
+		GoVersion:     goVersion(),
+		Uptime:        time.Since(s.startedAt).Seconds(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Debugf("failed to write the response: %v\n", err)
+	}
+}
+
+var (
+	goVersionOnce  sync.Once
+	goVersionValue string
+)
+
+// goVersion returns the version of the go command in the PATH, like `go1.14.2`. Empty if the go command is not available.
+func goVersion() string {
+	goVersionOnce.Do(func() {
+		// e.g. `go version go1.14.2 linux/amd64`
+		out, err := exec.Command("go", "version").Output()
+		if err != nil {
+			log.Debugf("failed to get the go version: %v\n", err)
+			return
+		}
+		if fields := strings.Fields(string(out)); len(fields) >= 3 {
+			goVersionValue = fields[2]
+		}
+	})
+	return goVersionValue
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+func TestHandleInfo(t *testing.T) {
+	server := NewServer("")
+
+	req := httptest.NewRequest("GET", common.InfoPath, nil)
+	w := httptest.NewRecorder()
+	server.handleInfo(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected code: %d", w.Code)
+	}
+
+	var resp common.InfoResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Version != common.Version {
+		t.Errorf("wrong version: %s", resp.Version)
+	}
+	if !strings.HasPrefix(resp.GoVersion, "go") {
+		t.Errorf("wrong go version: %s", resp.GoVersion)
+	}
+	if resp.Uptime < 0 {
+		t.Errorf("wrong uptime: %f", resp.Uptime)
+	}
+	expect := []string{"path", "ranges", "column_unit", "overlay"}
+	if !reflect.DeepEqual(expect, resp.RequestFields[common.HintPath]) {
+		t.Errorf("wrong fields: %#v", resp.RequestFields[common.HintPath])
+	}
+	if _, ok := resp.RequestFields[common.TestPath]; !ok {
+		t.Errorf("no test API fields: %#v", resp.RequestFields)
+	}
+}
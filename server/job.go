@@ -5,13 +5,15 @@ import (
 	"fmt"
 	"go/build"
 	"io"
-	"io/ioutil"
+	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/go-noisegate/noisegate/common"
 	"github.com/go-noisegate/noisegate/common/log"
 )
 
@@ -24,8 +26,25 @@ type Job struct {
 	CreatedAt, StartedAt, FinishedAt time.Time
 	TaskSets                         []*TaskSet
 	Tasks                            []*Task
-	influences                       []influence
+	influences                       []Influence
 	writer                           io.Writer
+	// the contents of the unsaved files, keyed by the abs path.
+	overlay map[string][]byte
+	// the path of the overlay file passed to `go test -overlay`. Empty if the job is not running or there is no overlay.
+	overlayPath string
+	// the environment variables of the go command, in the `key=value` form.
+	env []string
+	// the max number of times each failed test function is retried in isolation. 0 means no retry.
+	Retries int
+	// the test functions which failed, except the flaky ones. Available after the job runs.
+	failedTests []string
+	// the test functions which failed but passed on retry. Available after the job runs.
+	flakyTests []string
+	// the test functions which passed, including the flaky ones. Available after the job runs.
+	passedTests []string
+	// the selected test functions which have no result, e.g. the other test function panicked before they ran.
+	// They fail the job like the failed ones, but are not retried. Available after the job runs.
+	unfinishedTests []string
 }
 
 // JobStatus represents the status of the job.
@@ -37,8 +56,11 @@ const (
 	JobStatusFailed
 )
 
-// NewJob returns the new job.
-func NewJob(dirPath string, bypass bool, changes []Change, goTestOpts []string, w io.Writer) (*Job, error) {
+// NewJob returns the new job. The tests to run are selected by the selector.
+// `env` is the environment variables which override the environment of the server. It may be nil.
+// `overlay` is the contents of the unsaved files, which are used instead of the files on the disk. It may be nil.
+// `failedTests` is the test functions which failed before and haven't passed since, for the `failed` selector. It may be nil.
+func NewJob(dirPath string, selector Selector, changes []Change, failedTests []string, goTestOpts []string, env map[string]string, overlay map[string][]byte, w io.Writer) (*Job, error) {
 	job := &Job{
 		ID:            generateID(),
 		DirPath:       dirPath,
@@ -46,51 +68,62 @@ func NewJob(dirPath string, bypass bool, changes []Change, goTestOpts []string,
 		GoTestOptions: goTestOpts,
 		CreatedAt:     time.Now(),
 		writer:        w,
+		overlay:       overlay,
+		env:           mergeEnv(os.Environ(), env),
 	}
 
-	testFuncNames, err := retrieveTestFuncNames(dirPath)
+	ctxt := newOverlayContext(newBuildContext(goTestOpts, job.env), overlay)
+	conf := buildConfig{ctxt: ctxt, flags: findImporterFlags(goTestOpts), env: job.env, overlay: overlay}
+	testFuncNames, err := retrieveTestFuncNames(conf, dirPath)
 	if err != nil {
 		return nil, err
 	}
 
-	if bypass {
-		selectAllTasks(job, testFuncNames)
-		w.Write([]byte("Run all tests:\n"))
-		return job, nil
-	}
-
-	if len(changes) == 0 {
-		selectNoTasks(job, testFuncNames)
-		w.Write([]byte("Changed: []\n"))
-		return job, nil
-	}
-
 	start := time.Now()
-	defer func() {
-		log.Debugf("dependency analysis time: %v\n", time.Since(start))
-	}()
-
-	ctxt := &build.Default
-	ctxt.BuildTags = strings.Split(findOptionValue(goTestOpts, "tags"), ",")
-	job.influences, err = findInfluencedTests(ctxt, job.DirPath, changes)
+	job.influences, err = selector.Select(SelectorInput{DirPath: job.DirPath, Changes: changes, TestFunctions: testFuncNames, FailedTests: failedTests, conf: conf})
 	if err != nil {
 		return nil, err
 	}
+	log.Debugf("selection time: %v\n", time.Since(start))
 
 	if log.DebugLogEnabled() {
 		for _, inf := range job.influences {
-			var fs []string
-			for f := range inf.to {
-				fs = append(fs, f)
-			}
-			log.Debugf("%v -> [%v]\n", inf.from.Name(), strings.Join(fs, ", "))
+			log.Debugf("%v -> [%v]\n", inf.From(), strings.Join(inf.TestFunctions(), ", "))
 		}
 	}
 
 	selectInfluencedTasks(job, testFuncNames)
 
-	w.Write([]byte(fmt.Sprintf("Changed: [%s]\n", strings.Join(job.changedIdentityNames(), ", "))))
-	return job, err
+	if containsSelector(selector, isAllSelector) {
+		w.Write([]byte("Run all tests:\n"))
+	} else {
+		w.Write([]byte(fmt.Sprintf("Changed: [%s]\n", strings.Join(job.changedIdentityNames(), ", "))))
+	}
+	return job, nil
+}
+
+// mergeEnv returns the environment variables in which the variables in `env` override the ones in `base`.
+func mergeEnv(base []string, env map[string]string) []string {
+	merged := make([]string, 0, len(base)+len(env))
+	for _, kv := range base {
+		key := kv
+		if i := strings.Index(kv, "="); i != -1 {
+			key = kv[:i]
+		}
+		if _, ok := env[key]; !ok {
+			merged = append(merged, kv)
+		}
+	}
+
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		merged = append(merged, key+"="+env[key])
+	}
+	return merged
 }
 
 var jobIDCounter int64
@@ -102,62 +135,57 @@ func generateID() int64 {
 
 var patternTestFuncName = regexp.MustCompile(`(?m)^ *func *(Test[^(]+)`)
 
-func retrieveTestFuncNames(dirPath string) ([]string, error) {
-	fis, err := ioutil.ReadDir(dirPath)
+// retrieveTestFuncNames returns the names of the test functions in the test files `go test` compiles.
+func retrieveTestFuncNames(conf buildConfig, dirPath string) ([]string, error) {
+	testFileNames, err := findTestFileNames(conf, dirPath)
 	if err != nil {
 		return nil, err
 	}
 
-	var testFileNames []string
-	for _, fi := range fis {
-		if !fi.Mode().IsRegular() {
-			continue
-		}
-
-		if !strings.HasSuffix(fi.Name(), "_test.go") {
-			continue
-		}
-
-		testFileNames = append(testFileNames, fi.Name())
-	}
-
 	var testFuncNames []string
 	for _, filename := range testFileNames {
 		path := filepath.Join(dirPath, filename)
-		content, err := ioutil.ReadFile(path)
+		names, err := findTestFuncNamesInFile(conf, path)
 		if err != nil {
 			log.Printf("failed to read %s: %v\n", path, err)
 			continue
 		}
-
-		matches := patternTestFuncName.FindAllStringSubmatch(string(content), -1)
-		for _, match := range matches {
-			if match[1] == "TestMain" {
-				continue
-			}
-			testFuncNames = append(testFuncNames, match[1])
-		}
+		testFuncNames = append(testFuncNames, names...)
 	}
 	return testFuncNames, nil
 }
 
-func selectNoTasks(job *Job, testFuncNames []string) {
-	for _, testFuncName := range testFuncNames {
-		job.Tasks = append(job.Tasks, &Task{TestFunction: testFuncName})
+// findTestFuncNamesInFile returns the names of the test functions in the test file.
+func findTestFuncNamesInFile(conf buildConfig, path string) ([]string, error) {
+	content, err := readFile(conf.ctxt, path)
+	if err != nil {
+		return nil, err
 	}
-	job.TaskSets = []*TaskSet{NewTaskSet(0, job)}
+
+	var testFuncNames []string
+	matches := patternTestFuncName.FindAllStringSubmatch(string(content), -1)
+	for _, match := range matches {
+		if match[1] == "TestMain" {
+			continue
+		}
+		testFuncNames = append(testFuncNames, match[1])
+	}
+	return testFuncNames, nil
 }
 
-func selectAllTasks(job *Job, testFuncNames []string) {
-	ts := NewTaskSet(0, job)
-	for _, testFuncName := range testFuncNames {
-		t := &Task{TestFunction: testFuncName, Important: true}
-		job.Tasks = append(job.Tasks, t)
-		ts.Tasks = append(ts.Tasks, t)
+// findTestFileNames returns the base names of the test files `go test` compiles.
+func findTestFileNames(conf buildConfig, dirPath string) ([]string, error) {
+	metadata, err := loadPackageMetadata(conf, dirPath)
+	if err != nil {
+		if _, ok := err.(*build.NoGoError); ok {
+			return nil, nil
+		}
+		return nil, err
 	}
-	job.TaskSets = []*TaskSet{ts}
+	return metadata.TestGoFiles, nil
 }
 
+// selectInfluencedTasks creates the tasks of all the test functions and runs the influenced ones.
 func selectInfluencedTasks(job *Job, testFuncNames []string) {
 	influenced := make(map[string]struct{})
 	for _, inf := range job.influences {
@@ -179,12 +207,33 @@ func selectInfluencedTasks(job *Job, testFuncNames []string) {
 	job.TaskSets = []*TaskSet{ts}
 }
 
-func findOptionValue(opts []string, keyWithoutHyphen string) string {
-	i := findOptionValueIndex(opts, keyWithoutHyphen)
-	if i == -1 {
-		return ""
+// findFlagValues returns the values of the flag in the options, in the order of appearance.
+// The value is specified in any of the `-name value`, `-name=value`, `--name value` and `--name=value` forms.
+// The options after `-args` are not checked.
+func findFlagValues(opts []string, nameWithoutHyphen string) []string {
+	var values []string
+	for i := 0; i < len(opts); i++ {
+		opt := opts[i]
+		if opt == "-args" || opt == "--args" {
+			break
+		}
+		if !strings.HasPrefix(opt, "-") {
+			continue
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(opt, "-"), "-")
+		if j := strings.Index(name, "="); j != -1 {
+			if name[:j] == nameWithoutHyphen {
+				values = append(values, name[j+1:])
+			}
+			continue
+		}
+		if name == nameWithoutHyphen && i+1 < len(opts) {
+			i++
+			values = append(values, opts[i])
+		}
 	}
-	return opts[i]
+	return values
 }
 
 func findOptionValueIndex(opts []string, keyWithoutHyphen string) int {
@@ -202,15 +251,50 @@ func findOptionValueIndex(opts []string, keyWithoutHyphen string) int {
 func (j *Job) Run(ctx context.Context) {
 	j.StartedAt = time.Now()
 
+	if len(j.overlay) > 0 {
+		overlayPath, tempDir, err := writeOverlayFile(j.overlay)
+		if err != nil {
+			log.Printf("failed to write the overlay file: %v", err)
+		} else {
+			j.overlayPath = overlayPath
+			defer func() {
+				os.RemoveAll(tempDir)
+				j.overlayPath = ""
+			}()
+		}
+	}
+
 	successful := true
 	for _, taskSet := range j.TaskSets {
 		if err := taskSet.Start(ctx); err != nil {
 			log.Printf("failed to start the worker: %v", err)
 		}
 		taskSet.Wait()
-
-		if taskSet.Status == TaskSetStatusFailed {
-			successful = false
+		successful = successful && taskSet.Status == TaskSetStatusSuccessful
+
+		results := taskSet.worker.TestResults()
+		for _, t := range taskSet.Tasks {
+			switch results[t.TestFunction] {
+			case "PASS":
+				j.passedTests = append(j.passedTests, t.TestFunction)
+			case "SKIP":
+			case "FAIL":
+				j.failedTests = append(j.failedTests, t.TestFunction)
+			default:
+				j.unfinishedTests = append(j.unfinishedTests, t.TestFunction)
+			}
+		}
+	}
+	successful = successful && len(j.unfinishedTests) == 0
+
+	// the job is retriable only if all the selected test functions finished and some of them failed.
+	// Otherwise (e.g. the build error or the panic), retrying the failed ones doesn't tell the job passes.
+	retriable := len(j.unfinishedTests) == 0 && len(j.failedTests) > 0
+	if !successful && retriable && j.Retries > 0 {
+		j.failedTests = j.retryFailedTests(ctx, j.failedTests)
+		successful = len(j.failedTests) == 0
+		if len(j.flakyTests) > 0 {
+			fmt.Fprintf(j.writer, "Flaky: [%s]\n", strings.Join(j.flakyTests, ", "))
 		}
 	}
 
@@ -222,13 +306,90 @@ func (j *Job) Run(ctx context.Context) {
 	j.FinishedAt = time.Now()
 }
 
+// retryFailedTests runs each failed test function again in isolation, up to `Retries` times until it passes.
+// The test functions which pass on retry are flaky. It returns the test functions which never pass.
+func (j *Job) retryFailedTests(ctx context.Context, failed []string) []string {
+	var stillFailed []string
+	for _, testFunction := range failed {
+		passed := false
+		for i := 1; i <= j.Retries && !passed && ctx.Err() == nil; i++ {
+			fmt.Fprintf(j.writer, "Retry %s (%d/%d)\n", testFunction, i, j.Retries)
+			w := newRetryWorker(j, testFunction)
+			if err := w.Start(ctx); err != nil {
+				log.Printf("failed to start the worker: %v", err)
+				break
+			}
+			passed, _ = w.Wait()
+		}
+
+		if passed {
+			j.flakyTests = append(j.flakyTests, testFunction)
+			j.passedTests = append(j.passedTests, testFunction)
+		} else {
+			stillFailed = append(stillFailed, testFunction)
+		}
+	}
+	return stillFailed
+}
+
+// DryRun writes the selected and unselected tasks and the command lines to execute, without running the tests.
+// If there is the overlay, the overlay file is written and the command lines use it like the real run.
+func (j *Job) DryRun() {
+	var selected, unselected []string
+	for _, t := range j.Tasks {
+		if t.Important {
+			selected = append(selected, t.TestFunction)
+		} else {
+			unselected = append(unselected, t.TestFunction)
+		}
+	}
+	fmt.Fprintf(j.writer, "Selected: [%s]\n", strings.Join(selected, ", "))
+	fmt.Fprintf(j.writer, "Not selected: [%s]\n", strings.Join(unselected, ", "))
+	if len(j.overlay) > 0 {
+		var paths []string
+		for path := range j.overlay {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		fmt.Fprintf(j.writer, "Overlay: [%s]\n", strings.Join(paths, ", "))
+
+		// the overlay file is not removed so that the printed command can be executed as is.
+		overlayPath, _, err := writeOverlayFile(j.overlay)
+		if err != nil {
+			log.Printf("failed to write the overlay file: %v", err)
+		} else {
+			j.overlayPath = overlayPath
+			defer func() { j.overlayPath = "" }()
+		}
+	}
+
+	for _, taskSet := range j.TaskSets {
+		fmt.Fprintf(j.writer, "Command: %s\n", newWorker(j, taskSet).CommandLine())
+	}
+}
+
 func (j *Job) changedIdentityNames() (result []string) {
 	for _, inf := range j.influences {
-		result = append(result, inf.from.Name())
+		result = append(result, inf.From())
 	}
 	return result
 }
 
+// Explain explains why each test function is selected or not.
+func (j *Job) Explain() common.ExplainResponse {
+	resp := common.ExplainResponse{Changed: j.changedIdentityNames()}
+	for _, t := range j.Tasks {
+		e := common.Explanation{TestFunction: t.TestFunction, Selected: t.Important}
+		for _, inf := range j.influences {
+			if c, ok := inf.to[t.TestFunction]; ok {
+				e.Chains = append(e.Chains, c.elements(j.DirPath))
+			}
+		}
+		resp.Explain = append(resp.Explain, e)
+	}
+	return resp
+}
+
 // TaskSet represents the set of tasks handled by one worker.
 type TaskSet struct {
 	// this id must be the valid index of the Job.TaskSets.
@@ -3,12 +3,15 @@ package server
 import (
 	"context"
 	"go/ast"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 
+	"github.com/go-noisegate/noisegate/common"
 	"github.com/go-noisegate/noisegate/common/log"
 )
 
@@ -22,7 +25,7 @@ func TestNewJob(t *testing.T) {
 	currDir, _ := os.Getwd()
 	dirPath := filepath.Join(currDir, "testdata", "typical")
 
-	job, err := NewJob(dirPath, false, []Change{{filepath.Join(dirPath, "sum.go"), 0, 0}}, nil, &strings.Builder{})
+	job, err := NewJob(dirPath, influencedSelector{}, []Change{{filepath.Join(dirPath, "sum.go"), 0, 0}}, nil, nil, nil, nil, &strings.Builder{})
 	if err != nil {
 		t.Fatalf("failed to create new job: %v", err)
 	}
@@ -52,7 +55,7 @@ func TestNewJob_WithBypass(t *testing.T) {
 	currDir, _ := os.Getwd()
 	dirPath := filepath.Join(currDir, "testdata", "typical")
 
-	job, err := NewJob(dirPath, true, []Change{}, nil, &strings.Builder{})
+	job, err := NewJob(dirPath, allSelector{}, []Change{}, nil, nil, nil, nil, &strings.Builder{})
 	if err != nil {
 		t.Fatalf("failed to create new job: %v", err)
 	}
@@ -74,7 +77,7 @@ func TestNewJob_WithBypass(t *testing.T) {
 
 func TestNewJob_InvalidDirPath(t *testing.T) {
 	dirPath := "/not/exist/dir"
-	_, err := NewJob(dirPath, false, []Change{{filepath.Join(dirPath, "sum.go"), 0, 0}}, nil, &strings.Builder{})
+	_, err := NewJob(dirPath, influencedSelector{}, []Change{{filepath.Join(dirPath, "sum.go"), 0, 0}}, nil, nil, nil, nil, &strings.Builder{})
 	if err == nil {
 		t.Fatalf("err should not be nil: %v", err)
 	}
@@ -90,7 +93,7 @@ func TestNewJob_UniqueIDCheck(t *testing.T) {
 	for i := 0; i < numGoRoutines; i++ {
 		go func() {
 			for j := 0; j < numIter; j++ {
-				job, err := NewJob(dirPath, false, []Change{{filepath.Join(dirPath, "README.md"), 0, 0}}, nil, &strings.Builder{})
+				job, err := NewJob(dirPath, influencedSelector{}, []Change{{filepath.Join(dirPath, "README.md"), 0, 0}}, nil, nil, nil, nil, &strings.Builder{})
 				if err != nil {
 					panic(err)
 				}
@@ -116,7 +119,7 @@ func TestNewJob_WithBuildTags(t *testing.T) {
 	}
 	dirPath := filepath.Join(currDir, "testdata", "buildtags")
 
-	job, err := NewJob(dirPath, false, []Change{{filepath.Join(dirPath, "sum.go"), 63, 63}}, []string{"-tags", "example"}, &strings.Builder{})
+	job, err := NewJob(dirPath, influencedSelector{}, []Change{{filepath.Join(dirPath, "sum.go"), 63, 63}}, nil, []string{"-tags", "example"}, nil, nil, &strings.Builder{})
 	if err != nil {
 		t.Fatalf("failed to create new job: %v", err)
 	}
@@ -141,7 +144,7 @@ func TestJob_Run(t *testing.T) {
 	currDir, _ := os.Getwd()
 	dirPath := filepath.Join(currDir, "testdata", "typical")
 
-	job, err := NewJob(dirPath, false, []Change{{filepath.Join(dirPath, "sum.go"), 0, 0}}, nil, &strings.Builder{})
+	job, err := NewJob(dirPath, influencedSelector{}, []Change{{filepath.Join(dirPath, "sum.go"), 0, 0}}, nil, nil, nil, nil, &strings.Builder{})
 	if err != nil {
 		t.Fatalf("failed to create new job: %v", err)
 	}
@@ -159,41 +162,244 @@ func TestJob_Run(t *testing.T) {
 	}
 }
 
+func TestJob_RunWithRetries(t *testing.T) {
+	currDir, _ := os.Getwd()
+	dirPath := filepath.Join(currDir, "testdata", "flaky")
+	tempDir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var buff strings.Builder
+	env := map[string]string{"NOISEGATE_TEST_FLAKY_MARKER": filepath.Join(tempDir, "marker")}
+	job, err := NewJob(dirPath, allSelector{}, nil, nil, []string{"-count=1"}, env, nil, &buff)
+	if err != nil {
+		t.Fatalf("failed to create new job: %v", err)
+	}
+	job.Retries = 2
+
+	job.Run(context.Background())
+	if job.Status != JobStatusSuccessful {
+		t.Errorf("wrong status: %v", job.Status)
+	}
+	if !reflect.DeepEqual([]string{"TestFlaky"}, job.flakyTests) || len(job.failedTests) != 0 {
+		t.Errorf("wrong results: %v, %v", job.flakyTests, job.failedTests)
+	}
+	if !strings.Contains(buff.String(), "Retry TestFlaky (1/2)") || !strings.Contains(buff.String(), "Flaky: [TestFlaky]") {
+		t.Errorf("unexpected content: %s", buff.String())
+	}
+}
+
+func TestJob_RunWithRetries_Panic(t *testing.T) {
+	currDir, _ := os.Getwd()
+	dirPath := filepath.Join(currDir, "testdata", "panic")
+	tempDir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var buff strings.Builder
+	env := map[string]string{"NOISEGATE_TEST_PANIC_MARKER": filepath.Join(tempDir, "marker")}
+	job, err := NewJob(dirPath, allSelector{}, nil, nil, []string{"-count=1"}, env, nil, &buff)
+	if err != nil {
+		t.Fatalf("failed to create new job: %v", err)
+	}
+	job.Retries = 2
+
+	// TestPanic passes on retry, but TestAfterPanic never runs.
+	job.Run(context.Background())
+	if job.Status != JobStatusFailed {
+		t.Errorf("wrong status: %v", job.Status)
+	}
+	if !reflect.DeepEqual([]string{"TestPanic"}, job.failedTests) || !reflect.DeepEqual([]string{"TestAfterPanic"}, job.unfinishedTests) {
+		t.Errorf("wrong results: %v, %v", job.failedTests, job.unfinishedTests)
+	}
+	if strings.Contains(buff.String(), "Retry") {
+		t.Errorf("unexpected content: %s", buff.String())
+	}
+}
+
+func TestJob_RunWithRetries_Failed(t *testing.T) {
+	currDir, _ := os.Getwd()
+	dirPath := filepath.Join(currDir, "testdata", "env")
+
+	var buff strings.Builder
+	job, err := NewJob(dirPath, allSelector{}, nil, nil, nil, map[string]string{"NOISEGATE_TEST_DATABASE_URL": ""}, nil, &buff)
+	if err != nil {
+		t.Fatalf("failed to create new job: %v", err)
+	}
+	job.Retries = 2
+
+	job.Run(context.Background())
+	if job.Status != JobStatusFailed {
+		t.Errorf("wrong status: %v", job.Status)
+	}
+	if len(job.flakyTests) != 0 || !reflect.DeepEqual([]string{"TestDatabaseURL"}, job.failedTests) {
+		t.Errorf("wrong results: %v, %v", job.flakyTests, job.failedTests)
+	}
+	if !strings.Contains(buff.String(), "Retry TestDatabaseURL (2/2)") || strings.Contains(buff.String(), "Flaky:") {
+		t.Errorf("unexpected content: %s", buff.String())
+	}
+}
+
+func TestJob_Overlay(t *testing.T) {
+	currDir, _ := os.Getwd()
+	dirPath := filepath.Join(currDir, "testdata", "typical")
+
+	// the file does not exist on the disk.
+	overlay := map[string][]byte{
+		filepath.Join(dirPath, "overlay_test.go"): []byte(`package testdata
+
+import "testing"
+
+func TestOverlay(t *testing.T) {
+}
+`),
+	}
+	var buff strings.Builder
+	job, err := NewJob(dirPath, influencedSelector{}, []Change{{"overlay_test.go", 41, 41}}, nil, []string{"-v"}, nil, overlay, &buff)
+	if err != nil {
+		t.Fatalf("failed to create new job: %v", err)
+	}
+	if len(job.Tasks) != 4 || job.Tasks[0].TestFunction != "TestOverlay" || !job.Tasks[0].Important {
+		t.Fatalf("wrong tasks: %#v", job.Tasks)
+	}
+
+	job.Run(context.Background())
+	if job.Status != JobStatusSuccessful {
+		t.Errorf("wrong status: %v", job.Status)
+	}
+	if !strings.Contains(buff.String(), "--- PASS: TestOverlay") {
+		t.Errorf("the overlay is not used: %s", buff.String())
+	}
+	if job.overlayPath != "" {
+		t.Errorf("the overlay file is not removed: %s", job.overlayPath)
+	}
+}
+
 func TestJob_ChangedIdentityNames(t *testing.T) {
-	j := &Job{influences: []influence{{from: defaultIdentity{ast.NewIdent("FuncA")}}, {from: defaultIdentity{ast.NewIdent("FuncB")}}}}
+	j := &Job{influences: []Influence{{from: defaultIdentity{ast.NewIdent("FuncA")}}, {from: defaultIdentity{ast.NewIdent("FuncB")}}}}
 	names := j.changedIdentityNames()
 	if !reflect.DeepEqual([]string{"FuncA", "FuncB"}, names) {
 		t.Errorf("wrong list: %#v", names)
 	}
 }
 
-func TestFindOptionValue(t *testing.T) {
-	if result := findOptionValue([]string{"-tags", "integration_test"}, "tags"); result != "integration_test" {
-		t.Errorf("wrong result: %s", result)
+func TestJob_Explain(t *testing.T) {
+	currDir, _ := os.Getwd()
+	dirPath := filepath.Join(currDir, "testdata", "typical")
+
+	job, err := NewJob(dirPath, influencedSelector{}, []Change{{"sum_test.go", 60, 60}}, nil, nil, nil, nil, &strings.Builder{})
+	if err != nil {
+		t.Fatalf("failed to create new job: %v", err)
 	}
 
-	if result := findOptionValue([]string{"--tags", "integration_test"}, "tags"); result != "integration_test" {
-		t.Errorf("wrong result: %s", result)
+	expect := common.ExplainResponse{
+		Changed: []string{"TestSum"},
+		Explain: []common.Explanation{
+			{TestFunction: "TestSum", Selected: true, Chains: [][]common.ChainElement{{{Name: "TestSum", Position: "sum_test.go:7"}}}},
+			{TestFunction: "TestSum_ErrorCase"},
+			{TestFunction: "TestSum_Add1"},
+		},
+	}
+	if actual := job.Explain(); !reflect.DeepEqual(expect, actual) {
+		t.Errorf("wrong explanation: %#v", actual)
 	}
+}
+
+func TestJob_DryRun(t *testing.T) {
+	currDir, _ := os.Getwd()
+	dirPath := filepath.Join(currDir, "testdata", "typical")
 
-	if result := findOptionValue([]string{"-tags", "tag1,tag2"}, "tags"); result != "tag1,tag2" {
-		t.Errorf("wrong result: %s", result)
+	var buff strings.Builder
+	job, err := NewJob(dirPath, influencedSelector{}, []Change{{"sum_test.go", 60, 60}}, nil, []string{"-v"}, nil, nil, &buff)
+	if err != nil {
+		t.Fatalf("failed to create new job: %v", err)
 	}
+	job.DryRun()
 
-	if result := findOptionValue([]string{"-tags"}, "tags"); result != "" {
-		t.Errorf("wrong result: %s", result)
+	expect := `Changed: [TestSum]
+Selected: [TestSum]
+Not selected: [TestSum_ErrorCase, TestSum_Add1]
+Command: go test -v -run '^TestSum$' .
+`
+	if buff.String() != expect {
+		t.Errorf("unexpected output: %s", buff.String())
 	}
+	if job.Status != JobStatusCreated {
+		t.Errorf("wrong status: %v", job.Status)
+	}
+}
+
+func TestJob_DryRunWithOverlay(t *testing.T) {
+	currDir, _ := os.Getwd()
+	dirPath := filepath.Join(currDir, "testdata", "typical")
+	path := filepath.Join(dirPath, "sum_test.go")
+	content, _ := ioutil.ReadFile(path)
 
-	if result := findOptionValue([]string{"-wrong-tags", "tag1"}, "tags"); result != "" {
-		t.Errorf("wrong result: %s", result)
+	var buff strings.Builder
+	job, err := NewJob(dirPath, influencedSelector{}, []Change{{"sum_test.go", 60, 60}}, nil, nil, nil, map[string][]byte{path: content}, &buff)
+	if err != nil {
+		t.Fatalf("failed to create new job: %v", err)
 	}
+	job.DryRun()
 
-	if result := findOptionValue([]string{"-v"}, "tags"); result != "" {
-		t.Errorf("wrong result: %s", result)
+	matches := regexp.MustCompile(`Command: go test -overlay (\S+) `).FindStringSubmatch(buff.String())
+	if matches == nil {
+		t.Fatalf("no overlay option: %s", buff.String())
+	}
+	defer os.RemoveAll(filepath.Dir(matches[1]))
+	if _, err := os.Stat(matches[1]); err != nil {
+		t.Errorf("the overlay file is not kept: %v", err)
 	}
+}
 
-	if result := findOptionValue([]string{""}, "tags"); result != "" {
-		t.Errorf("wrong result: %s", result)
+func TestFindFlagValues(t *testing.T) {
+	for i, testCase := range []struct {
+		opts   []string
+		expect []string
+	}{
+		{[]string{"-tags", "integration_test"}, []string{"integration_test"}},
+		{[]string{"--tags", "integration_test"}, []string{"integration_test"}},
+		{[]string{"-tags=tag1,tag2"}, []string{"tag1,tag2"}},
+		{[]string{"--tags=tag1"}, []string{"tag1"}},
+		{[]string{"-tags=tag1", "-v", "-tags", "tag2"}, []string{"tag1", "tag2"}},
+		{[]string{"-tags="}, []string{""}},
+		{[]string{"-tags"}, nil},
+		{[]string{"-args", "-tags", "tag1"}, nil},
+		{[]string{"-wrong-tags", "tag1"}, nil},
+		{[]string{"-v"}, nil},
+		{[]string{""}, nil},
+	} {
+		if actual := findFlagValues(testCase.opts, "tags"); !reflect.DeepEqual(testCase.expect, actual) {
+			t.Errorf("[%d] wrong result: %#v", i, actual)
+		}
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	merged := mergeEnv([]string{"HOME=/home/user", "GOFLAGS=-mod=mod", "CGO_ENABLED=1"}, map[string]string{"GOFLAGS": "-mod=vendor", "GOOS": "windows"})
+	expect := []string{"HOME=/home/user", "CGO_ENABLED=1", "GOFLAGS=-mod=vendor", "GOOS=windows"}
+	if !reflect.DeepEqual(expect, merged) {
+		t.Errorf("unexpected env: %#v", merged)
+	}
+}
+
+func TestNewJob_Env(t *testing.T) {
+	currDir, _ := os.Getwd()
+	dirPath := filepath.Join(currDir, "testdata", "buildtags")
+
+	job, err := NewJob(dirPath, allSelector{}, nil, nil, nil, map[string]string{"GOFLAGS": "-tags=example"}, nil, &strings.Builder{})
+	if err != nil {
+		t.Fatalf("failed to create new job: %v", err)
+	}
+	if len(job.Tasks) != 1 || job.Tasks[0].TestFunction != "TestSum" {
+		t.Errorf("wrong tasks: %#v", job.Tasks)
+	}
+	if lookupEnv(job.env, "GOFLAGS") != "-tags=example" {
+		t.Errorf("wrong env: %v", job.env)
 	}
 }
 
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+// Listen listens on the address, which is `unix:/path/to/socket` or `host:port`.
+// The unix domain socket is accessible only by the current user: the permission of the socket is 0600 and
+// the directory is created with 0700 if not exist. The directory must be owned by the current user and not a symlink,
+// because another user may create it beforehand in the shared directory. The stale socket left by the dead server is removed.
+// Note that the tcp address is accessible by any local user.
+func Listen(addr string) (net.Listener, error) {
+	network, address := common.ParseServerAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	dir := filepath.Dir(address)
+	fi, err := common.MakeOwnDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket directory: %w", err)
+	}
+	if addr == common.DefaultServerAddr() && fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("the socket directory is accessible by other users: %s", dir)
+	}
+	if _, err := os.Stat(address); err == nil {
+		if conn, err := net.Dial("unix", address); err == nil {
+			conn.Close()
+			return nil, errors.New("the server is already running at " + addr)
+		}
+		if err := os.Remove(address); err != nil {
+			return nil, fmt.Errorf("failed to remove the stale socket: %w", err)
+		}
+	}
+
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(address, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to change the permission of the socket: %w", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "gated.sock")
+
+	l, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("wrong permission: %v", fi.Mode().Perm())
+	}
+	if fi, _ := os.Stat(filepath.Dir(path)); fi.Mode().Perm() != 0700 {
+		t.Errorf("wrong permission: %v", fi.Mode().Perm())
+	}
+
+	if _, err := Listen("unix:" + path); err == nil {
+		t.Errorf("nil error while the server is running")
+	}
+
+	// leave the stale socket
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("failed to listen with the stale socket: %v", err)
+	}
+	l.Close()
+}
+
+func TestListen_TCP(t *testing.T) {
+	l, err := Listen("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if l.Addr().Network() != "tcp" {
+		t.Errorf("wrong network: %s", l.Addr().Network())
+	}
+}
+
+func TestListen_UntrustedDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip(err)
+	}
+	if l, err := Listen("unix:" + filepath.Join(link, "gated.sock")); err == nil {
+		l.Close()
+		t.Errorf("nil error for the symlink directory")
+	}
+
+	if os.Getuid() != 0 {
+		return
+	}
+	// the directory created by another user.
+	if err := os.Chown(target, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := Listen("unix:" + filepath.Join(target, "gated.sock")); err == nil {
+		l.Close()
+		t.Errorf("nil error for the directory of another user")
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-noisegate/noisegate/common/log"
+	"golang.org/x/tools/go/packages"
+)
+
+// buildConfig represents how the package is built. The package is analyzed in the same way as `go test` builds it.
+type buildConfig struct {
+	// The build context which reads the files from the overlay. Its GOOS, GOARCH, CgoEnabled and BuildTags
+	// are passed to the go command.
+	ctxt *build.Context
+	// The go build flags which change how the dependencies are resolved. See `findImporterFlags`.
+	flags []string
+	// The environment variables of the go command, in the `key=value` form. The environment of the server if nil.
+	env []string
+	// The contents of the unsaved files, keyed by the abs path. May be nil.
+	overlay map[string][]byte
+}
+
+// goFlags returns the go build flags passed to the go command, including the build tags.
+func (c buildConfig) goFlags() []string {
+	flags := append([]string(nil), c.flags...)
+	var tags []string
+	for _, tag := range c.ctxt.BuildTags {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		flags = append(flags, "-tags="+strings.Join(tags, ","))
+	}
+	return flags
+}
+
+// environ returns the environment variables of the go command.
+func (c buildConfig) environ() []string {
+	cgoEnabled := "0"
+	if c.ctxt.CgoEnabled {
+		cgoEnabled = "1"
+	}
+	env := c.env
+	if env == nil {
+		env = os.Environ()
+	}
+	return append(env[:len(env):len(env)], "GOOS="+c.ctxt.GOOS, "GOARCH="+c.ctxt.GOARCH, "CGO_ENABLED="+cgoEnabled)
+}
+
+// the environment variables which change how the package is built, in addition to GOOS, GOARCH and CGO_ENABLED.
+var buildEnvKeys = []string{"GOFLAGS", "GOWORK", "GOEXPERIMENT", "GO111MODULE"}
+
+// key returns the string which identifies the build configuration, except the overlay.
+func (c buildConfig) key() string {
+	key := fmt.Sprintf("%s/%s/%v %s", c.ctxt.GOOS, c.ctxt.GOARCH, c.ctxt.CgoEnabled, strings.Join(c.goFlags(), " "))
+	env := c.environ()
+	for _, envKey := range buildEnvKeys {
+		key += fmt.Sprintf(" %s=%s", envKey, lookupEnv(env, envKey))
+	}
+	return key
+}
+
+// newBuildContext returns the build context which selects the same files as `go test` with the options and
+// the environment variables (in the `key=value` form). GOOS, GOARCH, CGO_ENABLED and the build tags in GOFLAGS are
+// respected. The build tags in the options take precedence over GOFLAGS, and only the last `-tags` is effective
+// as the go command does.
+func newBuildContext(goTestOpts []string, env []string) *build.Context {
+	ctxt := build.Default
+	goos, goarch, cgoEnabled, goFlags := lookupEnv(env, "GOOS"), lookupEnv(env, "GOARCH"), lookupEnv(env, "CGO_ENABLED"), lookupEnv(env, "GOFLAGS")
+	if goos != "" {
+		ctxt.GOOS = goos
+	}
+	if goarch != "" {
+		ctxt.GOARCH = goarch
+	}
+	switch {
+	case cgoEnabled != "":
+		ctxt.CgoEnabled = cgoEnabled == "1"
+	case ctxt.GOOS != build.Default.GOOS || ctxt.GOARCH != build.Default.GOARCH:
+		// cgo is disabled by default when cross-compiling.
+		ctxt.CgoEnabled = false
+	}
+
+	ctxt.BuildTags = nil
+	tags := findFlagValues(strings.Fields(goFlags), "tags")
+	tags = append(tags, findFlagValues(goTestOpts, "tags")...)
+	if len(tags) > 0 {
+		ctxt.BuildTags = parseBuildTags(tags[len(tags)-1])
+	}
+	return &ctxt
+}
+
+// parseBuildTags parses the value of the `-tags` flag. The tags are separated by the commas, or by the spaces
+// for compatibility with Go 1.12 and earlier.
+func parseBuildTags(value string) []string {
+	sep := ","
+	if strings.Contains(value, " ") || strings.Contains(value, "'") {
+		sep = " "
+		value = strings.Replace(value, "'", "", -1)
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(value, sep) {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// lookupEnv returns the value of the last environment variable of the key. Empty if not found.
+func lookupEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key+"=") {
+			return env[i][len(key)+1:]
+		}
+	}
+	return ""
+}
+
+// packageMetadata represents the package and its tests.
+type packageMetadata struct {
+	Dir string
+	// The name of the package. It has the `_test` suffix if the directory has only the external test package.
+	Name string
+	// The base names of the go files `go test` compiles, including the test files.
+	GoFiles []string
+	// The base names of the test files. Subset of `GoFiles`.
+	TestGoFiles []string
+	// The sizes and modification times of the files in the directory when the metadata is loaded, keyed by the base name.
+	// The metadata is cached until they are changed, so the cached package can skip reading the unchanged files.
+	FileStats map[string]fileStat
+}
+
+type fileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+func newFileStats(fis []os.FileInfo) map[string]fileStat {
+	stats := make(map[string]fileStat)
+	for _, fi := range fis {
+		stats[fi.Name()] = fileStat{fi.Size(), fi.ModTime()}
+	}
+	return stats
+}
+
+// metadataCache caches the package metadata until the directory, the overlay or the module files are modified,
+// because loading the metadata runs the go command and takes some time.
+var metadataCache = struct {
+	entries map[string]metadataCacheEntry
+	mtx     sync.Mutex
+}{entries: make(map[string]metadataCacheEntry)}
+
+type metadataCacheEntry struct {
+	fingerprint [sha256.Size]byte
+	metadata    *packageMetadata
+}
+
+// loadPackageMetadata loads the metadata of the package and its tests using go/packages, so the files which
+// `go test` compiles are selected with the same build constraints, go.work, vendor directory and so on.
+// It returns `*build.NoGoError` if there is no go file to compile.
+func loadPackageMetadata(conf buildConfig, dirPath string) (*packageMetadata, error) {
+	key := conf.key() + " " + dirPath
+	fis, _ := readDir(nil, dirPath)
+	fingerprint := metadataFingerprint(conf, dirPath, fis)
+	metadataCache.mtx.Lock()
+	entry, ok := metadataCache.entries[key]
+	metadataCache.mtx.Unlock()
+	if ok && entry.fingerprint == fingerprint {
+		return entry.metadata, nil
+	}
+
+	cfg := &packages.Config{
+		Mode:       packages.NeedName | packages.NeedFiles,
+		Dir:        dirPath,
+		Env:        conf.environ(),
+		BuildFlags: conf.goFlags(),
+		Tests:      true,
+		Overlay:    conf.overlay,
+	}
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		// e.g. the dependency is not available.
+		log.Debugf("failed to load the package %s, fall back to go/build: %v\n", dirPath, err)
+		metadata, err := importDirMetadata(conf, dirPath)
+		if err != nil {
+			return nil, err
+		}
+		metadata.FileStats = newFileStats(fis)
+		return metadata, nil
+	}
+
+	metadata := &packageMetadata{Dir: dirPath, FileStats: newFileStats(fis)}
+	found := make(map[string]struct{})
+	for _, pkg := range pkgs {
+		for _, path := range pkg.GoFiles {
+			if filepath.Dir(path) != dirPath {
+				// e.g. the generated test main.
+				continue
+			}
+			if metadata.Name == "" || strings.HasSuffix(metadata.Name, "_test") {
+				metadata.Name = pkg.Name
+			}
+
+			name := filepath.Base(path)
+			if _, ok := found[name]; ok {
+				continue
+			}
+			found[name] = struct{}{}
+			metadata.GoFiles = append(metadata.GoFiles, name)
+			if strings.HasSuffix(name, "_test.go") {
+				metadata.TestGoFiles = append(metadata.TestGoFiles, name)
+			}
+		}
+	}
+	if len(metadata.GoFiles) == 0 {
+		return nil, &build.NoGoError{Dir: dirPath}
+	}
+	sort.Strings(metadata.GoFiles)
+	sort.Strings(metadata.TestGoFiles)
+
+	metadataCache.mtx.Lock()
+	metadataCache.entries[key] = metadataCacheEntry{fingerprint, metadata}
+	metadataCache.mtx.Unlock()
+	return metadata, nil
+}
+
+// importDirMetadata loads the metadata of the package using go/build. Unlike go/packages, it doesn't respect go.work,
+// the vendor directory and so on, but works without the go command and the dependencies.
+func importDirMetadata(conf buildConfig, dirPath string) (*packageMetadata, error) {
+	pkg, err := conf.ctxt.ImportDir(dirPath, build.IgnoreVendor)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &packageMetadata{Dir: dirPath, Name: pkg.Name}
+	metadata.GoFiles = append(metadata.GoFiles, pkg.GoFiles...)
+	metadata.GoFiles = append(metadata.GoFiles, pkg.CgoFiles...)
+	metadata.TestGoFiles = append(metadata.TestGoFiles, pkg.TestGoFiles...)
+	metadata.TestGoFiles = append(metadata.TestGoFiles, pkg.XTestGoFiles...)
+	metadata.GoFiles = append(metadata.GoFiles, metadata.TestGoFiles...)
+	sort.Strings(metadata.GoFiles)
+	sort.Strings(metadata.TestGoFiles)
+	return metadata, nil
+}
+
+// metadataFingerprint returns the hash of the names and modification times of the files in the directory (`fis`),
+// the overlay of the files in the directory and the modification time of the module files.
+func metadataFingerprint(conf buildConfig, dirPath string, fis []os.FileInfo) [sha256.Size]byte {
+	h := sha256.New()
+	for _, fi := range fis {
+		fmt.Fprintf(h, "%s %d %d\n", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	var paths []string
+	for path := range conf.overlay {
+		if filepath.Dir(path) == dirPath {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(h, "%s %x\n", path, sha256.Sum256(conf.overlay[path]))
+	}
+
+	fmt.Fprintf(h, "%d\n", moduleFilesModTime(dirPath).UnixNano())
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
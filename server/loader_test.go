@@ -0,0 +1,148 @@
+package server
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadPackageMetadata(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "typical")
+
+	metadata, err := loadPackageMetadata(buildConfig{ctxt: &build.Default}, dirPath)
+	if err != nil {
+		t.Fatalf("failed to load the metadata: %v", err)
+	}
+	if metadata.Name != "testdata" {
+		t.Errorf("wrong name: %s", metadata.Name)
+	}
+	if !reflect.DeepEqual(metadata.GoFiles, []string{"sum.go", "sum_test.go"}) {
+		t.Errorf("wrong go files: %v", metadata.GoFiles)
+	}
+	if !reflect.DeepEqual(metadata.TestGoFiles, []string{"sum_test.go"}) {
+		t.Errorf("wrong test files: %v", metadata.TestGoFiles)
+	}
+}
+
+func TestLoadPackageMetadata_BuildTags(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "buildtags")
+
+	_, err := loadPackageMetadata(buildConfig{ctxt: &build.Default}, dirPath)
+	if _, ok := err.(*build.NoGoError); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ctxt := build.Default
+	ctxt.BuildTags = []string{"example"}
+	metadata, err := loadPackageMetadata(buildConfig{ctxt: &ctxt}, dirPath)
+	if err != nil {
+		t.Fatalf("failed to load the metadata: %v", err)
+	}
+	if !reflect.DeepEqual(metadata.TestGoFiles, []string{"sum_test.go"}) {
+		t.Errorf("wrong test files: %v", metadata.TestGoFiles)
+	}
+}
+
+func TestLoadPackageMetadata_Overlay(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "typical")
+	newPath := filepath.Join(dirPath, "new_test.go")
+	overlay := map[string][]byte{newPath: []byte("package testdata\n")}
+
+	metadata, err := loadPackageMetadata(buildConfig{ctxt: newOverlayContext(&build.Default, overlay), overlay: overlay}, dirPath)
+	if err != nil {
+		t.Fatalf("failed to load the metadata: %v", err)
+	}
+	if !reflect.DeepEqual(metadata.TestGoFiles, []string{"new_test.go", "sum_test.go"}) {
+		t.Errorf("wrong test files: %v", metadata.TestGoFiles)
+	}
+}
+
+func TestImportDirMetadata(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "typical")
+
+	metadata, err := importDirMetadata(buildConfig{ctxt: &build.Default}, dirPath)
+	if err != nil {
+		t.Fatalf("failed to load the metadata: %v", err)
+	}
+	if !reflect.DeepEqual(metadata.GoFiles, []string{"sum.go", "sum_test.go"}) {
+		t.Errorf("wrong go files: %v", metadata.GoFiles)
+	}
+}
+
+func TestNewBuildContext(t *testing.T) {
+	for i, testCase := range []struct {
+		opts   []string
+		env    []string
+		expect []string
+	}{
+		{nil, nil, nil},
+		{[]string{"-tags", "a"}, nil, []string{"a"}},
+		{[]string{"-tags=a,b"}, nil, []string{"a", "b"}},
+		{[]string{"-tags=a", "--tags=b"}, nil, []string{"b"}},
+		{[]string{"-tags", "a b"}, nil, []string{"a", "b"}},
+		{nil, []string{"GOFLAGS=-v -tags=a,b"}, []string{"a", "b"}},
+		{[]string{"-tags=c"}, []string{"GOFLAGS=-tags=a,b"}, []string{"c"}},
+	} {
+		ctxt := newBuildContext(testCase.opts, testCase.env)
+		if !reflect.DeepEqual(testCase.expect, ctxt.BuildTags) {
+			t.Errorf("[%d] wrong build tags: %#v", i, ctxt.BuildTags)
+		}
+	}
+}
+
+func TestNewBuildContext_Platform(t *testing.T) {
+	ctxt := newBuildContext(nil, []string{"GOOS=windows", "GOARCH=arm64"})
+	if ctxt.GOOS != "windows" || ctxt.GOARCH != "arm64" {
+		t.Errorf("wrong platform: %s/%s", ctxt.GOOS, ctxt.GOARCH)
+	}
+	if build.Default.GOOS != "windows" && ctxt.CgoEnabled {
+		t.Errorf("cgo is enabled when cross-compiling")
+	}
+	if build.Default.GOOS == "windows" && build.Default.GOARCH == "arm64" {
+		return
+	}
+	if build.Default.GOOS == ctxt.GOOS && build.Default.GOARCH == ctxt.GOARCH {
+		t.Errorf("build.Default is modified")
+	}
+
+	ctxt = newBuildContext(nil, []string{"GOOS=windows", "CGO_ENABLED=1"})
+	if !ctxt.CgoEnabled {
+		t.Errorf("cgo is not enabled")
+	}
+}
+
+func TestLoadPackageMetadata_GOOS(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	dirPath, _ = filepath.EvalSymlinks(dirPath)
+	for name, content := range map[string]string{
+		"go.mod":                  "module example.com/goos\n",
+		"sum.go":                  "package goos\n",
+		"sum_windows_test.go":     "package goos\n",
+		"sum_linux_test.go":       "package goos\n",
+		"sum_integration_test.go": "// +build integration\n\npackage goos\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dirPath, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := buildConfig{ctxt: newBuildContext([]string{"-tags=integration"}, []string{"GOOS=windows"})}
+	metadata, err := loadPackageMetadata(conf, dirPath)
+	if err != nil {
+		t.Fatalf("failed to load the metadata: %v", err)
+	}
+	if !reflect.DeepEqual(metadata.TestGoFiles, []string{"sum_integration_test.go", "sum_windows_test.go"}) {
+		t.Errorf("wrong test files: %v", metadata.TestGoFiles)
+	}
+}
@@ -0,0 +1,590 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/go-noisegate/noisegate/common"
+	"github.com/go-noisegate/noisegate/common/log"
+)
+
+// The commands which the lsp server exposes via `workspace/executeCommand`.
+// The argument of the commands is the package directory.
+const (
+	LSPCommandRunTests    = "noisegate.runTests"
+	LSPCommandRunAllTests = "noisegate.runAllTests"
+)
+
+// The error codes of the json rpc.
+const (
+	lspErrorParseError     = -32700
+	lspErrorInvalidParams  = -32602
+	lspErrorMethodNotFound = -32601
+	lspErrorInternalError  = -32603
+)
+
+// LSPServer serves the language server protocol over the stream, usually the stdio.
+// It shares the recent changes with the server, so the editor doesn't need to call the hint API.
+// * `textDocument/didChange` hints the changed ranges and keeps the unsaved content as the overlay.
+// * `textDocument/codeLens` shows the number of the affected tests at the top of the go file.
+// * `workspace/executeCommand` runs the affected tests (or all tests) of the package.
+type LSPServer struct {
+	// If not nil, each hint is also passed to it, so that another server (e.g. the one `gate` talks to) shares the changes.
+	ForwardHint HintForwarder
+	server      *Server
+	in          *bufio.Reader
+	out         io.Writer
+	outMtx      sync.Mutex
+	// the contents of the opened documents, keyed by the abs path.
+	docs    map[string][]byte
+	docsMtx sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// HintForwarder forwards the hint of the lsp server. The range is the byte offsets in the file and `content` is the
+// unsaved content of the file. It's called in the order of the changes and must not block.
+type HintForwarder func(path string, r common.Range, content string)
+
+// NewLSPServer returns a new lsp server which reads the messages from `in` and writes the messages to `out`.
+func NewLSPServer(s *Server, in io.Reader, out io.Writer) *LSPServer {
+	return &LSPServer{
+		server: s,
+		in:     bufio.NewReader(in),
+		out:    out,
+		docs:   make(map[string][]byte),
+	}
+}
+
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspTextDocumentItem struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspTextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type lspDidOpenParams struct {
+	TextDocument lspTextDocumentItem `json:"textDocument"`
+}
+
+type lspDidChangeParams struct {
+	TextDocument   lspTextDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		// nil if the text is the whole content.
+		Range *lspRange `json:"range"`
+		Text  string    `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type lspDidCloseParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+}
+
+type lspCodeLensParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+}
+
+type lspCodeLens struct {
+	Range   lspRange   `json:"range"`
+	Command lspCommand `json:"command"`
+}
+
+type lspCommand struct {
+	Title     string        `json:"title"`
+	Command   string        `json:"command"`
+	Arguments []interface{} `json:"arguments"`
+}
+
+type lspExecuteCommandParams struct {
+	Command   string            `json:"command"`
+	Arguments []json.RawMessage `json:"arguments"`
+}
+
+// The message types of `window/showMessage` and `window/logMessage`.
+const (
+	lspMessageTypeError   = 1
+	lspMessageTypeWarning = 2
+	lspMessageTypeInfo    = 3
+	lspMessageTypeLog     = 4
+)
+
+type lspMessageParams struct {
+	Type    int    `json:"type"`
+	Message string `json:"message"`
+}
+
+// Serve reads and handles the messages until the `exit` notification is received or the input is closed.
+func (l *LSPServer) Serve(ctx context.Context) error {
+	defer l.wg.Wait()
+
+	for {
+		body, err := l.readMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var msg lspMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			l.writeResponse(nil, nil, &lspError{lspErrorParseError, err.Error()})
+			continue
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		l.handleMessage(ctx, msg)
+	}
+}
+
+func (l *LSPServer) readMessage() ([]byte, error) {
+	header, err := textproto.NewReader(l.in).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read the header: %w", err)
+	}
+
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length: %w", err)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(l.in, body); err != nil {
+		return nil, fmt.Errorf("failed to read the body: %w", err)
+	}
+	return body, nil
+}
+
+func (l *LSPServer) writeMessage(v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("failed to encode the message: %v\n", err)
+		return
+	}
+
+	l.outMtx.Lock()
+	defer l.outMtx.Unlock()
+	if _, err := fmt.Fprintf(l.out, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		log.Printf("failed to write the message: %v\n", err)
+	}
+}
+
+func (l *LSPServer) writeResponse(id *json.RawMessage, result interface{}, lspErr *lspError) {
+	l.writeMessage(lspResponse{JSONRPC: "2.0", ID: id, Result: result, Error: lspErr})
+}
+
+func (l *LSPServer) writeNotification(method string, params interface{}) {
+	l.writeMessage(lspNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (l *LSPServer) handleMessage(ctx context.Context, msg lspMessage) {
+	log.Debugf("lsp: %s\n", msg.Method)
+
+	var err error
+	switch msg.Method {
+	case "initialize":
+		l.writeResponse(msg.ID, l.capabilities(), nil)
+	case "shutdown":
+		l.writeResponse(msg.ID, nil, nil)
+	case "textDocument/didOpen":
+		err = l.handleDidOpen(msg.Params)
+	case "textDocument/didChange":
+		err = l.handleDidChange(msg.Params)
+	case "textDocument/didClose":
+		err = l.handleDidClose(msg.Params)
+	case "textDocument/codeLens":
+		// the analysis may take a while, so other messages are handled meanwhile.
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			lenses, err := l.handleCodeLens(msg.Params)
+			if err != nil {
+				l.writeResponse(msg.ID, nil, &lspError{lspErrorInternalError, err.Error()})
+				return
+			}
+			l.writeResponse(msg.ID, lenses, nil)
+		}()
+	case "workspace/executeCommand":
+		// the test may take a long time, so other messages are handled meanwhile.
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			if err := l.handleExecuteCommand(ctx, msg.Params); err != nil {
+				l.writeResponse(msg.ID, nil, &lspError{lspErrorInvalidParams, err.Error()})
+				return
+			}
+			l.writeResponse(msg.ID, nil, nil)
+		}()
+	default:
+		if msg.ID != nil {
+			l.writeResponse(msg.ID, nil, &lspError{lspErrorMethodNotFound, "method not found: " + msg.Method})
+		}
+		// ignore the unsupported notification
+	}
+
+	if err != nil {
+		log.Printf("failed to handle %s: %v\n", msg.Method, err)
+	}
+}
+
+func (l *LSPServer) capabilities() interface{} {
+	return map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocumentSync": map[string]interface{}{
+				"openClose": true,
+				"change":    2, // incremental
+			},
+			"codeLensProvider": map[string]interface{}{},
+			"executeCommandProvider": map[string]interface{}{
+				"commands": []string{LSPCommandRunTests, LSPCommandRunAllTests},
+			},
+		},
+		"serverInfo": map[string]interface{}{
+			"name":    "gated",
+			"version": common.Version,
+		},
+	}
+}
+
+func (l *LSPServer) handleDidOpen(rawParams json.RawMessage) error {
+	var params lspDidOpenParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+	path, err := uriToPath(params.TextDocument.URI)
+	if err != nil {
+		return err
+	}
+
+	l.docsMtx.Lock()
+	defer l.docsMtx.Unlock()
+	l.docs[path] = []byte(params.TextDocument.Text)
+	return nil
+}
+
+func (l *LSPServer) handleDidClose(rawParams json.RawMessage) error {
+	var params lspDidCloseParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+	path, err := uriToPath(params.TextDocument.URI)
+	if err != nil {
+		return err
+	}
+
+	l.docsMtx.Lock()
+	defer l.docsMtx.Unlock()
+	delete(l.docs, path)
+	// the unsaved content is discarded when the document is closed.
+	l.server.changeManager.DeleteOverlay(path)
+	return nil
+}
+
+// handleDidChange applies the changes to the document and hints the changed ranges with the new content as the overlay.
+func (l *LSPServer) handleDidChange(rawParams json.RawMessage) error {
+	var params lspDidChangeParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+	path, err := uriToPath(params.TextDocument.URI)
+	if err != nil {
+		return err
+	}
+
+	if err := l.server.checkPath(path); err != nil {
+		return err
+	}
+
+	l.docsMtx.Lock()
+	defer l.docsMtx.Unlock()
+	content, ok := l.docs[path]
+	if !ok {
+		return fmt.Errorf("the document is not opened: %s", path)
+	}
+
+	// each change is hinted separately because the range of the change is based on the content after the previous changes.
+	for _, ch := range params.ContentChanges {
+		var r common.Range
+		if ch.Range == nil {
+			newContent := []byte(ch.Text)
+			r = findChangedRange(content, newContent)
+			content = newContent
+		} else {
+			begin := lspOffset(content, ch.Range.Start)
+			end := lspOffset(content, ch.Range.End)
+			if begin > end {
+				return fmt.Errorf("invalid range: %v", ch.Range)
+			}
+
+			newContent := make([]byte, 0, len(content)-int(end-begin)+len(ch.Text))
+			newContent = append(newContent, content[:begin]...)
+			newContent = append(newContent, ch.Text...)
+			newContent = append(newContent, content[end:]...)
+			content = newContent
+
+			r = common.Range{Begin: begin, End: begin}
+			if len(ch.Text) > 0 {
+				r.End = begin + int64(len(ch.Text)) - 1
+			}
+		}
+		l.docs[path] = content
+
+		// the overlay is kept until the document is closed.
+		if err := l.server.updateChanges(path, []common.Range{r}, "", map[string]string{path: string(content)}, 0); err != nil {
+			return err
+		}
+		if l.ForwardHint != nil {
+			l.ForwardHint(path, r, string(content))
+		}
+	}
+	return nil
+}
+
+// findChangedRange returns the range of the new content which differs from the old content.
+func findChangedRange(oldContent, newContent []byte) common.Range {
+	prefix := 0
+	for prefix < len(oldContent) && prefix < len(newContent) && oldContent[prefix] == newContent[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldContent)-prefix && suffix < len(newContent)-prefix &&
+		oldContent[len(oldContent)-1-suffix] == newContent[len(newContent)-1-suffix] {
+		suffix++
+	}
+
+	begin := int64(prefix)
+	end := int64(len(newContent) - suffix - 1)
+	if end < begin {
+		// deleted
+		end = begin
+	}
+	return common.Range{Begin: begin, End: end}
+}
+
+// lspOffset converts the lsp position (0-based line and utf-16 character) to the byte offset.
+func lspOffset(content []byte, pos lspPosition) int64 {
+	lineStarts := findLineStarts(content)
+	if pos.Line >= len(lineStarts) {
+		return int64(len(content))
+	}
+	offset, err := toOffset(content, lineStarts, pos.Line+1, pos.Character+1, common.ColumnUnitUTF16, false)
+	if err != nil {
+		return int64(len(content))
+	}
+	return offset
+}
+
+// handleCodeLens shows the number of the affected tests at the top of the go file.
+func (l *LSPServer) handleCodeLens(rawParams json.RawMessage) ([]lspCodeLens, error) {
+	var params lspCodeLensParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return nil, err
+	}
+	path, err := uriToPath(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".go") {
+		return []lspCodeLens{}, nil
+	}
+
+	pkgDir := filepath.Dir(path)
+	selector, goTestOpts, err := l.server.applyConfig(pkgDir, false, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	env, err := l.collectEnv(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	changes, _ := l.server.findChanges(pkgDir)
+	job, err := NewJob(pkgDir, selector, changes, l.server.failedTests.find(pkgDir), goTestOpts, env, l.server.changeManager.FindOverlays(), ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+	numSelected := 0
+	for _, t := range job.Tasks {
+		if t.Important {
+			numSelected++
+		}
+	}
+
+	title := fmt.Sprintf("run %d affected tests", numSelected)
+	if numSelected == 1 {
+		title = "run 1 affected test"
+	}
+	return []lspCodeLens{
+		{Command: lspCommand{Title: title, Command: LSPCommandRunTests, Arguments: []interface{}{pkgDir}}},
+		{Command: lspCommand{Title: fmt.Sprintf("run all %d tests", len(job.Tasks)), Command: LSPCommandRunAllTests, Arguments: []interface{}{pkgDir}}},
+	}, nil
+}
+
+// handleExecuteCommand runs the tests of the package. The output is sent by `window/logMessage`
+// and the result is sent by `window/showMessage`.
+func (l *LSPServer) handleExecuteCommand(ctx context.Context, rawParams json.RawMessage) error {
+	var params lspExecuteCommandParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+	if params.Command != LSPCommandRunTests && params.Command != LSPCommandRunAllTests {
+		return fmt.Errorf("unknown command: %s", params.Command)
+	}
+	if len(params.Arguments) != 1 {
+		return errors.New("the package directory is not specified")
+	}
+	var pkgDir string
+	if err := json.Unmarshal(params.Arguments[0], &pkgDir); err != nil {
+		return err
+	}
+	pkgDir = filepath.Clean(pkgDir)
+	if err := l.server.checkPath(pkgDir); err != nil {
+		return err
+	}
+	if err := l.server.validateTestPath(pkgDir); err != nil {
+		return err
+	}
+
+	log.Printf("test %s (lsp)\n", pkgDir)
+
+	w := &lspLogWriter{l: l}
+	defer w.Flush()
+	selector, goTestOpts, err := l.server.applyConfig(pkgDir, params.Command == LSPCommandRunAllTests, "", nil)
+	if err != nil {
+		return err
+	}
+	env, err := l.collectEnv(pkgDir)
+	if err != nil {
+		return err
+	}
+	changes, moduleMark := l.server.findChanges(pkgDir)
+	job, err := NewJob(pkgDir, selector, changes, l.server.failedTests.find(pkgDir), goTestOpts, env, l.server.changeManager.FindOverlays(), w)
+	if err != nil {
+		return fmt.Errorf("failed to generate a new job: %w", err)
+	}
+	job.Retries = findRetries(pkgDir, 0)
+	l.server.runJob(ctx, job, moduleMark)
+
+	if job.Status == JobStatusSuccessful && len(job.flakyTests) > 0 {
+		msg := fmt.Sprintf("tests passed: %s (flaky: %s)", pkgDir, strings.Join(job.flakyTests, ", "))
+		l.writeNotification("window/showMessage", lspMessageParams{lspMessageTypeWarning, msg})
+	} else if job.Status == JobStatusSuccessful {
+		l.writeNotification("window/showMessage", lspMessageParams{lspMessageTypeInfo, "tests passed: " + pkgDir})
+	} else {
+		l.writeNotification("window/showMessage", lspMessageParams{lspMessageTypeError, "tests failed: " + pkgDir})
+	}
+	return nil
+}
+
+// lspLogWriter sends the written data by `window/logMessage`, line by line.
+type lspLogWriter struct {
+	l   *LSPServer
+	buf bytes.Buffer
+	mtx sync.Mutex
+}
+
+func (w *lspLogWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i == -1 {
+			break
+		}
+		line := string(w.buf.Next(i + 1))
+		w.l.writeNotification("window/logMessage", lspMessageParams{lspMessageTypeLog, strings.TrimSuffix(line, "\n")})
+	}
+	return len(p), nil
+}
+
+// Flush sends the remaining data.
+func (w *lspLogWriter) Flush() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.l.writeNotification("window/logMessage", lspMessageParams{lspMessageTypeLog, w.buf.String()})
+		w.buf.Reset()
+	}
+}
+
+// collectEnv collects the environment variables of the go command like `gate` does. The lsp server runs in
+// the environment of the editor, so the variables are collected from the server process.
+func (l *LSPServer) collectEnv(pkgDir string) (map[string]string, error) {
+	env, err := common.CollectEnv(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.server.checkEnv(pkgDir, env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported uri: %s", uri)
+	}
+	path := u.Path
+	// the windows path is like `/C:/path/to/file`. `/C:` can't be the root directory on the other platforms in practice.
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' && unicode.IsLetter(rune(path[1])) {
+		path = path[1:]
+	}
+	return filepath.Clean(filepath.FromSlash(path)), nil
+}
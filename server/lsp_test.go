@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+type lspTestClient struct {
+	in     io.WriteCloser
+	out    *bufio.Reader
+	nextID int
+	errCh  chan error
+}
+
+func newLSPTestClient(s *Server, opts ...func(*LSPServer)) *lspTestClient {
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	c := &lspTestClient{in: inWriter, out: bufio.NewReader(outReader), errCh: make(chan error, 1)}
+	lspServer := NewLSPServer(s, inReader, outWriter)
+	for _, opt := range opts {
+		opt(lspServer)
+	}
+	go func() {
+		c.errCh <- lspServer.Serve(context.Background())
+		outWriter.Close()
+	}()
+	return c
+}
+
+func (c *lspTestClient) send(id int, method string, params interface{}) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	if id != 0 {
+		msg["id"] = id
+	}
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+// request sends the request and returns the response. The notifications before the response are also returned.
+func (c *lspTestClient) request(t *testing.T, method string, params interface{}) (map[string]interface{}, []map[string]interface{}) {
+	c.nextID++
+	c.send(c.nextID, method, params)
+
+	var notifications []map[string]interface{}
+	for {
+		header, err := textproto.NewReader(c.out).ReadMIMEHeader()
+		if err != nil {
+			t.Fatalf("failed to read the header: %v", err)
+		}
+		length, _ := strconv.Atoi(header.Get("Content-Length"))
+		body := make([]byte, length)
+		if _, err := io.ReadFull(c.out, body); err != nil {
+			t.Fatalf("failed to read the body: %v", err)
+		}
+
+		var msg map[string]interface{}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatalf("failed to decode the message: %v", err)
+		}
+		if id, ok := msg["id"]; ok && id == float64(c.nextID) {
+			return msg, notifications
+		}
+		notifications = append(notifications, msg)
+	}
+}
+
+func (c *lspTestClient) notify(method string, params interface{}) {
+	c.send(0, method, params)
+}
+
+func TestLSPServer(t *testing.T) {
+	server := NewServer("")
+	client := newLSPTestClient(server)
+
+	resp, _ := client.request(t, "initialize", map[string]interface{}{})
+	if resp["error"] != nil {
+		t.Fatalf("unexpected error: %v", resp["error"])
+	}
+
+	curr, _ := os.Getwd()
+	dirPath := filepath.Join(curr, "testdata", "typical")
+	path := filepath.Join(dirPath, "sum_test.go")
+	content, _ := ioutil.ReadFile(path)
+	uri := "file://" + filepath.ToSlash(path)
+	client.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri, "text": string(content)}})
+
+	resp, _ = client.request(t, "textDocument/codeLens", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri}})
+	lenses := resp["result"].([]interface{})
+	if title := lenses[0].(map[string]interface{})["command"].(map[string]interface{})["title"]; title != "run 0 affected tests" {
+		t.Errorf("unexpected title: %v", title)
+	}
+
+	// insert the new line to the body of `TestSum`.
+	client.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []interface{}{
+			map[string]interface{}{"range": map[string]interface{}{"start": map[string]int{"line": 6, "character": 28}, "end": map[string]int{"line": 6, "character": 28}}, "text": "\n\t_ = 1"},
+		},
+	})
+
+	resp, _ = client.request(t, "textDocument/codeLens", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri}})
+	lenses = resp["result"].([]interface{})
+	if title := lenses[0].(map[string]interface{})["command"].(map[string]interface{})["title"]; title != "run 1 affected test" {
+		t.Errorf("unexpected title: %v", title)
+	}
+	changes := server.changeManager.Find(dirPath)
+	if len(changes) != 1 || changes[0] != (Change{"sum_test.go", 88, 94}) {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+	if overlay := server.changeManager.FindOverlays(); !strings.Contains(string(overlay[path]), "\t_ = 1") {
+		t.Errorf("wrong overlay: %s", overlay[path])
+	}
+
+	resp, notifications := client.request(t, "workspace/executeCommand", map[string]interface{}{"command": LSPCommandRunTests, "arguments": []string{dirPath}})
+	if resp["error"] != nil {
+		t.Fatalf("unexpected error: %v", resp["error"])
+	}
+	var messages []string
+	for _, n := range notifications {
+		messages = append(messages, n["params"].(map[string]interface{})["message"].(string))
+	}
+	if !strings.Contains(strings.Join(messages, "\n"), "tests passed: "+dirPath) {
+		t.Errorf("unexpected messages: %v", messages)
+	}
+	if changes := server.changeManager.Find(dirPath); len(changes) != 0 {
+		t.Errorf("the changes are not deleted: %#v", changes)
+	}
+
+	client.notify("textDocument/didClose", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri}})
+	resp, _ = client.request(t, "unknown", nil)
+	if resp["error"] == nil {
+		t.Errorf("nil error")
+	}
+	if overlay := server.changeManager.FindOverlays(); len(overlay) != 0 {
+		t.Errorf("the overlay is not deleted: %v", overlay)
+	}
+
+	client.request(t, "shutdown", nil)
+	client.notify("exit", nil)
+	if err := <-client.errCh; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLSPServer_MultipleChanges(t *testing.T) {
+	server := NewServer("")
+	client := newLSPTestClient(server)
+
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sum.go")
+	if err := ioutil.WriteFile(path, []byte("package sum\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uri := "file://" + filepath.ToSlash(path)
+	client.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri, "text": "package sum\n"}})
+
+	// the range of the second change is based on the content after the first change.
+	client.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []interface{}{
+			map[string]interface{}{"range": map[string]interface{}{"start": map[string]int{"line": 1, "character": 0}, "end": map[string]int{"line": 1, "character": 0}}, "text": "var a = 1\n"},
+			map[string]interface{}{"range": map[string]interface{}{"start": map[string]int{"line": 0, "character": 0}, "end": map[string]int{"line": 0, "character": 0}}, "text": "// doc\n"},
+		},
+	})
+	client.request(t, "unknown", nil)
+
+	changes := server.changeManager.Find(dir)
+	if len(changes) != 2 || changes[0] != (Change{"sum.go", 12, 21}) || changes[1] != (Change{"sum.go", 0, 6}) {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+	if overlay := server.changeManager.FindOverlays(); string(overlay[path]) != "// doc\npackage sum\nvar a = 1\n" {
+		t.Errorf("wrong overlay: %q", overlay[path])
+	}
+
+	client.request(t, "shutdown", nil)
+	client.notify("exit", nil)
+	<-client.errCh
+}
+
+func TestLSPServer_ForwardHint(t *testing.T) {
+	server := NewServer("")
+	var forwarded []common.Range
+	var forwardedContent string
+	client := newLSPTestClient(server, func(l *LSPServer) {
+		l.ForwardHint = func(path string, r common.Range, content string) {
+			forwarded = append(forwarded, r)
+			forwardedContent = content
+		}
+	})
+
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sum.go")
+	if err := ioutil.WriteFile(path, []byte("package sum\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uri := "file://" + filepath.ToSlash(path)
+	client.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri, "text": "package sum\n"}})
+	client.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []interface{}{
+			map[string]interface{}{"range": map[string]interface{}{"start": map[string]int{"line": 1, "character": 0}, "end": map[string]int{"line": 1, "character": 0}}, "text": "var a = 1\n"},
+		},
+	})
+	client.request(t, "unknown", nil)
+
+	if len(forwarded) != 1 || forwarded[0] != (common.Range{Begin: 12, End: 21}) {
+		t.Errorf("wrong forwarded hints: %#v", forwarded)
+	}
+	if forwardedContent != "package sum\nvar a = 1\n" {
+		t.Errorf("wrong forwarded content: %q", forwardedContent)
+	}
+
+	client.request(t, "shutdown", nil)
+	client.notify("exit", nil)
+	<-client.errCh
+}
+
+func TestURIToPath(t *testing.T) {
+	for i, testdata := range []struct {
+		uri    string
+		expect string
+	}{
+		{"file:///path/to/sum.go", filepath.FromSlash("/path/to/sum.go")},
+		{"file:///path/to/a%20b.go", filepath.FromSlash("/path/to/a b.go")},
+		{"file:///C:/path/to/sum.go", filepath.FromSlash("C:/path/to/sum.go")},
+		{"file:///c%3A/path/to/sum.go", filepath.FromSlash("c:/path/to/sum.go")},
+	} {
+		actual, err := uriToPath(testdata.uri)
+		if err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if actual != testdata.expect {
+			t.Errorf("[%d] unexpected path: %s", i, actual)
+		}
+	}
+	if _, err := uriToPath("untitled:Untitled-1"); err == nil {
+		t.Errorf("nil error")
+	}
+}
+
+func TestFindChangedRange(t *testing.T) {
+	for i, testdata := range []struct {
+		oldContent, newContent string
+		expect                 common.Range
+	}{
+		{"abc", "abc", common.Range{Begin: 3, End: 3}},
+		{"abc", "aXc", common.Range{Begin: 1, End: 1}},
+		{"abc", "aXYbc", common.Range{Begin: 1, End: 2}},
+		{"abc", "ac", common.Range{Begin: 1, End: 1}},
+		{"abc", "abcd", common.Range{Begin: 3, End: 3}},
+		{"aa", "aaa", common.Range{Begin: 2, End: 2}},
+	} {
+		actual := findChangedRange([]byte(testdata.oldContent), []byte(testdata.newContent))
+		if actual != testdata.expect {
+			t.Errorf("[%d] unexpected range: %#v", i, actual)
+		}
+	}
+}
+
+func TestLSPOffset(t *testing.T) {
+	content := []byte("ab\n𝑥y\n")
+	for i, testdata := range []struct {
+		pos    lspPosition
+		expect int64
+	}{
+		{lspPosition{0, 0}, 0},
+		{lspPosition{0, 2}, 2},
+		{lspPosition{1, 2}, 7},
+		{lspPosition{1, 3}, 8},
+		{lspPosition{2, 0}, 9},
+	} {
+		if actual := lspOffset(content, testdata.pos); actual != testdata.expect {
+			t.Errorf("[%d] unexpected offset: %d", i, actual)
+		}
+	}
+}
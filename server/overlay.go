@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// newOverlayContext returns the copy of the build context which reads the file contents from the overlay
+// instead of the disk. The key of the overlay is the abs path of the file.
+func newOverlayContext(ctxt *build.Context, overlay map[string][]byte) *build.Context {
+	c := *ctxt
+	if len(overlay) == 0 {
+		return &c
+	}
+
+	c.OpenFile = func(path string) (io.ReadCloser, error) {
+		if content, ok := overlay[filepath.Clean(path)]; ok {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		}
+		return os.Open(path)
+	}
+	c.ReadDir = func(dir string) ([]os.FileInfo, error) {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		// the file may be not saved yet.
+		dir = filepath.Clean(dir)
+		var result []os.FileInfo
+		added := make(map[string]struct{})
+		for path, content := range overlay {
+			if filepath.Dir(path) == dir {
+				result = append(result, overlayFileInfo{name: filepath.Base(path), size: int64(len(content))})
+				added[filepath.Base(path)] = struct{}{}
+			}
+		}
+		if len(result) == 0 && err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if _, ok := added[fi.Name()]; !ok {
+				result = append(result, fi)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+		return result, nil
+	}
+	return &c
+}
+
+// readFile reads the file using the build context. The overlay is respected if the context is returned by `newOverlayContext`.
+func readFile(ctxt *build.Context, path string) ([]byte, error) {
+	if ctxt == nil || ctxt.OpenFile == nil {
+		return ioutil.ReadFile(path)
+	}
+
+	f, err := ctxt.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// readDir reads the directory using the build context. The overlay is respected if the context is returned by `newOverlayContext`.
+func readDir(ctxt *build.Context, dirPath string) ([]os.FileInfo, error) {
+	if ctxt == nil || ctxt.ReadDir == nil {
+		return ioutil.ReadDir(dirPath)
+	}
+	return ctxt.ReadDir(dirPath)
+}
+
+// overlayFileInfo is the file info of the file in the overlay.
+type overlayFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi overlayFileInfo) Name() string       { return fi.name }
+func (fi overlayFileInfo) Size() int64        { return fi.size }
+func (fi overlayFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi overlayFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi overlayFileInfo) IsDir() bool        { return false }
+func (fi overlayFileInfo) Sys() interface{}   { return nil }
+
+// writeOverlayFile writes the overlay in the format of the `-overlay` option of the go command.
+// It returns the path of the overlay file. The caller must remove the `tempDir` after use.
+func writeOverlayFile(overlay map[string][]byte) (overlayPath, tempDir string, err error) {
+	tempDir, err = ioutil.TempDir("", "noisegate-overlay")
+	if err != nil {
+		return "", "", err
+	}
+
+	replace := make(map[string]string)
+	i := 0
+	for path, content := range overlay {
+		replacePath := filepath.Join(tempDir, fmt.Sprintf("%d_%s", i, filepath.Base(path)))
+		if err := ioutil.WriteFile(replacePath, content, 0600); err != nil {
+			os.RemoveAll(tempDir)
+			return "", "", err
+		}
+		replace[path] = replacePath
+		i++
+	}
+
+	data, err := json.Marshal(struct{ Replace map[string]string }{replace})
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", "", err
+	}
+	overlayPath = filepath.Join(tempDir, "overlay.json")
+	if err := ioutil.WriteFile(overlayPath, data, 0600); err != nil {
+		os.RemoveAll(tempDir)
+		return "", "", err
+	}
+	return overlayPath, tempDir, nil
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultDeniedOptions are the go test options the clients can't specify by default. `-exec` and `-toolexec` execute
+// the commands, and `-o` and `-c` write the test binary. The options which pass the flags to the compiler or the linker can
+// execute the commands too (e.g. `-ldflags=-extld=...`), and `-overlay` and `-modfile` read the files which may be outside
+// the allowed roots. The other options are allowed, but the file path in the value must be under the allowed roots (see `pathOptions`).
+var DefaultDeniedOptions = []string{
+	"exec", "toolexec", "o", "c",
+	"ldflags", "gcflags", "asmflags", "gccgoflags", "compiler", "overlay", "modfile",
+}
+
+// DefaultAllowedEnv are the environment variables the clients can send by default. They change how the go command
+// builds the package, but can't make it execute arbitrary commands or read the files outside the allowed roots,
+// unlike `CC`, `CGO_LDFLAGS`, `PATH`, `GOROOT`, `GOTOOLCHAIN` and `GOENV` for example. The variables which change where
+// and how the modules are downloaded are not included either, because `GOPROXY=file:///...` reads any directory and
+// `GOSUMDB`, `GONOSUMDB`, `GOPRIVATE` and `GOINSECURE` skip the checksum verification.
+var DefaultAllowedEnv = []string{
+	"GOFLAGS", "GOOS", "GOARCH", "CGO_ENABLED", "GOEXPERIMENT", "GOWORK", "GO111MODULE", "GODEBUG",
+	"GO386", "GOAMD64", "GOARM", "GOARM64", "GOMIPS", "GOMIPS64", "GOPPC64", "GORISCV64", "GOWASM",
+}
+
+// valueOptions are the go test options which take the value. The value may be the next arg, like `-run TestSum`.
+var valueOptions = map[string]bool{
+	"run": true, "skip": true, "count": true, "cpu": true, "parallel": true, "timeout": true, "shuffle": true,
+	"list": true, "bench": true, "benchtime": true, "covermode": true, "coverpkg": true, "vet": true,
+	"tags": true, "mod": true, "p": true, "o": true, "exec": true, "toolexec": true, "overlay": true,
+	"modfile": true, "pkgdir": true, "gcflags": true, "ldflags": true, "asmflags": true, "gccgoflags": true,
+	"compiler": true, "buildmode": true, "installsuffix": true, "coverprofile": true, "cpuprofile": true,
+	"memprofile": true, "memprofilerate": true, "blockprofile": true, "blockprofilerate": true,
+	"mutexprofile": true, "mutexprofilefraction": true, "trace": true, "outputdir": true,
+	"fuzz": true, "fuzztime": true, "fuzzminimizetime": true, "pgo": true,
+}
+
+// pathOptions are the go test options whose value is the file path. If such an option is not denied, the path must
+// be under the allowed roots. The relative path is resolved from the package directory.
+var pathOptions = map[string]bool{
+	"o": true, "overlay": true, "modfile": true, "pkgdir": true, "coverprofile": true, "cpuprofile": true,
+	"memprofile": true, "blockprofile": true, "mutexprofile": true, "trace": true, "outputdir": true, "pgo": true,
+}
+
+// checkPath returns the error if the path is not under any of the allowed roots. Any path is allowed if no root is specified.
+// The symbolic links are resolved to prevent escaping from the roots.
+func (s *Server) checkPath(path string) error {
+	if len(s.AllowedRoots) == 0 {
+		return nil
+	}
+
+	resolvedPath := resolvePath(path)
+	for _, root := range s.AllowedRoots {
+		if inWorkspace(resolvePath(root), resolvedPath) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the path is not under the allowed roots: %s", path)
+}
+
+// resolvePath resolves the symbolic links in the path. The path may not exist (e.g. the unsaved file), so
+// its ancestor directories are resolved in that case.
+func resolvePath(path string) string {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+
+	dir := filepath.Dir(path)
+	if dir == path {
+		return path
+	}
+	return filepath.Join(resolvePath(dir), filepath.Base(path))
+}
+
+// checkGoTestOptions returns the error if the options include the denied option, in any form like `-o`, `--o`,
+// `-o=file` and `-test.o`, or the package to test. The options after `-args` are passed to the test binary, so only
+// the test flags (e.g. `-test.coverprofile`) are checked.
+// `dirPath` is the package directory, from which the relative path in the option value is resolved.
+func (s *Server) checkGoTestOptions(dirPath string, opts []string) error {
+	args := false
+	for i := 0; i < len(opts); i++ {
+		opt := opts[i]
+		if !args && (opt == "-args" || opt == "--args") {
+			args = true
+			continue
+		}
+		if args && !strings.HasPrefix(strings.TrimLeft(opt, "-"), "test.") {
+			continue
+		}
+		if !strings.HasPrefix(opt, "-") || opt == "-" || opt == "--" {
+			return fmt.Errorf("the package can't be specified in the go test options: %s", opt)
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(opt, "-"), "-")
+		name = strings.TrimPrefix(name, "test.")
+		value, hasValue := "", false
+		if i := strings.Index(name, "="); i != -1 {
+			name, value, hasValue = name[:i], name[i+1:], true
+		}
+		if s.isDeniedOption(name) {
+			return fmt.Errorf("the go test option is not allowed: %s", opt)
+		}
+		if valueOptions[name] && !hasValue && i+1 < len(opts) {
+			i++
+			value = opts[i]
+		}
+		if pathOptions[name] && value != "" {
+			if !filepath.IsAbs(value) {
+				value = filepath.Join(dirPath, value)
+			}
+			if err := s.checkPath(value); err != nil {
+				return fmt.Errorf("the go test option %s: %w", opt, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) isDeniedOption(name string) bool {
+	for _, denied := range s.DeniedOptions {
+		if name == denied {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEnv returns the error if the environment variables include the variable not allowed, or GOFLAGS includes
+// the denied option. The go command applies GOFLAGS like the command line options, so they are checked in the same way.
+// GOWORK must be `off` or the path under the allowed roots.
+func (s *Server) checkEnv(dirPath string, env map[string]string) error {
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !s.isAllowedEnv(key) {
+			return fmt.Errorf("the environment variable is not allowed: %s", key)
+		}
+	}
+
+	if goFlags, ok := env["GOFLAGS"]; ok {
+		if err := s.checkGoTestOptions(dirPath, strings.Fields(goFlags)); err != nil {
+			return fmt.Errorf("%w (in GOFLAGS)", err)
+		}
+	}
+	if goWork := env["GOWORK"]; goWork != "" && goWork != "off" {
+		if !filepath.IsAbs(goWork) {
+			return fmt.Errorf("GOWORK must be abs: %s", goWork)
+		}
+		if err := s.checkPath(goWork); err != nil {
+			return fmt.Errorf("%w (in GOWORK)", err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) isAllowedEnv(key string) bool {
+	for _, allowed := range s.AllowedEnv {
+		if key == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPolicy checks the path, the go test options and the environment variables.
+// The path is the package directory or the file in the package.
+func (s *Server) checkPolicy(path string, opts []string, env map[string]string) error {
+	if err := s.checkPath(path); err != nil {
+		return err
+	}
+	dirPath := path
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		dirPath = filepath.Dir(path)
+	}
+	if err := s.checkGoTestOptions(dirPath, opts); err != nil {
+		return err
+	}
+	return s.checkEnv(dirPath, env)
+}
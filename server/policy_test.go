@@ -0,0 +1,253 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+func TestCheckGoTestOptions(t *testing.T) {
+	server := NewServer("")
+	server.AllowedRoots = []string{"/path/to"}
+	for i, testdata := range []struct {
+		opts   []string
+		denied bool
+	}{
+		{nil, false},
+		{[]string{"-v", "-run", "TestSum", "-cover", "-count=1"}, false},
+		{[]string{"-test.v", "-test.run=TestSum"}, false},
+		{[]string{"-json", "-shuffle=on", "-coverprofile=cover.out"}, false},
+		{[]string{"-exec", "sudo"}, true},
+		{[]string{"--exec", "sudo"}, true},
+		{[]string{"-toolexec=/bin/evil"}, true},
+		{[]string{"-ldflags=-linkmode=external -extld=/bin/evil"}, true},
+		{[]string{"-gcflags", "all=-N"}, true},
+		{[]string{"-overlay=/tmp/overlay.json"}, true},
+		{[]string{"-coverprofile", "/etc/passwd"}, true},
+		{[]string{"-test.coverprofile=/etc/passwd"}, true},
+		{[]string{"-o", "/etc/passwd"}, true},
+		{[]string{"-c"}, true},
+		{[]string{"-pgo=/etc/default.pgo"}, true},
+		{[]string{"-v", "../other"}, true},
+		{[]string{"-v", "-args", "-exec", "arg"}, false},
+		{[]string{"-v", "-args", "-test.cpuprofile=/etc/passwd"}, true},
+	} {
+		err := server.checkGoTestOptions("/path/to/pkg", testdata.opts)
+		if (err != nil) != testdata.denied {
+			t.Errorf("[%d] unexpected result: %v, %v", i, testdata.opts, err)
+		}
+	}
+
+	server.DeniedOptions = []string{"v"}
+	if err := server.checkGoTestOptions("/path/to/pkg", []string{"-exec", "sudo"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := server.checkGoTestOptions("/path/to/pkg", []string{"-v"}); err == nil {
+		t.Errorf("nil error")
+	}
+}
+
+func TestCheckGoTestOptions_PathOutsideRoots(t *testing.T) {
+	server := NewServer("")
+	server.AllowedRoots = []string{"/path/to"}
+
+	for i, testdata := range []struct {
+		opts   []string
+		denied bool
+	}{
+		{[]string{"-coverprofile=cover.out"}, false},
+		{[]string{"-coverprofile", "/path/to/cover.out"}, false},
+		{[]string{"-coverprofile", "../../../etc/passwd"}, true},
+		{[]string{"-coverprofile=/etc/passwd"}, true},
+	} {
+		err := server.checkGoTestOptions("/path/to/pkg", testdata.opts)
+		if (err != nil) != testdata.denied {
+			t.Errorf("[%d] unexpected result: %v, %v", i, testdata.opts, err)
+		}
+	}
+}
+
+func TestCheckEnv(t *testing.T) {
+	server := NewServer("")
+	for i, testdata := range []struct {
+		env     map[string]string
+		allowed bool
+	}{
+		{nil, true},
+		{map[string]string{"CGO_ENABLED": "0"}, true},
+		{map[string]string{"GOFLAGS": "-mod=vendor -tags=integration"}, true},
+		{map[string]string{"GOFLAGS": "-exec=sudo"}, false},
+		{map[string]string{"GOFLAGS": "-mod=mod --toolexec=/bin/evil"}, false},
+		{map[string]string{"CC": "/bin/evil"}, false},
+		{map[string]string{"CGO_LDFLAGS": "-fuse-ld=/bin/evil"}, false},
+		{map[string]string{"LD_PRELOAD": "/tmp/evil.so"}, false},
+		{map[string]string{"GOENV": "/tmp/go.env"}, false},
+		{map[string]string{"DATABASE_URL": "postgres://localhost"}, false},
+		{map[string]string{"GOWORK": "off"}, true},
+		{map[string]string{"GOWORK": "go.work"}, false},
+		{map[string]string{"GOPROXY": "file:///etc"}, false},
+		{map[string]string{"GONOSUMDB": "*"}, false},
+	} {
+		err := server.checkEnv("/path/to/pkg", testdata.env)
+		if testdata.allowed && err != nil {
+			t.Errorf("[%d] unexpected error: %v", i, err)
+		} else if !testdata.allowed && err == nil {
+			t.Errorf("[%d] not denied", i)
+		}
+	}
+}
+
+func TestCheckEnv_AllowedByServer(t *testing.T) {
+	server := NewServer("")
+	server.AllowedRoots = []string{"/path/to"}
+	server.AllowedEnv = append(DefaultAllowedEnv, "DATABASE_URL")
+
+	if err := server.checkEnv("/path/to/pkg", map[string]string{"DATABASE_URL": "postgres://localhost"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := server.checkEnv("/path/to/pkg", map[string]string{"GOWORK": "/path/to/go.work"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := server.checkEnv("/path/to/pkg", map[string]string{"GOWORK": "/tmp/go.work"}); err == nil {
+		t.Errorf("nil error")
+	}
+}
+
+func TestCheckEnv_CollectedEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldGoFlags, ok := os.LookupEnv("GOFLAGS")
+	if ok {
+		defer os.Setenv("GOFLAGS", oldGoFlags)
+	} else {
+		defer os.Unsetenv("GOFLAGS")
+	}
+	os.Setenv("GOFLAGS", "-exec=sudo")
+
+	// GOFLAGS is not sent by default, so the denied option in it doesn't reject the request.
+	server := NewServer("")
+	env, err := common.CollectEnv(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.checkEnv(dir, env); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, common.ConfigFileName), []byte("env: [GOFLAGS]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env, err = common.CollectEnv(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.checkEnv(dir, env); err == nil {
+		t.Errorf("nil error")
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	other := filepath.Join(dir, "other")
+	os.MkdirAll(filepath.Join(root, "pkg"), 0755)
+	os.MkdirAll(other, 0755)
+	if err := os.Symlink(other, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer("")
+	if err := server.checkPath(other); err != nil {
+		t.Errorf("any path should be allowed without roots: %v", err)
+	}
+
+	server.AllowedRoots = []string{root}
+	for _, testdata := range []struct {
+		path    string
+		allowed bool
+	}{
+		{root, true},
+		{filepath.Join(root, "pkg"), true},
+		{filepath.Join(root, "pkg", "unsaved.go"), true},
+		{other, false},
+		{filepath.Join(root, "link"), false},
+		{filepath.Join(root, "..", "other"), false},
+	} {
+		err := server.checkPath(testdata.path)
+		if (err == nil) != testdata.allowed {
+			t.Errorf("unexpected result: %s, %v", testdata.path, err)
+		}
+	}
+}
+
+func TestHandleTest_Forbidden(t *testing.T) {
+	server := NewServer("")
+	curr, _ := os.Getwd()
+	dirPath := filepath.Join(curr, "testdata", "typical")
+
+	for _, body := range []string{
+		fmt.Sprintf(`{"path": "%s", "go_test_options": ["-exec", "sudo"]}`, dirPath),
+		fmt.Sprintf(`{"path": "%s", "go_test_options": ["-toolexec=/bin/evil"]}`, dirPath),
+		fmt.Sprintf(`{"path": "%s", "env": {"GOFLAGS": "-mod=mod -toolexec=/bin/evil"}}`, dirPath),
+		fmt.Sprintf(`{"path": "%s", "env": {"CC": "/bin/evil"}}`, dirPath),
+	} {
+		req := httptest.NewRequest("GET", common.TestPath, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		server.handleTest(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("unexpected code: %d", w.Code)
+		}
+	}
+
+	server.AllowedRoots = []string{filepath.Join(curr, "testdata", "embed")}
+	req := httptest.NewRequest("GET", common.TestPath, strings.NewReader(fmt.Sprintf(`{"path": "%s"}`, dirPath)))
+	w := httptest.NewRecorder()
+	server.handleTest(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "not under the allowed roots") {
+		t.Errorf("unexpected body: %s", w.Body.String())
+	}
+}
+
+func TestHandleEvents_Forbidden(t *testing.T) {
+	server := NewServer("")
+	curr, _ := os.Getwd()
+	server.AllowedRoots = []string{filepath.Join(curr, "testdata", "embed")}
+
+	req := httptest.NewRequest("GET", common.EventsPath+"?workspace="+filepath.Join(curr, "testdata", "typical"), nil)
+	w := httptest.NewRecorder()
+	server.handleEvents(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+}
+
+func TestHandleHint_Forbidden(t *testing.T) {
+	server := NewServer("")
+	curr, _ := os.Getwd()
+	server.AllowedRoots = []string{filepath.Join(curr, "testdata", "embed")}
+
+	path := filepath.Join(curr, "testdata", "typical", "sum.go")
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin": 1, "end": 2}]}`, path)))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+}
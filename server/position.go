@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+// toOffsetRanges converts the line-based ranges to the byte offset ranges using the file content.
+// The ranges specified by the byte offsets are returned as they are.
+// The end of the range is inclusive, same as the byte offset ranges.
+func toOffsetRanges(content []byte, ranges []common.Range, columnUnit string) ([]common.Range, error) {
+	if columnUnit != "" && columnUnit != common.ColumnUnitByte && columnUnit != common.ColumnUnitUTF16 {
+		return nil, fmt.Errorf("unknown column unit: %s", columnUnit)
+	}
+
+	lineStarts := findLineStarts(content)
+	var rs []common.Range
+	for _, r := range ranges {
+		if !r.IsLineBased() {
+			rs = append(rs, r)
+			continue
+		}
+		if r.EndLine == 0 {
+			return nil, errors.New("the end line is not specified")
+		}
+
+		begin, err := toOffset(content, lineStarts, r.BeginLine, r.BeginColumn, columnUnit, false)
+		if err != nil {
+			return nil, err
+		}
+		end, err := toOffset(content, lineStarts, r.EndLine, r.EndColumn, columnUnit, true)
+		if err != nil {
+			return nil, err
+		}
+		if begin > end {
+			return nil, fmt.Errorf("invalid range: %s", common.RangesToQuery([]common.Range{r}))
+		}
+		rs = append(rs, common.Range{Begin: begin, End: end})
+	}
+	return rs, nil
+}
+
+// findLineStarts returns the offsets of the beginning of each line.
+func findLineStarts(content []byte) []int64 {
+	lineStarts := []int64{0}
+	for i, b := range content {
+		if b == '\n' && i+1 < len(content) {
+			lineStarts = append(lineStarts, int64(i+1))
+		}
+	}
+	return lineStarts
+}
+
+// toOffset converts the 1-based line and column to the byte offset.
+// The column 0 means the beginning of the line, or the end of the line if `isEnd` is true.
+// The column beyond the end of the line is treated as the end of the line.
+func toOffset(content []byte, lineStarts []int64, line, column int, columnUnit string, isEnd bool) (int64, error) {
+	if line <= 0 || line > len(lineStarts) {
+		return 0, fmt.Errorf("line %d is out of range", line)
+	} else if column < 0 {
+		return 0, fmt.Errorf("invalid column: %d", column)
+	}
+
+	lineStart := lineStarts[line-1]
+	lineEnd := int64(len(content))
+	if line < len(lineStarts) {
+		lineEnd = lineStarts[line] - 1 // the offset of '\n'
+	}
+	if lineEnd < lineStart {
+		// the empty file
+		return lineStart, nil
+	}
+
+	if column == 0 {
+		if isEnd {
+			return lineEnd, nil
+		}
+		return lineStart, nil
+	}
+
+	lineContent := content[lineStart:lineEnd]
+	if columnUnit != common.ColumnUnitUTF16 {
+		if int64(column-1) >= int64(len(lineContent)) {
+			return lineEnd, nil
+		}
+		return lineStart + int64(column-1), nil
+	}
+
+	units := 0
+	for i := 0; i < len(lineContent); {
+		r, size := utf8.DecodeRune(lineContent[i:])
+		n := 1
+		if r > 0xffff {
+			// encoded as the surrogate pair
+			n = 2
+		}
+		if units+n >= column {
+			return lineStart + int64(i), nil
+		}
+		units += n
+		i += size
+	}
+	return lineEnd, nil
+}
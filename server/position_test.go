@@ -0,0 +1,47 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+func TestToOffsetRanges(t *testing.T) {
+	// "𝑥" is 4 bytes in utf-8 and 2 units in utf-16.
+	content := []byte("ab\nあい\n𝑥y\n")
+	for i, testdata := range []struct {
+		input      common.Range
+		columnUnit string
+		expect     common.Range
+		err        bool
+	}{
+		{common.Range{Begin: 1, End: 2}, "", common.Range{Begin: 1, End: 2}, false},
+		{common.Range{BeginLine: 1, EndLine: 1}, "", common.Range{Begin: 0, End: 2}, false},
+		{common.Range{BeginLine: 1, EndLine: 2}, "", common.Range{Begin: 0, End: 9}, false},
+		{common.Range{BeginLine: 2, BeginColumn: 4, EndLine: 2, EndColumn: 4}, common.ColumnUnitByte, common.Range{Begin: 6, End: 6}, false},
+		{common.Range{BeginLine: 2, BeginColumn: 2, EndLine: 2, EndColumn: 2}, common.ColumnUnitUTF16, common.Range{Begin: 6, End: 6}, false},
+		{common.Range{BeginLine: 3, BeginColumn: 3, EndLine: 3, EndColumn: 3}, common.ColumnUnitUTF16, common.Range{Begin: 14, End: 14}, false},
+		{common.Range{BeginLine: 3, BeginColumn: 2, EndLine: 3, EndColumn: 2}, common.ColumnUnitUTF16, common.Range{Begin: 10, End: 10}, false},
+		{common.Range{BeginLine: 1, BeginColumn: 100, EndLine: 1, EndColumn: 100}, "", common.Range{Begin: 2, End: 2}, false},
+		{common.Range{BeginLine: 2, EndLine: 1}, "", common.Range{}, true},
+		{common.Range{BeginLine: 4, EndLine: 4}, "", common.Range{}, true},
+		{common.Range{BeginLine: 1}, "", common.Range{}, true},
+		{common.Range{BeginLine: 1, EndLine: 1}, "rune", common.Range{}, true},
+	} {
+		actual, err := toOffsetRanges(content, []common.Range{testdata.input}, testdata.columnUnit)
+		if err != nil {
+			if !testdata.err {
+				t.Errorf("[%d] unexpected error: %v", i, err)
+			}
+			continue
+		} else if testdata.err {
+			t.Errorf("[%d] not error", i)
+			continue
+		}
+
+		if !reflect.DeepEqual([]common.Range{testdata.expect}, actual) {
+			t.Errorf("[%d] unexpected ranges: %#v", i, actual)
+		}
+	}
+}
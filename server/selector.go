@@ -0,0 +1,343 @@
+package server
+
+import (
+	"fmt"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-noisegate/noisegate/common"
+	"github.com/go-noisegate/noisegate/common/log"
+)
+
+// Selector selects the test functions to run. See `NewSelector` for the built-in selectors.
+// The selector of other packages can explain the selection by `NewSelectionInfluence`.
+type Selector interface {
+	// Select returns the influences, which explain why the test functions are selected.
+	Select(in SelectorInput) ([]Influence, error)
+}
+
+// SelectorInput is the information of the job the selector uses. The job fills all the fields, including the
+// unexported ones only the built-in selectors use.
+type SelectorInput struct {
+	// The abs path of the package directory.
+	DirPath string
+	// The changes of the package since the last successful job.
+	Changes []Change
+	// All the test functions in the package.
+	TestFunctions []string
+	// The test functions which failed before and haven't passed since.
+	FailedTests []string
+	// how the package is built. The built-in selectors analyze the package in the same way.
+	conf buildConfig
+}
+
+// NewSelector returns the selector of the spec, which is the names of the built-in selectors joined with `+`,
+// like `influenced+failed`. The composed selector selects the test functions any of the selectors selects.
+// See `common.SelectorAll` and so on for the names.
+func NewSelector(spec string) (Selector, error) {
+	var selectors unionSelector
+	for _, name := range strings.Split(spec, "+") {
+		switch strings.TrimSpace(name) {
+		case common.SelectorAll:
+			selectors = append(selectors, allSelector{})
+		case common.SelectorNone:
+			selectors = append(selectors, noneSelector{})
+		case common.SelectorInfluenced:
+			selectors = append(selectors, influencedSelector{})
+		case common.SelectorCoverage:
+			selectors = append(selectors, coverageSelector{})
+		case common.SelectorFailed:
+			selectors = append(selectors, failedSelector{})
+		case common.SelectorChangedFiles:
+			selectors = append(selectors, changedFilesSelector{})
+		default:
+			return nil, fmt.Errorf("unknown selector: %s", name)
+		}
+	}
+	if len(selectors) == 1 {
+		return selectors[0], nil
+	}
+	return selectors, nil
+}
+
+// unionSelector selects the test functions any of the selectors selects.
+type unionSelector []Selector
+
+func (s unionSelector) Select(in SelectorInput) ([]Influence, error) {
+	var ins []Influence
+	for _, selector := range s {
+		selectorIns, err := selector.Select(in)
+		if err != nil {
+			return nil, err
+		}
+		ins = append(ins, selectorIns...)
+	}
+	return ins, nil
+}
+
+// containsSelector returns true if the selector or any selector in the union matches.
+func containsSelector(selector Selector, match func(Selector) bool) bool {
+	if s, ok := selector.(unionSelector); ok {
+		for _, sub := range s {
+			if containsSelector(sub, match) {
+				return true
+			}
+		}
+		return false
+	}
+	return match(selector)
+}
+
+// isAllSelector returns true if the selector is `allSelector`.
+func isAllSelector(selector Selector) bool {
+	_, ok := selector.(allSelector)
+	return ok
+}
+
+// changeSelector returns the selector which selects only the test functions affected by the changes,
+// by removing the selectors which select the test functions regardless of the changes (`all`, `none` and `failed`).
+// It returns nil if no selector remains.
+func changeSelector(selector Selector) Selector {
+	var selectors unionSelector
+	var collect func(Selector)
+	collect = func(selector Selector) {
+		switch s := selector.(type) {
+		case unionSelector:
+			for _, sub := range s {
+				collect(sub)
+			}
+		case allSelector, noneSelector, failedSelector:
+		default:
+			selectors = append(selectors, s)
+		}
+	}
+	collect(selector)
+
+	switch len(selectors) {
+	case 0:
+		return nil
+	case 1:
+		return selectors[0]
+	default:
+		return selectors
+	}
+}
+
+// allSelector selects all the test functions regardless of the changes.
+type allSelector struct{}
+
+func (allSelector) Select(in SelectorInput) ([]Influence, error) {
+	return []Influence{NewSelectionInfluence("all tests", in.TestFunctions)}, nil
+}
+
+// noneSelector selects no test function.
+type noneSelector struct{}
+
+func (noneSelector) Select(in SelectorInput) ([]Influence, error) {
+	return nil, nil
+}
+
+// influencedSelector selects the test functions which use the changed identities. See `findInfluencedTests`.
+type influencedSelector struct{}
+
+func (influencedSelector) Select(in SelectorInput) ([]Influence, error) {
+	return findInfluencedTests(in.conf, in.DirPath, in.Changes)
+}
+
+// coverageSelector selects the test functions which covered the changed lines. See `findCoveredTests`.
+type coverageSelector struct{}
+
+func (coverageSelector) Select(in SelectorInput) ([]Influence, error) {
+	return findCoveredTests(in.conf, in.DirPath, in.Changes)
+}
+
+// failedSelector selects the test functions which failed and haven't passed since. See `withFailedSelector`.
+type failedSelector struct{}
+
+func (failedSelector) Select(in SelectorInput) ([]Influence, error) {
+	failed := make(map[string]struct{})
+	for _, testFunction := range in.FailedTests {
+		failed[testFunction] = struct{}{}
+	}
+
+	var testFunctions []string
+	for _, testFunction := range in.TestFunctions {
+		if _, ok := failed[testFunction]; ok {
+			testFunctions = append(testFunctions, testFunction)
+		}
+	}
+	if len(testFunctions) == 0 {
+		return nil, nil
+	}
+	return []Influence{NewSelectionInfluence("failed before", testFunctions)}, nil
+}
+
+// withFailedSelector returns the selector which also selects the failed test functions, so that they run in every job
+// until they pass. Otherwise, the test which failed for the reason unrelated to the recent changes is missed once
+// the changes are cleared.
+func withFailedSelector(selector Selector) Selector {
+	selectsFailed := containsSelector(selector, func(s Selector) bool {
+		switch s.(type) {
+		case allSelector, failedSelector:
+			return true
+		}
+		return false
+	})
+	if selectsFailed {
+		return selector
+	}
+	if s, ok := selector.(unionSelector); ok {
+		return append(s[:len(s):len(s)], failedSelector{})
+	}
+	return unionSelector{selector, failedSelector{}}
+}
+
+// changedFilesSelector selects the test functions in the changed test files and the test files of the changed
+// go files (e.g. `sum_test.go` for `sum.go`). It's coarse, but doesn't depend on the static analysis.
+type changedFilesSelector struct{}
+
+func (changedFilesSelector) Select(in SelectorInput) ([]Influence, error) {
+	selectable := make(map[string]struct{})
+	for _, testFunction := range in.TestFunctions {
+		selectable[testFunction] = struct{}{}
+	}
+
+	var ins []Influence
+	found := make(map[string]struct{})
+	for _, ch := range in.Changes {
+		path := ch.Basename
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(in.DirPath, path)
+		}
+		if !strings.HasSuffix(path, ".go") || filepath.Dir(path) != in.DirPath {
+			continue
+		}
+		testPath := path
+		if !strings.HasSuffix(path, "_test.go") {
+			testPath = strings.TrimSuffix(path, ".go") + "_test.go"
+		}
+		if _, ok := found[testPath]; ok {
+			continue
+		}
+		found[testPath] = struct{}{}
+
+		testFunctions, err := findTestFuncNamesInFile(in.conf, testPath)
+		if err != nil {
+			log.Debugf("no test file of %s: %v\n", path, err)
+			continue
+		}
+		id := fileIdentity{filepath.Base(path)}
+		head := chain{{id.Name(), token.Position{}}}
+		to := make(map[string]chain)
+		for _, testFunction := range testFunctions {
+			if _, ok := selectable[testFunction]; ok {
+				to[testFunction] = head.extend(testFunction, token.Position{})
+			}
+		}
+		ins = append(ins, Influence{from: id, to: to})
+	}
+	return ins, nil
+}
+
+// NewSelectionInfluence returns the influence which selects the test functions for the reason other than the change.
+func NewSelectionInfluence(reason string, testFunctions []string) Influence {
+	id := selectionIdentity{reason}
+	head := chain{{id.Name(), token.Position{}}}
+	to := make(map[string]chain)
+	for _, testFunction := range testFunctions {
+		to[testFunction] = head.extend(testFunction, token.Position{})
+	}
+	return Influence{from: id, to: to}
+}
+
+// failedTestStore keeps the test functions which failed and haven't passed since, per package.
+type failedTestStore struct {
+	failed map[string][]string
+	mtx    sync.Mutex
+}
+
+func newFailedTestStore() *failedTestStore {
+	return &failedTestStore{failed: make(map[string][]string)}
+}
+
+// find returns the failed test functions of the package.
+func (s *failedTestStore) find(dirPath string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.failed[dirPath]
+}
+
+// list returns the failed test functions of the packages under the workspace directory.
+func (s *failedTestStore) list(workspace string) []common.FailedPackage {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var pkgs []common.FailedPackage
+	for dirPath, testFunctions := range s.failed {
+		if inWorkspace(workspace, dirPath) {
+			pkgs = append(pkgs, common.FailedPackage{PackageDir: dirPath, TestFunctions: testFunctions})
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].PackageDir < pkgs[j].PackageDir })
+	return pkgs
+}
+
+// store replaces the failed test functions of the package.
+func (s *failedTestStore) store(dirPath string, testFunctions []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(testFunctions) == 0 {
+		delete(s.failed, dirPath)
+		return
+	}
+	s.failed[dirPath] = testFunctions
+}
+
+// update adds the failed test functions of the job and removes the ones which passed in the job.
+// The test functions which no longer exist in the package are also removed.
+func (s *failedTestStore) update(dirPath string, testFunctions, passed, failed []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	exists := make(map[string]struct{})
+	for _, testFunction := range testFunctions {
+		exists[testFunction] = struct{}{}
+	}
+	updated := make(map[string]struct{})
+	for _, testFunction := range s.failed[dirPath] {
+		if _, ok := exists[testFunction]; ok {
+			updated[testFunction] = struct{}{}
+		}
+	}
+	for _, testFunction := range passed {
+		delete(updated, testFunction)
+	}
+	for _, testFunction := range failed {
+		updated[testFunction] = struct{}{}
+	}
+
+	if len(updated) == 0 {
+		delete(s.failed, dirPath)
+		return
+	}
+	var result []string
+	for testFunction := range updated {
+		result = append(result, testFunction)
+	}
+	sort.Strings(result)
+	s.failed[dirPath] = result
+}
+
+// record records the test functions which failed in the job, and forgets the ones which passed.
+// Only the test functions whose pass is reported by the worker are forgotten (see `worker.TestResults`), so the test
+// function which didn't run to the end, for example because of the build error or the panic of the other test, is kept.
+func (s *failedTestStore) record(job *Job) {
+	var testFunctions []string
+	for _, t := range job.Tasks {
+		testFunctions = append(testFunctions, t.TestFunction)
+	}
+	s.update(job.DirPath, testFunctions, job.passedTests, job.failedTests)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-noisegate/noisegate/common"
+)
+
+func TestNewSelector(t *testing.T) {
+	for i, testCase := range []struct {
+		spec     string
+		expected Selector
+	}{
+		{"all", allSelector{}},
+		{"none", noneSelector{}},
+		{"influenced", influencedSelector{}},
+		{"coverage", coverageSelector{}},
+		{"failed", failedSelector{}},
+		{"changed-files", changedFilesSelector{}},
+		{"influenced + failed", unionSelector{influencedSelector{}, failedSelector{}}},
+	} {
+		selector, err := NewSelector(testCase.spec)
+		if err != nil {
+			t.Fatalf("[%d] failed to create the selector: %v", i, err)
+		}
+		if !reflect.DeepEqual(testCase.expected, selector) {
+			t.Errorf("[%d] unexpected selector: %#v", i, selector)
+		}
+	}
+
+	for _, spec := range []string{"", "unknown", "influenced+"} {
+		if _, err := NewSelector(spec); err == nil {
+			t.Errorf("nil error: %s", spec)
+		}
+	}
+}
+
+func selectedTests(ins []Influence) []string {
+	var testFunctions []string
+	for _, inf := range ins {
+		for testFunction := range inf.to {
+			testFunctions = append(testFunctions, testFunction)
+		}
+	}
+	sort.Strings(testFunctions)
+	return testFunctions
+}
+
+func TestAllSelector(t *testing.T) {
+	ins, err := allSelector{}.Select(SelectorInput{TestFunctions: []string{"TestA", "TestB"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tests := selectedTests(ins); !reflect.DeepEqual([]string{"TestA", "TestB"}, tests) {
+		t.Errorf("unexpected tests: %v", tests)
+	}
+}
+
+func TestFailedSelector(t *testing.T) {
+	in := SelectorInput{DirPath: "/path/to/pkg", TestFunctions: []string{"TestA", "TestB"}, FailedTests: []string{"TestA", "TestRemoved"}}
+	ins, err := failedSelector{}.Select(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ins) != 1 || ins[0].from.Name() != "(failed before)" {
+		t.Fatalf("unexpected influences: %#v", ins)
+	}
+	if tests := selectedTests(ins); !reflect.DeepEqual([]string{"TestA"}, tests) {
+		t.Errorf("unexpected tests: %v", tests)
+	}
+}
+
+func TestChangedFilesSelector(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "typical")
+	in := SelectorInput{
+		DirPath:       dirPath,
+		Changes:       []Change{{"sum.go", 0, 0}, {filepath.Join(dirPath, "sum_test.go"), 0, 0}, {"README.md", 0, 0}},
+		TestFunctions: []string{"TestSum", "TestSum_ErrorCase", "TestSum_Add1"},
+		conf:          buildConfig{ctxt: &build.Default},
+	}
+
+	ins, err := changedFilesSelector{}.Select(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ins) != 1 || ins[0].from.Name() != "sum.go" {
+		t.Fatalf("unexpected influences: %#v", ins)
+	}
+	if tests := selectedTests(ins); !reflect.DeepEqual([]string{"TestSum", "TestSum_Add1", "TestSum_ErrorCase"}, tests) {
+		t.Errorf("unexpected tests: %v", tests)
+	}
+}
+
+func TestWithFailedSelector(t *testing.T) {
+	for i, testCase := range []struct {
+		selector Selector
+		expected Selector
+	}{
+		{influencedSelector{}, unionSelector{influencedSelector{}, failedSelector{}}},
+		{noneSelector{}, unionSelector{noneSelector{}, failedSelector{}}},
+		{allSelector{}, allSelector{}},
+		{failedSelector{}, failedSelector{}},
+		{unionSelector{influencedSelector{}, coverageSelector{}}, unionSelector{influencedSelector{}, coverageSelector{}, failedSelector{}}},
+		{unionSelector{influencedSelector{}, failedSelector{}}, unionSelector{influencedSelector{}, failedSelector{}}},
+	} {
+		if actual := withFailedSelector(testCase.selector); !reflect.DeepEqual(testCase.expected, actual) {
+			t.Errorf("[%d] unexpected selector: %#v", i, actual)
+		}
+	}
+}
+
+func TestChangeSelector(t *testing.T) {
+	for i, testCase := range []struct {
+		selector Selector
+		expected Selector
+	}{
+		{influencedSelector{}, influencedSelector{}},
+		{allSelector{}, nil},
+		{unionSelector{allSelector{}, coverageSelector{}}, coverageSelector{}},
+		{unionSelector{influencedSelector{}, failedSelector{}, changedFilesSelector{}}, unionSelector{influencedSelector{}, changedFilesSelector{}}},
+		{unionSelector{noneSelector{}, failedSelector{}}, nil},
+	} {
+		if actual := changeSelector(testCase.selector); !reflect.DeepEqual(testCase.expected, actual) {
+			t.Errorf("[%d] unexpected selector: %#v", i, actual)
+		}
+	}
+}
+
+func TestNewJob_AllSelectorInUnion(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "typical")
+	var buff strings.Builder
+	job, err := NewJob(dirPath, unionSelector{allSelector{}, failedSelector{}}, nil, nil, nil, nil, nil, &buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buff.String(), "Run all tests:") {
+		t.Errorf("unexpected output: %s", buff.String())
+	}
+	for _, task := range job.Tasks {
+		if !task.Important {
+			t.Errorf("not selected: %s", task.TestFunction)
+		}
+	}
+}
+
+// fixedSelector is the selector defined outside of the built-in ones.
+type fixedSelector []string
+
+func (s fixedSelector) Select(in SelectorInput) ([]Influence, error) {
+	return []Influence{NewSelectionInfluence("fixed", s)}, nil
+}
+
+func TestInfluence_Accessors(t *testing.T) {
+	in := NewSelectionInfluence("fixed", []string{"TestB", "TestA"})
+	if in.From() != "(fixed)" {
+		t.Errorf("wrong from: %s", in.From())
+	}
+	if testFunctions := in.TestFunctions(); !reflect.DeepEqual([]string{"TestA", "TestB"}, testFunctions) {
+		t.Errorf("wrong test functions: %v", testFunctions)
+	}
+	expected := []common.ChainElement{{Name: "(fixed)"}, {Name: "TestA"}}
+	if c := in.Chain("TestA"); !reflect.DeepEqual(expected, c) {
+		t.Errorf("wrong chain: %#v", c)
+	}
+	if c := in.Chain("TestC"); c != nil {
+		t.Errorf("wrong chain: %#v", c)
+	}
+}
+
+func TestNewJob_CustomSelector(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "typical")
+	var buff strings.Builder
+	job, err := NewJob(dirPath, fixedSelector{"TestSum"}, nil, nil, nil, nil, nil, &buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range job.Tasks {
+		if task.Important != (task.TestFunction == "TestSum") {
+			t.Errorf("wrong selection: %s, %v", task.TestFunction, task.Important)
+		}
+	}
+	if !strings.Contains(buff.String(), "Changed: [(fixed)]") {
+		t.Errorf("unexpected output: %s", buff.String())
+	}
+}
+
+func TestFailedTestStore_Record(t *testing.T) {
+	dirPath := "/path/to/pkg"
+	store := newFailedTestStore()
+	newJob := func(passed, failed []string) *Job {
+		job := &Job{DirPath: dirPath, passedTests: passed, failedTests: failed}
+		for _, testFunction := range []string{"TestA", "TestB", "TestC"} {
+			job.Tasks = append(job.Tasks, &Task{TestFunction: testFunction})
+		}
+		return job
+	}
+
+	store.record(newJob(nil, []string{"TestB", "TestA"}))
+	// the build error
+	store.record(newJob(nil, nil))
+	if failed := store.find(dirPath); !reflect.DeepEqual([]string{"TestA", "TestB"}, failed) {
+		t.Errorf("unexpected failed tests: %v", failed)
+	}
+
+	// TestB is kept until it passes, even if the other test function fails and TestB doesn't finish.
+	store.record(newJob([]string{"TestA"}, []string{"TestC"}))
+	if failed := store.find(dirPath); !reflect.DeepEqual([]string{"TestB", "TestC"}, failed) {
+		t.Errorf("unexpected failed tests: %v", failed)
+	}
+
+	store.record(newJob([]string{"TestB", "TestC"}, nil))
+	if failed := store.find(dirPath); failed != nil {
+		t.Errorf("unexpected failed tests: %v", failed)
+	}
+}
+
+func TestFailedTestStore(t *testing.T) {
+	store := newFailedTestStore()
+	store.update("/path/to/a", []string{"TestA", "TestB"}, nil, []string{"TestA", "TestB"})
+	store.update("/path/to/a/sub", []string{"TestSub"}, nil, []string{"TestSub"})
+	store.update("/path/to/b", []string{"TestB"}, nil, []string{"TestB"})
+
+	// TestB is removed from the package.
+	store.update("/path/to/a", []string{"TestA"}, nil, nil)
+	expected := []common.FailedPackage{
+		{PackageDir: "/path/to/a", TestFunctions: []string{"TestA"}},
+		{PackageDir: "/path/to/a/sub", TestFunctions: []string{"TestSub"}},
+	}
+	if pkgs := store.list("/path/to/a"); !reflect.DeepEqual(expected, pkgs) {
+		t.Errorf("unexpected packages: %#v", pkgs)
+	}
+}
+
+func TestNewJob_Selector(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dirPath := filepath.Join(cwd, "testdata", "typical")
+	selector, _ := NewSelector("influenced+failed")
+	var out strings.Builder
+	job, err := NewJob(dirPath, selector, nil, []string{"TestSum_ErrorCase"}, nil, nil, nil, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(job.TaskSets) != 1 || len(job.TaskSets[0].Tasks) != 1 || job.TaskSets[0].Tasks[0].TestFunction != "TestSum_ErrorCase" {
+		t.Errorf("unexpected task sets: %#v", job.TaskSets)
+	}
+	if out.String() != "Changed: [(failed before)]\n" {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
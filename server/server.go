@@ -6,9 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-noisegate/noisegate/common"
 	"github.com/go-noisegate/noisegate/common/log"
@@ -17,32 +21,70 @@ import (
 // Server serves the APIs for the cli client.
 type Server struct {
 	*http.Server
-	changeManager changeManager
+	// The token the clients must send. No authentication if empty.
+	AuthToken string
+	// The directories under which the clients can test and hint. Any directory is allowed if empty.
+	AllowedRoots []string
+	// The go test options the clients can't specify, without the hyphen (e.g. `exec`).
+	DeniedOptions []string
+	// The names of the environment variables the clients can send.
+	AllowedEnv    []string
+	changeManager *changeManager
+	eventHub      *eventHub
+	failedTests   *failedTestStore
+	flakes        *flakeStore
+	startedAt     time.Time
+	// the semaphores to limit the number of the running jobs, keyed by the directory of the configuration file.
+	jobSlots    map[string]chan struct{}
+	jobSlotsMtx sync.Mutex
+	// the context of the background work like the coverage collection. Canceled when the server is shut down.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	background sync.WaitGroup
 }
 
 // NewServer returns a new server.
 // We can use only one server instance in the process even if the address is different.
-func NewServer(addr string) Server {
-	s := Server{
+func NewServer(addr string) *Server {
+	s := &Server{
+		DeniedOptions: DefaultDeniedOptions,
+		AllowedEnv:    DefaultAllowedEnv,
 		changeManager: newChangeManager(),
+		eventHub:      newEventHub(),
+		failedTests:   newFailedTestStore(),
+		flakes:        newFlakeStore(),
+		startedAt:     time.Now(),
+		jobSlots:      make(map[string]chan struct{}),
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	mux := http.NewServeMux()
 	mux.HandleFunc(common.TestPath, s.handleTest)
 	mux.HandleFunc(common.HintPath, s.handleHint)
+	mux.HandleFunc(common.ExplainPath, s.handleExplain)
+	mux.HandleFunc(common.AffectedPath, s.handleAffected)
+	mux.HandleFunc(common.EventsPath, s.handleEvents)
+	mux.HandleFunc(common.InfoPath, s.handleInfo)
+	mux.HandleFunc(common.FailedPath, s.handleFailed)
+	mux.HandleFunc(common.FlakyPath, s.handleFlaky)
 	s.Server = &http.Server{
-		Handler: mux,
+		Handler: s.authenticate(mux),
 		Addr:    addr,
 	}
+	// the event streams never become idle, so close them explicitly.
+	s.Server.RegisterOnShutdown(s.eventHub.Close)
 	return s
 }
 
-// Shutdown shutdowns the server.
-func (s Server) Shutdown(ctx context.Context) error {
-	return s.Server.Shutdown(ctx)
+// Shutdown shutdowns the server. The background work is canceled and waited.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+	err := s.Server.Shutdown(ctx)
+	s.background.Wait()
+	return err
 }
 
-func (s Server) handleHint(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleHint(w http.ResponseWriter, r *http.Request) {
 	var input common.HintRequest
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&input); err != nil {
@@ -51,7 +93,20 @@ func (s Server) handleHint(w http.ResponseWriter, r *http.Request) {
 	}
 	input.Path = filepath.Clean(input.Path)
 
-	if err := s.updateChanges(input.Path, input.Ranges); err != nil {
+	if err := s.checkPath(input.Path); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for path := range input.Overlay {
+		if err := s.checkPath(path); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	if err := s.updateChanges(input.Path, input.Ranges, input.ColumnUnit, input.Overlay, hintOverlayTTL); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
@@ -66,33 +121,251 @@ func (s Server) handleHint(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("accepted\n"))
 }
 
-func (s Server) updateChanges(inputPath string, ranges []common.Range) error {
+// hintOverlayTTL is how long the overlay of the hint API is kept. The client can't tell the server the file is closed
+// without saving, so the content which is not updated for a while is considered to be discarded.
+const hintOverlayTTL = time.Hour
+
+// updateChanges stores the changed ranges and the overlay. The overlay expires after the `overlayTTL` (0 means never).
+func (s *Server) updateChanges(inputPath string, ranges []common.Range, columnUnit string, inputOverlay map[string]string, overlayTTL time.Duration) error {
+	overlay, err := s.mergeOverlays(inputOverlay)
+	if err != nil {
+		return err
+	}
+	if err := s.validateHintPath(inputPath, ranges, overlay); err != nil {
+		return err
+	}
+
+	ranges, err = resolveRanges(inputPath, ranges, columnUnit, overlay)
+	if err != nil {
+		return err
+	}
+	for path, content := range inputOverlay {
+		s.changeManager.AddOverlay(filepath.Clean(path), []byte(content), overlayTTL)
+	}
+	if isExcluded(inputPath) {
+		log.Debugf("the changes of %s are excluded by the config\n", inputPath)
+		return nil
+	}
+
+	if base := filepath.Base(inputPath); base == "go.mod" || base == "go.sum" {
+		moduleDir := filepath.Dir(inputPath)
+		for _, r := range ranges {
+			s.changeManager.AddModuleChange(moduleDir, Change{base, r.Begin, r.End})
+		}
+		return nil
+	}
+
+	pkgDir, changes, err := newChanges(inputPath, ranges)
+	if err != nil {
+		return err
+	}
+	for _, ch := range changes {
+		s.changeManager.Add(pkgDir, ch)
+	}
+	return nil
+}
+
+// validateHintPath validates the path and ranges of the hint. The file in the overlay may not exist on the disk.
+func (s *Server) validateHintPath(inputPath string, ranges []common.Range, overlay map[string][]byte) error {
 	if !filepath.IsAbs(inputPath) {
 		return errors.New("the path must be abs")
 	}
 
-	fi, err := os.Stat(inputPath)
-	if os.IsNotExist(err) {
-		return errors.New("the path not exist")
-	}
+	if _, ok := overlay[inputPath]; !ok {
+		fi, err := os.Stat(inputPath)
+		if os.IsNotExist(err) {
+			return errors.New("the path not exist")
+		} else if err != nil {
+			return err
+		}
 
-	if fi.IsDir() {
-		return errors.New("the path must be file")
+		if fi.IsDir() {
+			return errors.New("the path must be file")
+		}
 	}
 
 	if len(ranges) == 0 {
 		return errors.New("the range is not specified")
 	}
+	return nil
+}
 
-	pathDir := filepath.Dir(inputPath)
-	baseName := filepath.Base(inputPath)
+// mergeOverlays merges the overlay in the request with the stored overlays. The overlay in the request takes precedence.
+func (s *Server) mergeOverlays(inputOverlay map[string]string) (map[string][]byte, error) {
+	overlay := s.changeManager.FindOverlays()
+	for path, content := range inputOverlay {
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("the path in the overlay must be abs: %s", path)
+		}
+		overlay[filepath.Clean(path)] = []byte(content)
+	}
+	return overlay, nil
+}
+
+// resolveRanges converts the line-based ranges to the byte offset ranges using the content of the file.
+// The content in the overlay is used if exists.
+func resolveRanges(inputPath string, ranges []common.Range, columnUnit string, overlay map[string][]byte) ([]common.Range, error) {
+	lineBased := false
 	for _, r := range ranges {
-		s.changeManager.Add(pathDir, Change{baseName, r.Begin, r.End})
+		if r.IsLineBased() {
+			lineBased = true
+			break
+		}
 	}
-	return nil
+	if !lineBased && columnUnit == "" {
+		return ranges, nil
+	}
+
+	content, ok := overlay[inputPath]
+	if !ok {
+		var err error
+		content, err = ioutil.ReadFile(inputPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return toOffsetRanges(content, ranges, columnUnit)
+}
+
+// newChanges returns the package directory which the file belongs to and the changes of the file.
+func newChanges(inputPath string, ranges []common.Range) (string, []Change, error) {
+	pkgDir := findPackageDir(inputPath)
+	relPath, err := filepath.Rel(pkgDir, inputPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var changes []Change
+	for _, r := range ranges {
+		changes = append(changes, Change{relPath, r.Begin, r.End})
+	}
+	return pkgDir, changes, nil
 }
 
-func (s Server) handleTest(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleAffected(w http.ResponseWriter, r *http.Request) {
+	var input common.AffectedRequest
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid request body\n"))
+		return
+	}
+	input.Path = filepath.Clean(input.Path)
+
+	if err := s.checkPolicy(input.Path, input.GoTestOptions, input.Env); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	overlay := s.changeManager.FindOverlays()
+	if err := s.validateHintPath(input.Path, input.Ranges, overlay); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if base := filepath.Base(input.Path); base == "go.mod" || base == "go.sum" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("go.mod and go.sum are not supported"))
+		return
+	}
+	ranges, err := resolveRanges(input.Path, input.Ranges, input.ColumnUnit, overlay)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	log.Printf("affected %s\n", input.Path)
+
+	// the changes are not stored in the change manager.
+	pkgDir, changes, err := newChanges(input.Path, ranges)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if isExcluded(input.Path) {
+		changes = nil
+	}
+	_, goTestOpts, err := s.applyConfig(pkgDir, false, "", input.GoTestOptions)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	job, err := NewJob(pkgDir, findChangeSelector(pkgDir), changes, s.failedTests.find(pkgDir), goTestOpts, input.Env, overlay, ioutil.Discard)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		msg := fmt.Sprintf("failed to generate a new job: %v\n", err)
+		fmt.Fprint(w, msg)
+		log.Debug(msg)
+		return
+	}
+
+	resp := common.AffectedResponse{PackageDir: pkgDir, Changed: job.changedIdentityNames()}
+	for _, t := range job.Tasks {
+		if t.Important {
+			resp.TestFunctions = append(resp.TestFunctions, t.TestFunction)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Printf("failed to encode the response: %v\n", err)
+	}
+}
+
+// findPackageDir returns the directory of the package which the file belongs to.
+// The go file belongs to the package of its directory. The non-go file (e.g. the embedded file) belongs to
+// the nearest package in its ancestor directories. If the file is under the `testdata` directory, it belongs to
+// the package of the parent directory of `testdata`, because the test usually opens the file with the relative path.
+func findPackageDir(path string) string {
+	dir := filepath.Dir(path)
+	if strings.HasSuffix(path, ".go") {
+		return dir
+	}
+
+	for d := dir; d != filepath.Dir(d); d = filepath.Dir(d) {
+		if filepath.Base(d) == "testdata" {
+			return filepath.Dir(d)
+		}
+		if hasGoFiles(d) {
+			return d
+		}
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			// do not go beyond the module root
+			break
+		}
+	}
+	return dir
+}
+
+// findModuleDir returns the root directory of the module which the directory belongs to.
+// It returns the empty string if go.mod is not found.
+func findModuleDir(dirPath string) string {
+	for d := dirPath; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d
+		}
+		if d == filepath.Dir(d) {
+			return ""
+		}
+	}
+}
+
+func hasGoFiles(dirPath string) bool {
+	fis, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return false
+	}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".go") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleTest(w http.ResponseWriter, r *http.Request) {
 	var input common.TestRequest
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&input); err != nil {
@@ -102,16 +375,45 @@ func (s Server) handleTest(w http.ResponseWriter, r *http.Request) {
 	}
 	input.Path = filepath.Clean(input.Path)
 
+	if err := s.checkTestRequest(input); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	if err := s.validateTestPath(input.Path); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if input.Retries < 0 || input.Retries > common.MaxRetries {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("the retries must be between 0 and %d", common.MaxRetries)))
+		return
+	}
 
-	log.Printf("test %s\n", input.Path)
+	if input.DryRun {
+		log.Printf("test %s (dry run)\n", input.Path)
+	} else {
+		log.Printf("test %s\n", input.Path)
+	}
 
+	overlay, err := s.mergeOverlays(input.Overlay)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	selector, goTestOpts, err := s.applyConfig(input.Path, input.Bypass, input.Selector, input.GoTestOptions)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	changes, moduleMark := s.findChanges(input.Path)
 	respWriter := newFlushWriter(w)
-	job, err := NewJob(input.Path, input.Bypass, s.changeManager.Find(input.Path), input.GoTestOptions, respWriter)
+	job, err := NewJob(input.Path, selector, changes, s.failedTests.find(input.Path), goTestOpts, input.Env, overlay, respWriter)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		msg := fmt.Sprintf("failed to generate a new job: %v\n", err)
@@ -119,18 +421,206 @@ func (s Server) handleTest(w http.ResponseWriter, r *http.Request) {
 		log.Debug(msg)
 		return
 	}
+	job.Retries = findRetries(input.Path, input.Retries)
+
+	if input.DryRun {
+		job.DryRun()
+		return
+	}
+
+	s.runJob(context.Background(), job, moduleMark)
+}
+
+// runJob runs the job and deletes the changes of the package if the tests are passed.
+// The failed test functions are recorded so that they run in the later jobs until they pass, and the flaky ones are
+// recorded to track how often they are flaky.
+// The progress of the job is published to the subscribers of the events API.
+// The number of the running jobs is limited by the configuration file.
+// Only the module changes up to `moduleMark`, which is taken when the job is created, are marked as tested.
+func (s *Server) runJob(ctx context.Context, job *Job, moduleMark moduleChangesMark) {
+	release, err := s.acquireJobSlot(ctx, job.DirPath)
+	if err != nil {
+		log.Printf("failed to start job #%d: %v\n", job.ID, err)
+		job.Status = JobStatusFailed
+		return
+	}
+	defer release()
+
+	var selected []string
+	for _, t := range job.Tasks {
+		if t.Important {
+			selected = append(selected, t.TestFunction)
+		}
+	}
+	s.eventHub.Publish(common.Event{Type: common.EventTypeJobStarted, JobID: job.ID, PackageDir: job.DirPath, Time: time.Now(), TestFunctions: selected})
+	evWriter := newEventWriter(s.eventHub, job)
+	job.writer = io.MultiWriter(job.writer, evWriter)
 
 	log.Debugf("start job #%d\n", job.ID)
-	job.Run(context.Background())
+	job.Run(ctx)
+
+	evWriter.Flush()
+	result := common.JobResultFailed
+	if job.Status == JobStatusSuccessful {
+		result = common.JobResultSuccessful
+	}
+	s.eventHub.Publish(common.Event{Type: common.EventTypeJobFinished, JobID: job.ID, PackageDir: job.DirPath, Time: time.Now(),
+		Result: result, Elapsed: job.FinishedAt.Sub(job.StartedAt).Seconds(), FlakyTestFunctions: job.flakyTests})
+	s.failedTests.record(job)
+	s.flakes.record(job)
 
 	if job.Status == JobStatusSuccessful {
-		s.changeManager.Delete(input.Path)
+		s.startCoverageCollection(job)
+		s.changeManager.Delete(job.DirPath)
+		if moduleMark.moduleDirPath != "" {
+			s.changeManager.DeleteModuleChanges(job.DirPath, moduleMark)
+		}
 	}
 	log.Debugf("finish job #%d\n", job.ID)
 	log.Debugf("build + test time: %v\n", job.FinishedAt.Sub(job.CreatedAt))
 }
 
-func (s Server) validateTestPath(inputPath string) error {
+// findChanges returns the changes of the package, including the changes of go.mod and go.sum.
+// It also returns the mark of the module changes, which is the zero value if the package is not in any module.
+func (s *Server) findChanges(dirPath string) ([]Change, moduleChangesMark) {
+	changes := s.changeManager.Find(dirPath)
+	moduleDir := findModuleDir(dirPath)
+	if moduleDir == "" {
+		return changes, moduleChangesMark{}
+	}
+	modChanges, mark := s.changeManager.FindModuleChanges(moduleDir, dirPath)
+	for _, ch := range modChanges {
+		ch.Basename = filepath.Join(moduleDir, ch.Basename)
+		changes = append(changes, ch)
+	}
+	return changes, mark
+}
+
+func (s *Server) handleExplain(w http.ResponseWriter, r *http.Request) {
+	var input common.TestRequest
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid request body\n"))
+		return
+	}
+	input.Path = filepath.Clean(input.Path)
+
+	if err := s.checkTestRequest(input); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := s.validateTestPath(input.Path); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	log.Printf("explain %s\n", input.Path)
+
+	overlay, err := s.mergeOverlays(input.Overlay)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	selector, goTestOpts, err := s.applyConfig(input.Path, input.Bypass, input.Selector, input.GoTestOptions)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	changes, _ := s.findChanges(input.Path)
+	job, err := NewJob(input.Path, selector, changes, s.failedTests.find(input.Path), goTestOpts, input.Env, overlay, ioutil.Discard)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		msg := fmt.Sprintf("failed to generate a new job: %v\n", err)
+		fmt.Fprint(w, msg)
+		log.Debug(msg)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job.Explain()); err != nil {
+		log.Printf("failed to encode the response: %v\n", err)
+	}
+}
+
+// handleFailed lists the failed tests of the packages under the workspace directory.
+func (s *Server) handleFailed(w http.ResponseWriter, r *http.Request) {
+	var input common.FailedRequest
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid request body\n"))
+		return
+	}
+	if !filepath.IsAbs(input.Path) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the path must be abs"))
+		return
+	}
+	input.Path = filepath.Clean(input.Path)
+
+	if err := s.checkPath(input.Path); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	resp := common.FailedResponse{Packages: s.failedTests.list(input.Path)}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Printf("failed to encode the response: %v\n", err)
+	}
+}
+
+// handleFlaky lists the flaky tests of the packages under the workspace directory.
+func (s *Server) handleFlaky(w http.ResponseWriter, r *http.Request) {
+	var input common.FlakyRequest
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid request body\n"))
+		return
+	}
+	if !filepath.IsAbs(input.Path) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the path must be abs"))
+		return
+	}
+	input.Path = filepath.Clean(input.Path)
+
+	if err := s.checkPath(input.Path); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	resp := common.FlakyResponse{Tests: s.flakes.list(input.Path)}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Printf("failed to encode the response: %v\n", err)
+	}
+}
+
+// checkTestRequest checks the path, the go test options, the environment variables and the overlay of the request violate the policy.
+func (s *Server) checkTestRequest(input common.TestRequest) error {
+	if err := s.checkPolicy(input.Path, input.GoTestOptions, input.Env); err != nil {
+		return err
+	}
+	for path := range input.Overlay {
+		if err := s.checkPath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) validateTestPath(inputPath string) error {
 	if !filepath.IsAbs(inputPath) {
 		return errors.New("the path must be abs")
 	}
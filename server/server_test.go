@@ -1,14 +1,17 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-noisegate/noisegate/common"
 )
@@ -36,6 +39,132 @@ func TestHandleHint_InputIsFileAndRange(t *testing.T) {
 	}
 }
 
+func TestHandleHint_LineRange(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	path := filepath.Join(curr, "testdata", "typical", "sum_test.go")
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin_line": 7, "begin_column": 6, "end_line": 7, "end_column": 6}]}`, path)))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+
+	changes := server.changeManager.Find(filepath.Dir(path))
+	if len(changes) != 1 || changes[0] != (Change{filepath.Base(path), 65, 65}) {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+}
+
+func TestHandleHint_LineOutOfRange(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	path := filepath.Join(curr, "testdata", "typical", "sum_test.go")
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin_line": 10000, "end_line": 10000}]}`, path)))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+}
+
+func TestHandleHint_Overlay(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	path := filepath.Join(curr, "testdata", "typical", "unsaved.go") // not exist on the disk
+	reqData := common.HintRequest{
+		Path:    path,
+		Ranges:  []common.Range{{BeginLine: 3, EndLine: 3}},
+		Overlay: map[string]string{path: "package testdata\n\nfunc Unsaved() {}\n"},
+	}
+	body, _ := json.Marshal(&reqData)
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected code: %d", w.Code)
+	}
+
+	changes := server.changeManager.Find(filepath.Dir(path))
+	if len(changes) != 1 || changes[0] != (Change{"unsaved.go", 18, 36}) {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+	overlays := server.changeManager.FindOverlays()
+	if string(overlays[path]) != reqData.Overlay[path] {
+		t.Errorf("wrong overlays: %#v", overlays)
+	}
+}
+
+func TestChangeManager_OverlayExpires(t *testing.T) {
+	m := newChangeManager()
+	m.AddOverlay("/path/to/expired.go", []byte("package a\n"), time.Nanosecond)
+	m.AddOverlay("/path/to/kept.go", []byte("package a\n"), 0)
+	time.Sleep(time.Millisecond)
+
+	overlays := m.FindOverlays()
+	if _, ok := overlays["/path/to/expired.go"]; ok || len(overlays) != 1 {
+		t.Errorf("wrong overlays: %#v", overlays)
+	}
+
+	m.DeleteOverlay("/path/to/kept.go")
+	if overlays := m.FindOverlays(); len(overlays) != 0 {
+		t.Errorf("wrong overlays: %#v", overlays)
+	}
+}
+
+func TestHandleHint_OverlayIsSaved(t *testing.T) {
+	server := NewServer("")
+
+	dir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sum.go")
+	if err := ioutil.WriteFile(path, []byte("package sum\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reqData := common.HintRequest{Path: path, Ranges: []common.Range{{Begin: 1, End: 1}}, Overlay: map[string]string{path: "package sum\n\nfunc Sum() {}\n"}}
+	body, _ := json.Marshal(&reqData)
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected code: %d", w.Code)
+	}
+	if overlays := server.changeManager.FindOverlays(); len(overlays) != 1 {
+		t.Fatalf("wrong overlays: %#v", overlays)
+	}
+
+	// the file is saved after the hint.
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if overlays := server.changeManager.FindOverlays(); len(overlays) != 0 {
+		t.Errorf("the stale overlay is not deleted: %#v", overlays)
+	}
+}
+
+func TestHandleHint_OverlayRelativePath(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	path := filepath.Join(curr, "testdata", "typical", "sum.go")
+	reqData := common.HintRequest{Path: path, Ranges: []common.Range{{Begin: 1, End: 1}}, Overlay: map[string]string{"sum.go": ""}}
+	body, _ := json.Marshal(&reqData)
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+}
+
 func TestHandleHint_InputIsFile(t *testing.T) {
 	server := NewServer("")
 
@@ -132,6 +261,109 @@ func TestHandleHint_IdentifyMultiplePathRepresentations(t *testing.T) {
 	}
 }
 
+func TestHandleHint_Testdata(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	pkgPath := filepath.Join(curr, "testdata", "embed")
+	for _, relPath := range []string{filepath.Join("testdata", "golden.txt"), filepath.Join("static", "hello.txt")} {
+		req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin": 0, "end": 0}]}`, filepath.Join(pkgPath, relPath))))
+		w := httptest.NewRecorder()
+		server.handleHint(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("unexpected code: %d", w.Code)
+		}
+	}
+
+	changes := server.changeManager.Find(pkgPath)
+	if len(changes) != 2 || changes[0].Basename != filepath.Join("testdata", "golden.txt") || changes[1].Basename != filepath.Join("static", "hello.txt") {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+}
+
+func TestHandleHint_ModuleFile(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	moduleDir := filepath.Join(curr, "testdata", "gomod")
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin": 1, "end": 2}]}`, filepath.Join(moduleDir, "go.mod"))))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+
+	changes, mark := server.changeManager.FindModuleChanges(moduleDir, moduleDir)
+	if len(changes) != 1 || changes[0] != (Change{"go.mod", 1, 2}) {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+	subDir := filepath.Join(moduleDir, "sub")
+	if changes, _ := server.changeManager.FindModuleChanges(moduleDir, subDir); len(changes) != 1 {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+
+	// the change during the job is not marked as tested.
+	server.changeManager.AddModuleChange(moduleDir, Change{"go.sum", 3, 4})
+	server.changeManager.DeleteModuleChanges(moduleDir, mark)
+	if changes, _ := server.changeManager.FindModuleChanges(moduleDir, moduleDir); len(changes) != 1 || changes[0] != (Change{"go.sum", 3, 4}) {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+	changes, mark = server.changeManager.FindModuleChanges(moduleDir, subDir)
+	if len(changes) != 2 {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+
+	// the changes all the packages tested are trimmed.
+	server.changeManager.DeleteModuleChanges(subDir, mark)
+	if l := server.changeManager.modChanges[moduleDir]; l.offset != 1 || len(l.changes) != 1 {
+		t.Errorf("not trimmed: %#v", l)
+	}
+	if changes, _ := server.changeManager.FindModuleChanges(moduleDir, subDir); len(changes) != 0 {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+}
+
+func TestChangeManager_ModuleChangesNotTested(t *testing.T) {
+	m := newChangeManager()
+	moduleDir, testedDir, untestedDir := "/path/to/module", "/path/to/module/tested", "/path/to/module/untested"
+	m.AddModuleChange(moduleDir, Change{"go.mod", 0, 0})
+	// the package finds the changes, but never tests them.
+	m.FindModuleChanges(moduleDir, untestedDir)
+
+	for i := 0; i < maxModuleChanges*2; i++ {
+		m.AddModuleChange(moduleDir, Change{"go.sum", int64(i), int64(i)})
+		_, mark := m.FindModuleChanges(moduleDir, testedDir)
+		m.DeleteModuleChanges(testedDir, mark)
+	}
+	if l := m.modChanges[moduleDir]; len(l.changes) != maxModuleChanges {
+		t.Errorf("wrong number of changes: %d", len(l.changes))
+	}
+	if changes, _ := m.FindModuleChanges(moduleDir, testedDir); len(changes) != 0 {
+		t.Errorf("wrong changes: %#v", changes)
+	}
+	changes, _ := m.FindModuleChanges(moduleDir, untestedDir)
+	if len(changes) != maxModuleChanges || changes[len(changes)-1] != (Change{"go.sum", maxModuleChanges*2 - 1, maxModuleChanges*2 - 1}) {
+		t.Errorf("wrong changes: %d", len(changes))
+	}
+}
+
+func TestFindPackageDir(t *testing.T) {
+	curr, _ := os.Getwd()
+	pkgPath := filepath.Join(curr, "testdata", "embed")
+	for _, testCase := range []struct {
+		path, expect string
+	}{
+		{filepath.Join(pkgPath, "embed.go"), pkgPath},
+		{filepath.Join(pkgPath, "testdata", "golden.txt"), pkgPath},
+		{filepath.Join(pkgPath, "testdata", "golden.go"), filepath.Join(pkgPath, "testdata")},
+		{filepath.Join(pkgPath, "static", "hello.txt"), pkgPath},
+	} {
+		if actual := findPackageDir(testCase.path); actual != testCase.expect {
+			t.Errorf("wrong package dir: %s", actual)
+		}
+	}
+}
+
 func TestHandleTest_InputIsDirectory(t *testing.T) {
 	server := NewServer("")
 
@@ -160,6 +392,149 @@ func TestHandleTest_InputIsDirectory(t *testing.T) {
 	}
 }
 
+func TestHandleTest_Env(t *testing.T) {
+	server := NewServer("")
+	server.AllowedEnv = append(DefaultAllowedEnv, "NOISEGATE_TEST_DATABASE_URL")
+
+	curr, _ := os.Getwd()
+	dirPath := filepath.Join(curr, "testdata", "env")
+	req := httptest.NewRequest("GET", common.TestPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "bypass": true, "go_test_options": ["-v", "-count=1"], "env": {"NOISEGATE_TEST_DATABASE_URL": "postgres://localhost/test"}}`, dirPath)))
+	w := httptest.NewRecorder()
+	server.handleTest(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+
+	out, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(out), "PASS: TestDatabaseURL") {
+		t.Errorf("unexpected content: %s", string(out))
+	}
+}
+
+func TestHandleTest_RerunFailed(t *testing.T) {
+	server := NewServer("")
+	server.AllowedEnv = append(DefaultAllowedEnv, "NOISEGATE_TEST_DATABASE_URL")
+
+	curr, _ := os.Getwd()
+	dirPath := filepath.Join(curr, "testdata", "env")
+
+	// the test fails without the environment variable.
+	req := httptest.NewRequest("GET", common.TestPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "bypass": true, "go_test_options": ["-count=1"]}`, dirPath)))
+	w := httptest.NewRecorder()
+	server.handleTest(w, req)
+	if failed := server.failedTests.find(dirPath); !reflect.DeepEqual([]string{"TestDatabaseURL"}, failed) {
+		t.Fatalf("unexpected failed tests: %v", failed)
+	}
+
+	req = httptest.NewRequest("GET", common.FailedPath, strings.NewReader(fmt.Sprintf(`{"path": "%s"}`, curr)))
+	w = httptest.NewRecorder()
+	server.handleFailed(w, req)
+	var resp common.FailedResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Packages) != 1 || resp.Packages[0].PackageDir != dirPath {
+		t.Errorf("unexpected response: %#v", resp)
+	}
+
+	// no change, but the failed test runs again.
+	req = httptest.NewRequest("GET", common.TestPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "go_test_options": ["-v", "-count=1"], "env": {"NOISEGATE_TEST_DATABASE_URL": "postgres://localhost/test"}}`, dirPath)))
+	w = httptest.NewRecorder()
+	server.handleTest(w, req)
+	out, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(out), "Changed: [(failed before)]") || !strings.Contains(string(out), "PASS: TestDatabaseURL") {
+		t.Errorf("unexpected content: %s", string(out))
+	}
+	if failed := server.failedTests.find(dirPath); failed != nil {
+		t.Errorf("unexpected failed tests: %v", failed)
+	}
+}
+
+func TestHandleFailed_RelativePath(t *testing.T) {
+	server := NewServer("")
+
+	req := httptest.NewRequest("GET", common.FailedPath, strings.NewReader(`{"path": "testdata"}`))
+	w := httptest.NewRecorder()
+	server.handleFailed(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+}
+
+func TestHandleTest_TooManyRetries(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	dirPath := filepath.Join(curr, "testdata", "typical")
+	req := httptest.NewRequest("GET", common.TestPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "retries": %d}`, dirPath, common.MaxRetries+1)))
+	w := httptest.NewRecorder()
+	server.handleTest(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+}
+
+func TestHandleFlaky(t *testing.T) {
+	server := NewServer("")
+	server.AllowedEnv = append(DefaultAllowedEnv, "NOISEGATE_TEST_FLAKY_MARKER")
+
+	curr, _ := os.Getwd()
+	dirPath := filepath.Join(curr, "testdata", "flaky")
+	tempDir, err := ioutil.TempDir("", "noisegate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	marker := filepath.Join(tempDir, "marker")
+	req := httptest.NewRequest("GET", common.TestPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "bypass": true, "retries": 1, "go_test_options": ["-count=1"], "env": {"NOISEGATE_TEST_FLAKY_MARKER": "%s"}}`, dirPath, marker)))
+	w := httptest.NewRecorder()
+	server.handleTest(w, req)
+	if out, _ := ioutil.ReadAll(w.Body); !strings.Contains(string(out), "Flaky: [TestFlaky]") {
+		t.Errorf("unexpected content: %s", string(out))
+	}
+	if failed := server.failedTests.find(dirPath); failed != nil {
+		t.Errorf("the flaky test is recorded as failed: %v", failed)
+	}
+
+	req = httptest.NewRequest("GET", common.FlakyPath, strings.NewReader(fmt.Sprintf(`{"path": "%s"}`, dirPath)))
+	w = httptest.NewRecorder()
+	server.handleFlaky(w, req)
+	var resp common.FlakyResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	expected := []common.FlakyTest{{PackageDir: dirPath, TestFunction: "TestFlaky", Runs: 1, Flakes: 1}}
+	if !reflect.DeepEqual(expected, resp.Tests) {
+		t.Errorf("unexpected response: %#v", resp)
+	}
+}
+
+func TestHandleTest_DryRun(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	path := filepath.Join(curr, "testdata", "typical", "sum_test.go")
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin": 0, "end": 99}]}`, path)))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+
+	req = httptest.NewRequest("GET", common.TestPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "dry_run": true}`, filepath.Dir(path))))
+	w = httptest.NewRecorder()
+	server.handleTest(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+
+	out, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(out), "Command: go test -run '^TestSum$|^TestSum_ErrorCase$' .") || strings.Contains(string(out), "PASS") {
+		t.Errorf("unexpected content: %s", string(out))
+	}
+	if changes := server.changeManager.Find(filepath.Dir(path)); len(changes) != 1 {
+		t.Errorf("changes should not be cleared: %#v", changes)
+	}
+}
+
 func TestHandleTest_InputIsFile(t *testing.T) {
 	server := NewServer("")
 
@@ -199,3 +574,86 @@ func TestHandleTest_RelativePath(t *testing.T) {
 		t.Errorf("unexpected code: %d", w.Code)
 	}
 }
+
+func TestHandleExplain(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	path := filepath.Join(curr, "testdata", "typical", "sum_test.go")
+	req := httptest.NewRequest("GET", common.HintPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin": 0, "end": 99}]}`, path)))
+	w := httptest.NewRecorder()
+	server.handleHint(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", common.ExplainPath, strings.NewReader(fmt.Sprintf(`{"path": "%s"}`, filepath.Dir(path))))
+	w = httptest.NewRecorder()
+	server.handleExplain(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected code: %d", w.Code)
+	}
+
+	var resp common.ExplainResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp.Changed, []string{"TestSum", "TestSum_ErrorCase"}) || len(resp.Explain) != 3 || resp.Explain[2].Selected {
+		t.Errorf("unexpected response: %#v", resp)
+	}
+
+	if changes := server.changeManager.Find(filepath.Dir(path)); len(changes) != 1 {
+		t.Errorf("changes should not be cleared: %#v", changes)
+	}
+}
+
+func TestHandleExplain_RelativePath(t *testing.T) {
+	server := NewServer("")
+
+	req := httptest.NewRequest("GET", common.ExplainPath, strings.NewReader(`{"path": "rel/path"}`))
+	w := httptest.NewRecorder()
+	server.handleExplain(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+}
+
+func TestHandleAffected(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	path := filepath.Join(curr, "testdata", "typical", "sum_test.go")
+	req := httptest.NewRequest("GET", common.AffectedPath, strings.NewReader(fmt.Sprintf(`{"path": "%s", "ranges": [{"begin": 60, "end": 60}]}`, path)))
+	w := httptest.NewRecorder()
+	server.handleAffected(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected code: %d", w.Code)
+	}
+
+	var resp common.AffectedResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	expect := common.AffectedResponse{PackageDir: filepath.Dir(path), Changed: []string{"TestSum"}, TestFunctions: []string{"TestSum"}}
+	if !reflect.DeepEqual(expect, resp) {
+		t.Errorf("unexpected response: %#v", resp)
+	}
+
+	if changes := server.changeManager.Find(filepath.Dir(path)); len(changes) != 0 {
+		t.Errorf("changes should not be stored: %#v", changes)
+	}
+}
+
+func TestHandleAffected_NoRange(t *testing.T) {
+	server := NewServer("")
+
+	curr, _ := os.Getwd()
+	path := filepath.Join(curr, "testdata", "typical", "sum_test.go")
+	req := httptest.NewRequest("GET", common.AffectedPath, strings.NewReader(fmt.Sprintf(`{"path": "%s"}`, path)))
+	w := httptest.NewRecorder()
+	server.handleAffected(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected code: %d", w.Code)
+	}
+}
@@ -0,0 +1,7 @@
+package asm
+
+func Sum(a, b int64) int64
+
+func Sub(a, b int64) int64 {
+	return a - b
+}
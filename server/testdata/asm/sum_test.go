@@ -0,0 +1,15 @@
+package asm
+
+import "testing"
+
+func TestSum(t *testing.T) {
+	if Sum(1, 2) != 3 {
+		t.Error("wrong result")
+	}
+}
+
+func TestSub(t *testing.T) {
+	if Sub(2, 1) != 1 {
+		t.Error("wrong result")
+	}
+}
@@ -0,0 +1,12 @@
+package cgo
+
+// #include "sum.h"
+import "C"
+
+func Sum(a, b int) int {
+	return int(C.sum(C.int(a), C.int(b)))
+}
+
+func Sub(a, b int) int {
+	return a - b
+}
@@ -0,0 +1 @@
+int sum(int a, int b);
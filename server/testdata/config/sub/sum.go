@@ -0,0 +1,5 @@
+package sub
+
+func Sum(a, b int) int {
+	return a + b
+}
@@ -0,0 +1,5 @@
+package sub
+
+func Diff(a, b int) int {
+	return a - b
+}
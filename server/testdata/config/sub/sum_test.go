@@ -0,0 +1,15 @@
+package sub
+
+import "testing"
+
+func TestSum(t *testing.T) {
+	if Sum(1, 2) != 3 {
+		t.Error("wrong sum")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	if Diff(2, 1) != 1 {
+		t.Error("wrong diff")
+	}
+}
@@ -0,0 +1,11 @@
+package coverage
+
+type Calculator struct{}
+
+func (Calculator) Add(a, b int) int {
+	return a + b
+}
+
+func (Calculator) Mul(a, b int) int {
+	return a * b
+}
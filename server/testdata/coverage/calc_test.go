@@ -0,0 +1,19 @@
+package coverage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	if (Calculator{}).Add(1, 2) != 3 {
+		t.Error("wrong result")
+	}
+}
+
+func TestMulByName(t *testing.T) {
+	out := reflect.ValueOf(Calculator{}).MethodByName("Mul").Call([]reflect.Value{reflect.ValueOf(2), reflect.ValueOf(3)})
+	if out[0].Int() != 6 {
+		t.Error("wrong result")
+	}
+}
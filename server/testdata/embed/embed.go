@@ -0,0 +1,18 @@
+package embed
+
+import (
+	"embed"
+	"strings"
+)
+
+//go:embed static/hello.txt
+var hello string
+
+var (
+	//go:embed static
+	assets embed.FS
+)
+
+func Hello() string {
+	return strings.TrimSpace(hello)
+}
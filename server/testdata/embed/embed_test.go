@@ -0,0 +1,40 @@
+package embed
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	if Hello() != "hello" {
+		t.Error("wrong greeting")
+	}
+}
+
+func TestAssets(t *testing.T) {
+	if _, err := assets.ReadFile("static/hello.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	if _, err := ioutil.ReadFile(filepath.Join("testdata", "golden.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHelper(t *testing.T) {
+	readTestdata(t, "other.txt")
+}
+
+func TestNothing(t *testing.T) {
+}
+
+func readTestdata(t *testing.T, name string) []byte {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
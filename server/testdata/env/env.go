@@ -0,0 +1,7 @@
+package env
+
+import "os"
+
+func DatabaseURL() string {
+	return os.Getenv("NOISEGATE_TEST_DATABASE_URL")
+}
@@ -0,0 +1,9 @@
+package env
+
+import "testing"
+
+func TestDatabaseURL(t *testing.T) {
+	if url := DatabaseURL(); url != "postgres://localhost/test" {
+		t.Errorf("unexpected url: %s", url)
+	}
+}
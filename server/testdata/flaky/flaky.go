@@ -0,0 +1,5 @@
+package flaky
+
+func Marker() string {
+	return "marker"
+}
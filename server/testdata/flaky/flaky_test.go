@@ -0,0 +1,19 @@
+package flaky
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// fails at the first run, and passes after the marker file is created.
+func TestFlaky(t *testing.T) {
+	path := os.Getenv("NOISEGATE_TEST_FLAKY_MARKER")
+	if _, err := os.Stat(path); err != nil {
+		ioutil.WriteFile(path, []byte(Marker()), 0644)
+		t.Fatalf("the marker file does not exist: %s", path)
+	}
+}
+
+func TestStable(t *testing.T) {
+}
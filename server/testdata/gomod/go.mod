@@ -0,0 +1,10 @@
+module example.com/gomod
+
+go 1.13
+
+require (
+	example.com/dep v1.0.0
+	example.com/other v1.0.0
+)
+
+replace example.com/dep => example.com/fork v1.0.1
@@ -0,0 +1,7 @@
+package gomod
+
+import "example.com/dep/sum"
+
+func Sum(a, b int) int {
+	return sum.Sum(a, b)
+}
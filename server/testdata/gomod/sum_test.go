@@ -0,0 +1,15 @@
+package gomod
+
+import "testing"
+
+func TestSum(t *testing.T) {
+	if Sum(1, 2) != 3 {
+		t.Error("wrong result")
+	}
+}
+
+func TestSum_Negative(t *testing.T) {
+	if Sum(-1, -2) != -3 {
+		t.Error("wrong result")
+	}
+}
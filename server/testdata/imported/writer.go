@@ -0,0 +1,14 @@
+package imported
+
+import "bytes"
+
+type Writer struct{}
+
+func (Writer) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Buffer embeds the struct of the other package, which has the method of the same name.
+type Buffer struct {
+	bytes.Buffer
+}
@@ -0,0 +1,26 @@
+package imported
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	Writer{}.Write(nil)
+}
+
+func TestInterface(t *testing.T) {
+	var w io.Writer = Writer{}
+	w.Write(nil)
+}
+
+func TestBytesBuffer(t *testing.T) {
+	var b bytes.Buffer
+	b.Write(nil)
+}
+
+func TestEmbeddedBuffer(t *testing.T) {
+	var b Buffer
+	b.Write(nil)
+}
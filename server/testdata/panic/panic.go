@@ -0,0 +1,5 @@
+package panic
+
+func Marker() string {
+	return "marker"
+}
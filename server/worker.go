@@ -1,11 +1,14 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"os/exec"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/go-noisegate/noisegate/common/log"
 )
@@ -14,8 +17,13 @@ type worker struct {
 	testFuncs     []string
 	packagePath   string
 	goTestOptions []string
+	overlayPath   string
+	env           []string
 	writer        io.Writer
 	cmd           *exec.Cmd
+	results       *testResultWriter
+	// true if the go test command succeeded. Available after the test finishes.
+	succeeded bool
 }
 
 func newWorker(job *Job, taskSet *TaskSet) *worker {
@@ -28,27 +36,53 @@ func newWorker(job *Job, taskSet *TaskSet) *worker {
 		testFuncs:     testFuncs,
 		packagePath:   job.DirPath,
 		goTestOptions: job.GoTestOptions,
+		overlayPath:   job.overlayPath,
+		env:           job.env,
+		writer:        job.writer,
+	}
+}
+
+// newRetryWorker returns the worker which runs the failed test function again. The test cache is disabled
+// unless the `-count` option is specified, because the cached result doesn't tell whether the test is flaky.
+func newRetryWorker(job *Job, testFunction string) *worker {
+	goTestOpts := job.GoTestOptions
+	if len(findFlagValues(goTestOpts, "count")) == 0 {
+		// the options after `-args` are passed to the test binary.
+		i := len(goTestOpts)
+		for j, opt := range goTestOpts {
+			if opt == "-args" || opt == "--args" {
+				i = j
+				break
+			}
+		}
+		goTestOpts = append(append(append([]string(nil), goTestOpts[:i]...), "-count=1"), goTestOpts[i:]...)
+	}
+
+	return &worker{
+		testFuncs:     []string{testFunction},
+		packagePath:   job.DirPath,
+		goTestOptions: goTestOpts,
+		overlayPath:   job.overlayPath,
+		env:           job.env,
 		writer:        job.writer,
 	}
 }
 
 // Start starts the new test.
 func (w *worker) Start(ctx context.Context) error {
-	args := append([]string{"test"}, w.goTestOptions...)
-	runOptIndex := findOptionValueIndex(args, "run")
-	runOptValue := "^" + strings.Join(w.testFuncs, "$|^") + "$"
-	if runOptIndex != -1 {
-		args[runOptIndex] += "|" + runOptValue
-	} else {
-		args = append(args, "-run", runOptValue)
-	}
-	args = append(args, ".")
+	args := w.buildArgs()
 	log.Debugf("go test command: go %s\n", strings.Join(args, " "))
 
+	w.results = newTestResultWriter()
+	var out io.Writer = w.results
+	if w.writer != nil {
+		out = io.MultiWriter(w.writer, w.results)
+	}
 	w.cmd = exec.CommandContext(ctx, "go", args...)
 	w.cmd.Dir = w.packagePath
-	w.cmd.Stdout = w.writer
-	w.cmd.Stderr = w.writer
+	w.cmd.Env = w.env
+	w.cmd.Stdout = out
+	w.cmd.Stderr = out
 	if err := w.cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start the test: %w", err)
 	}
@@ -61,5 +95,139 @@ func (w *worker) Wait() (bool, error) {
 		return true, nil
 	}
 	err := w.cmd.Wait()
-	return err == nil, err
+	w.succeeded = err == nil
+	return w.succeeded, err
+}
+
+// TestResults returns the results of the test functions of the worker, `PASS`, `FAIL` or `SKIP`, keyed by the test function.
+// The results are parsed from the output, so the passed test functions have no result unless the `-v` option is specified.
+// They are considered to be passed if the go test command succeeded, or the test binary ran all the test functions
+// (i.e. it printed the final `FAIL` line and the `-failfast` option is not specified).
+// The test function without the result didn't finish, for example, because the other test function panicked.
+func (w *worker) TestResults() map[string]string {
+	results := make(map[string]string)
+	if w.results == nil {
+		return results
+	}
+
+	w.results.mtx.Lock()
+	defer w.results.mtx.Unlock()
+	ranAll := w.succeeded || w.results.completed && !hasFailfast(w.goTestOptions)
+	for _, testFunction := range w.testFuncs {
+		if result, ok := w.results.results[testFunction]; ok {
+			results[testFunction] = result
+		} else if ranAll {
+			results[testFunction] = "PASS"
+		}
+	}
+	return results
+}
+
+// hasFailfast returns true if the options have the `-failfast` option, which stops the test binary without
+// running the remaining test functions.
+func hasFailfast(opts []string) bool {
+	for _, opt := range opts {
+		if opt == "-args" || opt == "--args" {
+			break
+		}
+		switch strings.TrimLeft(opt, "-") {
+		case "failfast", "failfast=true", "test.failfast", "test.failfast=true":
+			return true
+		}
+	}
+	return false
+}
+
+// buildArgs builds the args of the go command, like `test -run ^TestSum$ .`.
+func (w *worker) buildArgs() []string {
+	args := append([]string{"test"}, w.goTestOptions...)
+	if w.overlayPath != "" {
+		args = append(args, "-overlay", w.overlayPath)
+	}
+	runOptIndex := findOptionValueIndex(args, "run")
+	runOptValue := "^" + strings.Join(w.testFuncs, "$|^") + "$"
+	if runOptIndex != -1 {
+		args[runOptIndex] += "|" + runOptValue
+	} else {
+		args = append(args, "-run", runOptValue)
+	}
+	return append(args, ".")
+}
+
+// CommandLine returns the command line the worker executes. The args are quoted so that it can be pasted to the shell.
+func (w *worker) CommandLine() string {
+	args := w.buildArgs()
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return "go " + strings.Join(quoted, " ")
+}
+
+// shellQuote quotes the arg with single quotes if it has any character the shell may interpret.
+func shellQuote(arg string) string {
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_=+.,/:@%", r))
+	}) == -1 {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// testResultWriter parses the results of the top-level test functions from the written test output, line by line.
+// Like `eventWriter`, the results of the passed tests are available only when the `-v` option is specified.
+type testResultWriter struct {
+	buf bytes.Buffer
+	// `PASS`, `FAIL` or `SKIP`, keyed by the test function. `FAIL` is kept even if the test passes later (e.g. `-count=2`).
+	results map[string]string
+	// true if the test binary printed the final `PASS` or `FAIL` line, i.e. it ran all the test functions.
+	completed bool
+	// true if the go command printed the summary line of the package.
+	summarized bool
+	mtx        sync.Mutex
+}
+
+func newTestResultWriter() *testResultWriter {
+	return &testResultWriter{results: make(map[string]string)}
+}
+
+func (w *testResultWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i == -1 {
+			break
+		}
+		line := string(w.buf.Next(i + 1))
+		if match := patternTestResult.FindStringSubmatch(line); match != nil && !strings.Contains(match[2], "/") {
+			if w.results[match[2]] != "FAIL" {
+				w.results[match[2]] = match[1]
+			}
+		}
+		// the go command also prints `FAIL` after the summary line of the package (`FAIL\t<package>\t<time>`).
+		if trimmed := strings.TrimRight(line, "\r\n"); (trimmed == "PASS" || trimmed == "FAIL") && !w.summarized {
+			w.completed = true
+		} else if strings.HasPrefix(trimmed, "FAIL\t") || strings.HasPrefix(trimmed, "ok  \t") {
+			w.summarized = true
+		}
+	}
+	return len(p), nil
+}
+
+// find returns the sorted test functions which have the result.
+func (w *testResultWriter) find(result string) []string {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	var testFunctions []string
+	for testFunction, r := range w.results {
+		if r == result {
+			testFunctions = append(testFunctions, testFunction)
+		}
+	}
+	sort.Strings(testFunctions)
+	return testFunctions
 }
@@ -2,8 +2,10 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -149,3 +151,107 @@ func TestWorker_WithRunOptions(t *testing.T) {
 		t.Errorf("unexpected content: %s", buff.String())
 	}
 }
+
+func TestWorker_CommandLine(t *testing.T) {
+	for _, testCase := range []struct {
+		goTestOptions []string
+		testFuncs     []string
+		expect        string
+	}{
+		{nil, []string{"TestSum"}, "go test -run '^TestSum$' ."},
+		{[]string{"-v"}, []string{"TestSum", "TestSub"}, "go test -v -run '^TestSum$|^TestSub$' ."},
+		{[]string{"-run", "TestSum_ErrorCase"}, []string{"TestSum"}, "go test -run 'TestSum_ErrorCase|^TestSum$' ."},
+		{[]string{"-tags", "a b", "-ldflags=-X 'main.v=1'"}, []string{"TestSum"}, `go test -tags 'a b' '-ldflags=-X '\''main.v=1'\''' -run '^TestSum$' .`},
+	} {
+		w := &worker{goTestOptions: testCase.goTestOptions, testFuncs: testCase.testFuncs}
+		if actual := w.CommandLine(); actual != testCase.expect {
+			t.Errorf("wrong command line: %s", actual)
+		}
+	}
+}
+
+func TestWorker_TestResults(t *testing.T) {
+	currDir, _ := os.Getwd()
+
+	for i, testCase := range []struct {
+		dir      string
+		opts     []string
+		expected map[string]string
+	}{
+		// the test binary ran all the test functions.
+		{"flaky", nil, map[string]string{"TestFlaky": "FAIL", "TestStable": "PASS"}},
+		{"flaky", []string{"-v"}, map[string]string{"TestFlaky": "FAIL", "TestStable": "PASS"}},
+		{"flaky", []string{"-failfast"}, map[string]string{"TestFlaky": "FAIL"}},
+		// TestAfterPanic doesn't run.
+		{"panic", []string{"-v"}, map[string]string{"TestPanic": "FAIL"}},
+	} {
+		job := &Job{DirPath: filepath.Join(currDir, "testdata", testCase.dir), GoTestOptions: append([]string{"-count=1"}, testCase.opts...)}
+		taskSet := &TaskSet{}
+		for _, testFunction := range []string{"TestFlaky", "TestStable", "TestPanic", "TestAfterPanic"} {
+			if testCase.dir == "flaky" == strings.Contains(testFunction, "Panic") {
+				continue
+			}
+			taskSet.Tasks = append(taskSet.Tasks, &Task{TestFunction: testFunction})
+		}
+		w := newWorker(job, taskSet)
+		if err := w.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		w.Wait()
+
+		if results := w.TestResults(); !reflect.DeepEqual(testCase.expected, results) {
+			t.Errorf("[%d] unexpected results: %v", i, results)
+		}
+	}
+}
+
+func TestTestResultWriter(t *testing.T) {
+	w := newTestResultWriter()
+	fmt.Fprint(w, "--- PASS: TestSum (0.01s)\n--- FAIL: TestSub (0.00s)\n    --- FAIL: TestSub/sub")
+	fmt.Fprint(w, "test (0.00s)\n--- FAIL: TestMul (0.00s)")
+
+	if failed := w.find("FAIL"); !reflect.DeepEqual([]string{"TestSub"}, failed) {
+		t.Errorf("unexpected failed tests: %v", failed)
+	}
+	if passed := w.find("PASS"); !reflect.DeepEqual([]string{"TestSum"}, passed) {
+		t.Errorf("unexpected passed tests: %v", passed)
+	}
+	if w.completed {
+		t.Errorf("completed before the final line")
+	}
+
+	// the final line of the go command.
+	fmt.Fprint(w, "\nFAIL\tpkg\t0.01s\nFAIL\n")
+	if w.completed {
+		t.Errorf("completed by the final line of the go command")
+	}
+
+	// the failure is kept, e.g. with `-count=2`.
+	w = newTestResultWriter()
+	fmt.Fprint(w, "--- FAIL: TestMul (0.00s)\n--- FAIL: TestSub (0.00s)\n--- PASS: TestSub (0.00s)\nFAIL\nFAIL\tpkg\t0.01s\n")
+	if failed := w.find("FAIL"); !reflect.DeepEqual([]string{"TestMul", "TestSub"}, failed) {
+		t.Errorf("unexpected failed tests: %v", failed)
+	}
+	if !w.completed {
+		t.Errorf("not completed")
+	}
+}
+
+func TestNewRetryWorker(t *testing.T) {
+	for i, testCase := range []struct {
+		opts   []string
+		expect []string
+	}{
+		{nil, []string{"-count=1"}},
+		{[]string{"-v", "-args", "-x"}, []string{"-v", "-count=1", "-args", "-x"}},
+		{[]string{"-count", "5"}, []string{"-count", "5"}},
+	} {
+		w := newRetryWorker(&Job{GoTestOptions: testCase.opts}, "TestSum")
+		if !reflect.DeepEqual(testCase.expect, w.goTestOptions) {
+			t.Errorf("[%d] unexpected options: %v", i, w.goTestOptions)
+		}
+		if !reflect.DeepEqual([]string{"TestSum"}, w.testFuncs) {
+			t.Errorf("[%d] unexpected test functions: %v", i, w.testFuncs)
+		}
+	}
+}